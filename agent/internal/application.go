@@ -6,34 +6,151 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
-	"strconv"
 	"sync"
 	"time"
 )
+
 type TaskWrapper struct {
-    Task Task `json:"task"`
+	Task Task `json:"task"`
 }
 
 type Task struct {
 	ID            string    `json:"id"`
-	Arg1          string    `json:"arg1"`          
-	Arg2          string    `json:"arg2"`          
-	Operation     Operation `json:"operation"`     
+	LeaseID       string    `json:"lease_id"`
+	Args          []Operand `json:"args"`
+	Operation     Operation `json:"operation"`
 	OperationTime int       `json:"operation_time"`
+	// Mode — режим вычислений: "float", "decimal" (аргументы и результат —
+	// десятичные строки, результат округляется до decimalDigits значащих цифр)
+	// или "rational" (точные дроби "p/q").
+	Mode NumberMode `json:"mode,omitempty"`
+	// Unit — единица результата; агент только возвращает её вместе с результатом.
+	Unit string `json:"unit,omitempty"`
+}
+
+// Operand — аргумент задачи: значение Value, ссылка Ref на другую задачу
+// или список List из таких операндов. Оркестратор выдаёт задачу, только
+// когда все её аргументы вычислены, поэтому ссылка в полученной задаче —
+// ошибка протокола.
+type Operand struct {
+	Value json.RawMessage `json:"value,omitempty"`
+	Ref   string          `json:"ref,omitempty"`
+	List  []Operand       `json:"list,omitempty"`
+}
+
+// flattenArgs раскрывает списки среди аргументов в их элементы, так что
+// агрегаты считают над всеми числами подряд. У dot оба аргумента — списки
+// одной длины: сначала идут элементы первого, затем второго.
+func flattenArgs(task *Task) ([]Operand, error) {
+	if task.Operation == OperationDot && len(task.Args[0].List) != len(task.Args[1].List) {
+		return nil, &TaskError{Code: ErrCodeInvalidArgument, Message: "dot expects two lists of the same length"}
+	}
+	var args []Operand
+	for _, arg := range task.Args {
+		if arg.List == nil {
+			args = append(args, arg)
+			continue
+		}
+		for _, item := range arg.List {
+			if item.List != nil {
+				return nil, &TaskError{Code: ErrCodeInvalidArgument, Message: "nested lists are not supported"}
+			}
+			args = append(args, item)
+		}
+	}
+	return args, nil
+}
+
+// parseFloat читает аргумент режима float — число JSON.
+func parseFloat(arg Operand) (float64, error) {
+	var value float64
+	if err := json.Unmarshal(arg.Value, &value); err != nil {
+		return 0, &TaskError{Code: ErrCodeInvalidArgument, Message: fmt.Sprintf("invalid argument %s", arg.Value)}
+	}
+	return value, nil
+}
+
+// textArg возвращает значение операнда в режимах decimal и rational, где
+// числа передаются строками.
+func textArg(arg Operand) (string, error) {
+	var text string
+	if err := json.Unmarshal(arg.Value, &text); err != nil {
+		return "", &TaskError{Code: ErrCodeInvalidArgument, Message: fmt.Sprintf("invalid argument %s", arg.Value)}
+	}
+	return text, nil
 }
 
+type NumberMode string
+
+const (
+	NumberModeFloat    NumberMode = "float"
+	NumberModeDecimal  NumberMode = "decimal"
+	NumberModeRational NumberMode = "rational"
+	// NumberModeComplex — комплексные числа в complex128, значения — объекты Complex.
+	NumberModeComplex NumberMode = "complex"
+	// NumberModeInterval — отрезки float64 с округлением наружу, значения — объекты Interval.
+	NumberModeInterval NumberMode = "interval"
+)
+
 type Operation string
+
 const (
 	OperationAddition       Operation = "addition"
 	OperationSubtraction    Operation = "subtraction"
 	OperationMultiplication Operation = "multiplication"
 	OperationDivision       Operation = "division"
+	OperationNegation       Operation = "negation"
+	// Операция "^": возведение в степень.
+	OperationExponentiation Operation = "exponentiation"
+	// Операция "%": остаток от деления с округлением вниз, a - b*floor(a/b);
+	// знак остатка совпадает со знаком делителя, как и у "//".
+	OperationModulo Operation = "modulo"
+	// Операция "//": деление с округлением вниз.
+	OperationIntegerDivision Operation = "integer_division"
+
+	// Сравнения и логические операции возвращают 1 или 0; истинно любое
+	// ненулевое значение.
+	OperationLess         Operation = "less"
+	OperationLessEqual    Operation = "less_equal"
+	OperationGreater      Operation = "greater"
+	OperationGreaterEqual Operation = "greater_equal"
+	OperationEqual        Operation = "equal"
+	OperationNotEqual     Operation = "not_equal"
+	OperationAnd          Operation = "and"
+	OperationOr           Operation = "or"
+	OperationNot          Operation = "not"
+
+	// Встроенные функции. log с одним аргументом — натуральный логарифм,
+	// log(x, b) — логарифм по основанию b.
+	OperationSqrt Operation = "sqrt"
+	OperationAbs  Operation = "abs"
+	OperationMin  Operation = "min"
+	OperationMax  Operation = "max"
+	OperationLog  Operation = "log"
+	OperationExp  Operation = "exp"
+	OperationSin  Operation = "sin"
+	OperationCos  Operation = "cos"
+	OperationTan  Operation = "tan"
+
+	// Агрегаты над списками: sum считает сумму всех чисел и элементов
+	// списков, dot — скалярное произведение двух списков.
+	OperationSum Operation = "sum"
+	OperationDot Operation = "dot"
+
+	// Матричные операции: matmul возвращает матрицу — массив строк JSON,
+	// determinant — число. Аргументы — матрицы, списки строк-списков.
+	OperationMatmul      Operation = "matmul"
+	OperationDeterminant Operation = "determinant"
 )
 
 type Result struct {
-	ID     string  `json:"id"`
-	Result float64 `json:"result"`
+	ID      string          `json:"id"`
+	LeaseID string          `json:"lease_id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Unit    string          `json:"unit,omitempty"`
+	Error   *TaskError      `json:"error,omitempty"`
 }
 
 type Agent struct {
@@ -62,17 +179,16 @@ func (a *Agent) fetchTask() (*Task, error) {
 
 	var taskWrapper TaskWrapper
 	body, _ := io.ReadAll(resp.Body)
-	fmt.Println("Received raw JSON:", string(body)) 
+	fmt.Println("Received raw JSON:", string(body))
 
 	if err := json.Unmarshal(body, &taskWrapper); err != nil {
 		return nil, err
 	}
 
-	fmt.Printf("Parsed task: %+v\n", taskWrapper.Task) 
+	fmt.Printf("Parsed task: %+v\n", taskWrapper.Task)
 	return &taskWrapper.Task, nil
 }
 
-
 func (a *Agent) sendResult(result Result) error {
 	data, err := json.Marshal(result)
 	if err != nil {
@@ -87,69 +203,284 @@ func (a *Agent) sendResult(result Result) error {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		
+
 		return fmt.Errorf("failed to send result, status: %d, body: %s", resp.StatusCode, string(body))
 	}
 
 	return nil
 }
 
-func compute(task *Task) (float64, error) {
-	fmt.Printf("Received operation: '%s'\n", task.Operation) 
+// Коды ошибок, которые агент сообщает оркестратору.
+const (
+	ErrCodeInvalidArgument  = "invalid_argument"
+	ErrCodeDivisionByZero   = "division_by_zero"
+	ErrCodeUnknownOperation = "unknown_operation"
+	ErrCodeDomainError      = "domain_error"
+	ErrCodeOverflow         = "overflow"
+)
+
+// TaskError — ошибка вычисления задачи, передаваемая оркестратору.
+type TaskError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *TaskError) Error() string {
+	return e.Message
+}
+
+// compute выполняет задачу в её режиме и кодирует результат для оркестратора:
+// числом в режиме float, строкой в режимах decimal и rational, объектом
+// {"re": .., "im": ..} в режиме complex и {"lo": .., "hi": ..} в режиме interval.
+func compute(task *Task) (json.RawMessage, error) {
+	fmt.Printf("Received operation: '%s'\n", task.Operation)
+
+	arity, ok := operationArity[task.Operation]
+	if !ok {
+		return nil, &TaskError{Code: ErrCodeUnknownOperation, Message: fmt.Sprintf("unknown operation %q", task.Operation)}
+	}
+	if len(task.Args) < arity.min || (arity.max >= 0 && len(task.Args) > arity.max) {
+		return nil, &TaskError{Code: ErrCodeInvalidArgument, Message: fmt.Sprintf("%s does not accept %d arguments", task.Operation, len(task.Args))}
+	}
+	if task.Operation == OperationMatmul || task.Operation == OperationDeterminant {
+		return computeMatrix(task)
+	}
+	args, err := flattenArgs(task)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, &TaskError{Code: ErrCodeInvalidArgument, Message: "empty list"}
+	}
+	for _, arg := range args {
+		if arg.Ref != "" || arg.Value == nil {
+			return nil, &TaskError{Code: ErrCodeInvalidArgument, Message: "task has unresolved arguments"}
+		}
+	}
+	flat := *task
+	flat.Args = args
+	task = &flat
+	switch task.Mode {
+	case "", NumberModeFloat:
+		result, err := computeFloat(task)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(result)
+	case NumberModeDecimal:
+		result, err := computeDecimal(task)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(formatDecimal(result))
+	case NumberModeRational:
+		result, err := computeRational(task)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(result.RatString())
+	case NumberModeComplex:
+		result, err := computeComplex(task)
+		if err != nil {
+			return nil, err
+		}
+		return encodeComplex(result)
+	case NumberModeInterval:
+		result, err := computeInterval(task)
+		if err != nil {
+			return nil, err
+		}
+		return encodeInterval(result)
+	default:
+		return nil, &TaskError{Code: ErrCodeUnknownOperation, Message: fmt.Sprintf("unknown number mode %q", task.Mode)}
+	}
+}
+
+// computeFloat выполняет задачу в float64 и проверяет, что результат —
+// конечное число, иначе его нельзя передать оркестратору в JSON.
+func computeFloat(task *Task) (float64, error) {
+	args := make([]float64, len(task.Args))
+	for i, arg := range task.Args {
+		var err error
+		if args[i], err = parseFloat(arg); err != nil {
+			return 0, err
+		}
+	}
+	result, err := computeOperation(task.Operation, args)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(result) {
+		return 0, &TaskError{Code: ErrCodeDomainError, Message: fmt.Sprintf("%s is undefined for %v", task.Operation, args)}
+	}
+	if math.IsInf(result, 0) {
+		return 0, &TaskError{Code: ErrCodeOverflow, Message: fmt.Sprintf("%s result is out of range", task.Operation)}
+	}
+	return result, nil
+}
 
-	switch task.Operation {
+// operationArity — допустимое число аргументов операции; max < 0 означает
+// вариадическую операцию.
+var operationArity = map[Operation]struct{ min, max int }{
+	OperationAddition:        {2, 2},
+	OperationSubtraction:     {2, 2},
+	OperationMultiplication:  {2, 2},
+	OperationDivision:        {2, 2},
+	OperationNegation:        {1, 1},
+	OperationExponentiation:  {2, 2},
+	OperationModulo:          {2, 2},
+	OperationIntegerDivision: {2, 2},
+	OperationLess:            {2, 2},
+	OperationLessEqual:       {2, 2},
+	OperationGreater:         {2, 2},
+	OperationGreaterEqual:    {2, 2},
+	OperationEqual:           {2, 2},
+	OperationNotEqual:        {2, 2},
+	OperationAnd:             {2, 2},
+	OperationOr:              {2, 2},
+	OperationNot:             {1, 1},
+	OperationSqrt:            {1, 1},
+	OperationAbs:             {1, 1},
+	OperationMin:             {1, -1},
+	OperationMax:             {1, -1},
+	OperationLog:             {1, 2},
+	OperationExp:             {1, 1},
+	OperationSin:             {1, 1},
+	OperationCos:             {1, 1},
+	OperationTan:             {1, 1},
+	OperationSum:             {1, -1},
+	OperationDot:             {2, 2},
+	OperationMatmul:          {2, 2},
+	OperationDeterminant:     {1, 1},
+}
+
+// compareResult переводит результат сравнения cmp (-1, 0 или 1) в значение
+// операции сравнения.
+func compareResult(operation Operation, cmp int) bool {
+	switch operation {
+	case OperationLess:
+		return cmp < 0
+	case OperationLessEqual:
+		return cmp <= 0
+	case OperationGreater:
+		return cmp > 0
+	case OperationGreaterEqual:
+		return cmp >= 0
+	case OperationEqual:
+		return cmp == 0
+	}
+	return cmp != 0
+}
 
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func computeOperation(operation Operation, args []float64) (float64, error) {
+	switch operation {
 	case OperationAddition:
-		operand1, err1 := strconv.ParseFloat(task.Arg1, 64)
-		if err1 != nil {
-            return 0, err1
-        }
-		operand2, err2 := strconv.ParseFloat(task.Arg2, 64)
-		if err2 != nil {
-            return 0, err2
-        }
-		return operand1 + operand2, nil
+		return args[0] + args[1], nil
 	case OperationSubtraction:
-		operand1, err1 := strconv.ParseFloat(task.Arg1, 64)
-		if err1 != nil {
-            return 0, err1
-        }
-		operand2, err2 := strconv.ParseFloat(task.Arg2, 64)
-		if err2 != nil {
-            return 0, err2
-        }
-		time.Sleep(5*time.Second)
-		return operand1 - operand2, nil
+		return args[0] - args[1], nil
 	case OperationMultiplication:
-		operand1, err1 := strconv.ParseFloat(task.Arg1, 64)
-		if err1 != nil {
-            return 0, err1
-        }
-		operand2, err2 := strconv.ParseFloat(task.Arg2, 64)
-		if err2 != nil {
-            return 0, err2
-        }
-		time.Sleep(5*time.Second)
-
-		return operand1 * operand2, nil
+		return args[0] * args[1], nil
 	case OperationDivision:
-		operand1, err1 := strconv.ParseFloat(task.Arg1, 64)
-		if err1 != nil {
-			return 0, err1
+		if args[1] == 0 {
+			return 0, &TaskError{Code: ErrCodeDivisionByZero, Message: "division by zero"}
 		}
-		operand2, err2  := strconv.ParseFloat(task.Arg2, 64) 
-		if err2 != nil {
-            return 0, err2
-        }
-		if operand2 == 0 {
-			return 0, fmt.Errorf("division by zero")
+		return args[0] / args[1], nil
+	case OperationNegation:
+		return -args[0], nil
+	case OperationExponentiation:
+		return math.Pow(args[0], args[1]), nil
+	case OperationModulo:
+		if args[1] == 0 {
+			return 0, &TaskError{Code: ErrCodeDivisionByZero, Message: "modulo by zero"}
 		}
-		time.Sleep(5*time.Second)
-
-		return operand1 / operand2, nil
-		
+		r := math.Mod(args[0], args[1])
+		switch {
+		case r == 0:
+			// math.Mod сохраняет знак делимого и у нуля.
+			r = 0
+		case (r < 0) != (args[1] < 0):
+			r += args[1]
+		}
+		return r, nil
+	case OperationIntegerDivision:
+		if args[1] == 0 {
+			return 0, &TaskError{Code: ErrCodeDivisionByZero, Message: "integer division by zero"}
+		}
+		return math.Floor(args[0] / args[1]), nil
+	case OperationLess, OperationLessEqual, OperationGreater, OperationGreaterEqual, OperationEqual, OperationNotEqual:
+		cmp := 0
+		if args[0] < args[1] {
+			cmp = -1
+		} else if args[0] > args[1] {
+			cmp = 1
+		}
+		return boolValue(compareResult(operation, cmp)), nil
+	case OperationAnd:
+		return boolValue(args[0] != 0 && args[1] != 0), nil
+	case OperationOr:
+		return boolValue(args[0] != 0 || args[1] != 0), nil
+	case OperationNot:
+		return boolValue(args[0] == 0), nil
+	case OperationSqrt:
+		if args[0] < 0 {
+			return 0, &TaskError{Code: ErrCodeDomainError, Message: "square root of a negative number"}
+		}
+		return math.Sqrt(args[0]), nil
+	case OperationAbs:
+		return math.Abs(args[0]), nil
+	case OperationMin:
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Min(result, arg)
+		}
+		return result, nil
+	case OperationMax:
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Max(result, arg)
+		}
+		return result, nil
+	case OperationSum:
+		var result float64
+		for _, arg := range args {
+			result += arg
+		}
+		return result, nil
+	case OperationDot:
+		var result float64
+		n := len(args) / 2
+		for i := 0; i < n; i++ {
+			result += args[i] * args[n+i]
+		}
+		return result, nil
+	case OperationLog:
+		if args[0] <= 0 {
+			return 0, &TaskError{Code: ErrCodeDomainError, Message: "logarithm of a non-positive number"}
+		}
+		if len(args) == 1 {
+			return math.Log(args[0]), nil
+		}
+		if args[1] <= 0 || args[1] == 1 {
+			return 0, &TaskError{Code: ErrCodeDomainError, Message: "invalid logarithm base"}
+		}
+		return math.Log(args[0]) / math.Log(args[1]), nil
+	case OperationExp:
+		return math.Exp(args[0]), nil
+	case OperationSin:
+		return math.Sin(args[0]), nil
+	case OperationCos:
+		return math.Cos(args[0]), nil
+	case OperationTan:
+		return math.Tan(args[0]), nil
 	default:
-		return 0, fmt.Errorf("unknown operation")
+		return 0, &TaskError{Code: ErrCodeUnknownOperation, Message: fmt.Sprintf("unknown operation %q", operation)}
 	}
 }
 
@@ -163,13 +494,23 @@ func (a *Agent) worker() {
 			continue
 		}
 
+		// Оркестратор рассчитывает аренду задачи исходя из OperationTime,
+		// поэтому искусственная задержка должна ему соответствовать.
+		time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
 		result, err := compute(task)
 		if err != nil {
 			log.Println("Error computing task:", err)
+			taskErr, ok := err.(*TaskError)
+			if !ok {
+				taskErr = &TaskError{Code: ErrCodeInvalidArgument, Message: err.Error()}
+			}
+			if err := a.sendResult(Result{ID: task.ID, LeaseID: task.LeaseID, Error: taskErr}); err != nil {
+				log.Println("Error sending failure:", err)
+			}
 			continue
 		}
 
-		if err := a.sendResult(Result{ID: task.ID, Result: result}); err != nil {
+		if err := a.sendResult(Result{ID: task.ID, LeaseID: task.LeaseID, Result: result, Unit: task.Unit}); err != nil {
 			log.Println("Error sending result:", err)
 		}
 	}
@@ -182,5 +523,3 @@ func (a *Agent) Run() {
 	}
 	a.wg.Wait()
 }
-
-
@@ -0,0 +1,246 @@
+package agent
+
+import (
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// operands разбирает аргументы задачи из JSON-массива: вложенный массив
+// становится списком, остальные значения — значениями операндов.
+func operands(t *testing.T, raw string) []Operand {
+	t.Helper()
+	var items []json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &items); err != nil {
+		t.Fatalf("Invalid arguments %s: %v", raw, err)
+	}
+	out := make([]Operand, len(items))
+	for i, item := range items {
+		if item[0] == '[' {
+			out[i] = Operand{List: operands(t, string(item))}
+		} else {
+			out[i] = Operand{Value: item}
+		}
+	}
+	return out
+}
+
+func TestCompute(t *testing.T) {
+	tests := []struct {
+		mode      NumberMode
+		operation Operation
+		args      string
+		expected  string
+	}{
+		{NumberModeFloat, OperationAddition, `[2, 3]`, `5`},
+		{NumberModeFloat, OperationSubtraction, `[2, 3]`, `-1`},
+		{NumberModeFloat, OperationMultiplication, `[-1.5, 4]`, `-6`},
+		{NumberModeFloat, OperationDivision, `[1, 4]`, `0.25`},
+		{NumberModeFloat, OperationNegation, `[2.5]`, `-2.5`},
+		{NumberModeFloat, OperationExponentiation, `[2, 10]`, `1024`},
+		{NumberModeFloat, OperationExponentiation, `[4, -0.5]`, `0.5`},
+		{NumberModeFloat, OperationModulo, `[7, 3]`, `1`},
+		{NumberModeFloat, OperationIntegerDivision, `[7, 2]`, `3`},
+		// "%" и "//" согласованы: a = b*(a // b) + a % b, остаток со знаком делителя.
+		{NumberModeFloat, OperationModulo, `[-7, 3]`, `2`},
+		{NumberModeFloat, OperationIntegerDivision, `[-7, 3]`, `-3`},
+		{NumberModeFloat, OperationModulo, `[7, -3]`, `-2`},
+		{NumberModeFloat, OperationIntegerDivision, `[7, -3]`, `-3`},
+		{NumberModeFloat, OperationModulo, `[-7, -3]`, `-1`},
+		{NumberModeFloat, OperationModulo, `[-6, 3]`, `0`},
+		{NumberModeFloat, OperationSqrt, `[16]`, `4`},
+		{NumberModeFloat, OperationAbs, `[-3]`, `3`},
+		{NumberModeFloat, OperationMin, `[3, -1, 2]`, `-1`},
+		{NumberModeFloat, OperationMax, `[3, -1, 2]`, `3`},
+		{NumberModeFloat, OperationLog, `[1]`, `0`},
+		{NumberModeFloat, OperationLog, `[8, 2]`, `3`},
+		{NumberModeFloat, OperationExp, `[0]`, `1`},
+		{NumberModeFloat, OperationSin, `[0]`, `0`},
+		{NumberModeFloat, OperationCos, `[0]`, `1`},
+		{NumberModeFloat, OperationSum, `[[1, 2, 3]]`, `6`},
+		{NumberModeFloat, OperationSum, `[[1, 2], 3]`, `6`},
+		{NumberModeFloat, OperationMax, `[[1, 5], [2]]`, `5`},
+		{NumberModeFloat, OperationDot, `[[1, 2], [3, 4]]`, `11`},
+		{NumberModeFloat, OperationLess, `[1, 2]`, `1`},
+		{NumberModeFloat, OperationGreaterEqual, `[1, 2]`, `0`},
+		{NumberModeFloat, OperationEqual, `[0.5, 0.5]`, `1`},
+		{NumberModeFloat, OperationNotEqual, `[0.5, 0.5]`, `0`},
+		{NumberModeFloat, OperationAnd, `[2, 0]`, `0`},
+		{NumberModeFloat, OperationOr, `[2, 0]`, `1`},
+		{NumberModeFloat, OperationNot, `[0]`, `1`},
+		{NumberModeDecimal, OperationAddition, `["0.1", "0.2"]`, `"0.3"`},
+		{NumberModeDecimal, OperationMultiplication, `["1.5", "-2"]`, `"-3"`},
+		{NumberModeDecimal, OperationExponentiation, `["1.5", "2"]`, `"2.25"`},
+		{NumberModeDecimal, OperationModulo, `["7.5", "2"]`, `"1.5"`},
+		{NumberModeDecimal, OperationIntegerDivision, `["7.5", "2"]`, `"3"`},
+		{NumberModeDecimal, OperationModulo, `["-7.5", "2"]`, `"0.5"`},
+		{NumberModeDecimal, OperationIntegerDivision, `["-7.5", "2"]`, `"-4"`},
+		{NumberModeDecimal, OperationModulo, `["7.5", "-2"]`, `"-0.5"`},
+		{NumberModeDecimal, OperationMax, `["0.1", "0.3", "0.2"]`, `"0.3"`},
+		{NumberModeDecimal, OperationLessEqual, `["0.3", "0.30"]`, `"1"`},
+		{NumberModeRational, OperationAddition, `["1/3", "1/6"]`, `"1/2"`},
+		{NumberModeDecimal, OperationSum, `[["0.1", "0.2", "0.3"]]`, `"0.6"`},
+		{NumberModeDecimal, OperationExponentiation, `["1.1", "2"]`, `"1.21"`},
+		{NumberModeDecimal, OperationDivision, `["1", "3"]`, `"0.` + strings.Repeat("3", 50) + `"`},
+		{NumberModeDecimal, OperationDivision, `["2", "3"]`, `"0.` + strings.Repeat("6", 49) + `7"`},
+		{NumberModeDecimal, OperationSqrt, `["2.25"]`, `"1.5"`},
+		{NumberModeRational, OperationDot, `[["1/2", "1/3"], ["2", "3"]]`, `"2"`},
+		{NumberModeRational, OperationGreater, `["1/3", "1/4"]`, `"1"`},
+		{NumberModeRational, OperationNot, `["1/3"]`, `"0"`},
+		{NumberModeRational, OperationDivision, `["2", "6"]`, `"1/3"`},
+		{NumberModeRational, OperationExponentiation, `["2/3", "-2"]`, `"9/4"`},
+		{NumberModeRational, OperationExponentiation, `["-1", "4096"]`, `"1"`},
+		{NumberModeRational, OperationModulo, `["7/2", "1"]`, `"1/2"`},
+		{NumberModeRational, OperationIntegerDivision, `["7/2", "1"]`, `"3"`},
+		{NumberModeRational, OperationModulo, `["-7/2", "1"]`, `"1/2"`},
+		{NumberModeRational, OperationIntegerDivision, `["-7/2", "1"]`, `"-4"`},
+		{NumberModeRational, OperationModulo, `["7/2", "-1"]`, `"-1/2"`},
+		{NumberModeRational, OperationIntegerDivision, `["7/2", "-1"]`, `"-4"`},
+		{NumberModeRational, OperationMin, `["1/2", "1/3"]`, `"1/3"`},
+		{NumberModeComplex, OperationMultiplication, `[{"re": 1, "im": 2}, {"re": 3, "im": 4}]`, `{"re":-5,"im":10}`},
+		{NumberModeComplex, OperationDivision, `[{"re": 0, "im": 2}, {"re": 0, "im": 1}]`, `{"re":2,"im":0}`},
+		{NumberModeComplex, OperationSqrt, `[{"re": -4, "im": 0}]`, `{"re":0,"im":2}`},
+		{NumberModeComplex, OperationAbs, `[{"re": 3, "im": -4}]`, `{"re":5,"im":0}`},
+		{NumberModeComplex, OperationEqual, `[{"re": 1, "im": 1}, {"re": 1, "im": 1}]`, `{"re":1,"im":0}`},
+		{NumberModeInterval, OperationAddition, `[{"lo": 1, "hi": 2}, {"lo": 3, "hi": 4}]`, `{"lo":4,"hi":6}`},
+		{NumberModeInterval, OperationMultiplication, `[{"lo": -1, "hi": 2}, {"lo": 3, "hi": 4}]`, `{"lo":-4,"hi":8}`},
+		{NumberModeInterval, OperationSqrt, `[{"lo": 4, "hi": 9}]`, `{"lo":2,"hi":3}`},
+		{NumberModeInterval, OperationExponentiation, `[{"lo": -2, "hi": 1}, {"lo": 2, "hi": 2}]`, `{"lo":0,"hi":4}`},
+		// Матрицы.
+		{NumberModeFloat, OperationDeterminant, `[[[1, 2], [2, 4]]]`, `0`},
+		{NumberModeFloat, OperationDeterminant, `[[[0, 1], [1, 0]]]`, `-1`},
+		{NumberModeFloat, OperationMatmul, `[[[1, 2], [3, 4]], [[5], [6]]]`, `[[17],[39]]`},
+		{NumberModeRational, OperationDeterminant, `[[["1/2", "1/3"], ["1/4", "1/6"]]]`, `"0"`},
+		{NumberModeRational, OperationMatmul, `[[["1/2"]], [["2/3"]]]`, `[["1/3"]]`},
+		{NumberModeDecimal, OperationDeterminant, `[[["2", "0.5"], ["0.1", "0.3"]]]`, `"0.55"`},
+		{NumberModeComplex, OperationMatmul, `[[[{"re": 0, "im": 1}]], [[{"re": 0, "im": 1}]]]`, `[[{"re":-1,"im":0}]]`},
+		{NumberModeInterval, OperationMatmul, `[[[{"lo": 1, "hi": 2}]], [[{"lo": 3, "hi": 3}]]]`, `[[{"lo":3,"hi":6}]]`},
+	}
+	for _, tc := range tests {
+		result, err := compute(&Task{Mode: tc.mode, Operation: tc.operation, Args: operands(t, tc.args)})
+		if err != nil {
+			t.Errorf("For %s %s %s: unexpected error %v", tc.mode, tc.operation, tc.args, err)
+			continue
+		}
+		if string(result) != tc.expected {
+			t.Errorf("For %s %s %s: expected %s, got %s", tc.mode, tc.operation, tc.args, tc.expected, result)
+		}
+	}
+}
+
+func TestComputeErrors(t *testing.T) {
+	tests := []struct {
+		mode      NumberMode
+		operation Operation
+		args      string
+		code      string
+	}{
+		{NumberModeFloat, OperationDivision, `[1, 0]`, ErrCodeDivisionByZero},
+		{NumberModeFloat, OperationAddition, `[1, "abc"]`, ErrCodeInvalidArgument},
+		{NumberModeFloat, Operation("unknown"), `[1, 2]`, ErrCodeUnknownOperation},
+		{NumberModeFloat, OperationModulo, `[1, 0]`, ErrCodeDivisionByZero},
+		{NumberModeFloat, OperationIntegerDivision, `[1, 0]`, ErrCodeDivisionByZero},
+		{NumberModeFloat, OperationExponentiation, `[-8, 0.5]`, ErrCodeDomainError},
+		{NumberModeFloat, OperationExponentiation, `[10, 400]`, ErrCodeOverflow},
+		// Число аргументов проверяется по операции.
+		{NumberModeFloat, OperationAddition, `[1]`, ErrCodeInvalidArgument},
+		{NumberModeFloat, OperationSqrt, `[1, 2]`, ErrCodeInvalidArgument},
+		{NumberModeFloat, OperationMin, `[]`, ErrCodeInvalidArgument},
+		{NumberModeFloat, OperationSqrt, `[-1]`, ErrCodeDomainError},
+		{NumberModeFloat, OperationLog, `[0]`, ErrCodeDomainError},
+		{NumberModeFloat, OperationLog, `[8, 1]`, ErrCodeDomainError},
+		{NumberModeFloat, OperationExp, `[1000]`, ErrCodeOverflow},
+		{NumberModeFloat, OperationSum, `[[]]`, ErrCodeInvalidArgument},
+		{NumberModeFloat, OperationDot, `[[1, 2], [3]]`, ErrCodeInvalidArgument},
+		{NumberModeFloat, OperationSum, `[[[1]]]`, ErrCodeInvalidArgument},
+		{NumberModeDecimal, OperationDivision, `["1", "0"]`, ErrCodeDivisionByZero},
+		{NumberModeDecimal, OperationAddition, `["1", "abc"]`, ErrCodeInvalidArgument},
+		{NumberModeDecimal, OperationExponentiation, `["2", "0.5"]`, ErrCodeDomainError},
+		{NumberModeDecimal, OperationSin, `["1"]`, ErrCodeUnknownOperation},
+		{NumberModeDecimal, OperationMultiplication, `["1e60000", "1e60000"]`, ErrCodeOverflow},
+		{NumberModeDecimal, OperationAddition, `["1/3", "1"]`, ErrCodeInvalidArgument},
+		{NumberModeRational, OperationDivision, `["1/2", "0"]`, ErrCodeDivisionByZero},
+		{NumberModeRational, OperationExponentiation, `["2", "1/2"]`, ErrCodeDomainError},
+		{NumberModeRational, OperationExponentiation, `["0", "-1"]`, ErrCodeDivisionByZero},
+		{NumberModeRational, OperationExponentiation, `["2", "100000"]`, ErrCodeOverflow},
+		{NumberModeRational, OperationExponentiation, `["1/` + strings.Repeat("9", 100) + `", "4000"]`, ErrCodeOverflow},
+		{NumberModeRational, OperationSqrt, `["4"]`, ErrCodeUnknownOperation},
+		{NumberMode("octal"), OperationAddition, `[1, 2]`, ErrCodeUnknownOperation},
+		{NumberModeComplex, OperationDivision, `[{"re": 1, "im": 1}, {"re": 0, "im": 0}]`, ErrCodeDivisionByZero},
+		{NumberModeComplex, OperationLess, `[{"re": 1, "im": 0}, {"re": 2, "im": 0}]`, ErrCodeUnknownOperation},
+		{NumberModeComplex, OperationLog, `[{"re": 0, "im": 0}]`, ErrCodeDomainError},
+		{NumberModeComplex, OperationAddition, `[{"re": 1, "im": 0}, 2]`, ErrCodeInvalidArgument},
+		// Отрезки, захватывающие точки вне области определения.
+		{NumberModeInterval, OperationSqrt, `[{"lo": -1, "hi": 4}]`, ErrCodeDomainError},
+		{NumberModeInterval, OperationLog, `[{"lo": 0, "hi": 1}]`, ErrCodeDomainError},
+		{NumberModeInterval, OperationLog, `[{"lo": -2, "hi": -1}]`, ErrCodeDomainError},
+		{NumberModeInterval, OperationDivision, `[{"lo": 1, "hi": 2}, {"lo": -1, "hi": 1}]`, ErrCodeDivisionByZero},
+		{NumberModeInterval, OperationDivision, `[{"lo": 1, "hi": 2}, {"lo": 0, "hi": 3}]`, ErrCodeDivisionByZero},
+		{NumberModeInterval, OperationExponentiation, `[{"lo": -1, "hi": 1}, {"lo": -1, "hi": -1}]`, ErrCodeDivisionByZero},
+		{NumberModeInterval, OperationExponentiation, `[{"lo": 2, "hi": 3}, {"lo": 0.5, "hi": 0.5}]`, ErrCodeDomainError},
+		{NumberModeInterval, OperationAddition, `[{"lo": 2, "hi": 1}, {"lo": 0, "hi": 0}]`, ErrCodeInvalidArgument},
+		{NumberModeInterval, OperationDeterminant, `[[[{"lo": 1, "hi": 1}]]]`, ErrCodeUnknownOperation},
+		// Матрицы неподходящей формы.
+		{NumberModeFloat, OperationDeterminant, `[[[1, 2, 3], [4, 5, 6]]]`, ErrCodeInvalidArgument},
+		{NumberModeFloat, OperationMatmul, `[[[1, 2]], [[1, 2]]]`, ErrCodeInvalidArgument},
+		{NumberModeFloat, OperationDeterminant, `[[[1, 2], [3]]]`, ErrCodeInvalidArgument},
+		{NumberModeFloat, OperationDeterminant, `[[1, 2]]`, ErrCodeInvalidArgument},
+	}
+	for _, tc := range tests {
+		_, err := compute(&Task{Mode: tc.mode, Operation: tc.operation, Args: operands(t, tc.args)})
+		taskErr, ok := err.(*TaskError)
+		if !ok {
+			t.Errorf("For %s %s %s: expected %s error, got %v", tc.mode, tc.operation, tc.args, tc.code, err)
+			continue
+		}
+		if taskErr.Code != tc.code {
+			t.Errorf("For %s %s %s: expected %s error, got %s (%s)", tc.mode, tc.operation, tc.args, tc.code, taskErr.Code, taskErr.Message)
+		}
+	}
+
+	// Ссылка на задачу в полученной задаче — ошибка протокола.
+	_, err := compute(&Task{Operation: OperationAddition, Args: []Operand{{Ref: "t1"}, {Value: json.RawMessage("1")}}})
+	if taskErr, ok := err.(*TaskError); !ok || taskErr.Code != ErrCodeInvalidArgument {
+		t.Errorf("Expected an unresolved reference to be rejected, got %v", err)
+	}
+}
+
+// TestIntervalRounding проверяет, что границы округляются наружу: отрезок
+// содержит точный результат над границами аргументов, а неточный результат
+// не схлопывается в точку.
+func TestIntervalRounding(t *testing.T) {
+	tests := []struct {
+		operation Operation
+		a, b      float64
+		exact     func(a, b *big.Rat) *big.Rat
+	}{
+		{OperationAddition, 0.1, 0.2, func(a, b *big.Rat) *big.Rat { return new(big.Rat).Add(a, b) }},
+		{OperationSubtraction, 1, 1e-20, func(a, b *big.Rat) *big.Rat { return new(big.Rat).Sub(a, b) }},
+		{OperationMultiplication, 0.1, 0.1, func(a, b *big.Rat) *big.Rat { return new(big.Rat).Mul(a, b) }},
+		{OperationDivision, 1, 3, func(a, b *big.Rat) *big.Rat { return new(big.Rat).Quo(a, b) }},
+		{OperationDivision, -2, 7, func(a, b *big.Rat) *big.Rat { return new(big.Rat).Quo(a, b) }},
+	}
+	for _, tc := range tests {
+		a, _ := json.Marshal(Interval{tc.a, tc.a})
+		b, _ := json.Marshal(Interval{tc.b, tc.b})
+		result, err := compute(&Task{Mode: NumberModeInterval, Operation: tc.operation, Args: []Operand{{Value: a}, {Value: b}}})
+		if err != nil {
+			t.Errorf("For %v %s %v: unexpected error %v", tc.a, tc.operation, tc.b, err)
+			continue
+		}
+		var got Interval
+		json.Unmarshal(result, &got)
+		exact := tc.exact(new(big.Rat).SetFloat64(tc.a), new(big.Rat).SetFloat64(tc.b))
+		lo, hi := new(big.Rat).SetFloat64(got.Lo), new(big.Rat).SetFloat64(got.Hi)
+		if lo.Cmp(exact) > 0 || hi.Cmp(exact) < 0 || got.Lo == got.Hi {
+			t.Errorf("For %v %s %v: expected bounds around %s, got %s", tc.a, tc.operation, tc.b, exact.FloatString(30), result)
+		}
+	}
+
+	// Точный результат не расширяется.
+	result, _ := compute(&Task{Mode: NumberModeInterval, Operation: OperationSqrt, Args: operands(t, `[{"lo": 0.25, "hi": 0.25}]`)})
+	if string(result) != `{"lo":0.5,"hi":0.5}` {
+		t.Errorf("Expected exact sqrt {0.5, 0.5}, got %s", result)
+	}
+}
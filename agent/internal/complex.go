@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/cmplx"
+)
+
+// Complex — значение в режиме complex.
+type Complex struct {
+	Re float64 `json:"re"`
+	Im float64 `json:"im"`
+}
+
+// parseComplex читает аргумент режима complex — объект {"re": .., "im": ..}.
+func parseComplex(arg Operand) (complex128, error) {
+	var value Complex
+	if err := json.Unmarshal(arg.Value, &value); err != nil {
+		return 0, &TaskError{Code: ErrCodeInvalidArgument, Message: fmt.Sprintf("invalid argument %s", arg.Value)}
+	}
+	return complex(value.Re, value.Im), nil
+}
+
+// encodeComplex кодирует результат; к частям прибавляется 0, чтобы -0 не попадал в ответ.
+func encodeComplex(z complex128) (json.RawMessage, error) {
+	if math.IsInf(real(z), 0) || math.IsInf(imag(z), 0) {
+		return nil, &TaskError{Code: ErrCodeOverflow, Message: "result is out of range"}
+	}
+	if math.IsNaN(real(z)) || math.IsNaN(imag(z)) {
+		return nil, &TaskError{Code: ErrCodeDomainError, Message: "result is undefined"}
+	}
+	return json.Marshal(Complex{Re: real(z) + 0, Im: imag(z) + 0})
+}
+
+// computeComplex выполняет задачу в complex128. Комплексные числа не
+// упорядочены, поэтому сравнения кроме == и !=, min, max, % и // недоступны.
+func computeComplex(task *Task) (complex128, error) {
+	args := make([]complex128, len(task.Args))
+	for i, arg := range task.Args {
+		var err error
+		if args[i], err = parseComplex(arg); err != nil {
+			return 0, err
+		}
+	}
+
+	switch task.Operation {
+	case OperationAddition:
+		return args[0] + args[1], nil
+	case OperationSubtraction:
+		return args[0] - args[1], nil
+	case OperationMultiplication:
+		return args[0] * args[1], nil
+	case OperationDivision:
+		if args[1] == 0 {
+			return 0, &TaskError{Code: ErrCodeDivisionByZero, Message: "division by zero"}
+		}
+		return args[0] / args[1], nil
+	case OperationNegation:
+		return -args[0], nil
+	case OperationExponentiation:
+		return cmplx.Pow(args[0], args[1]), nil
+	case OperationEqual, OperationNotEqual:
+		cmp := 0
+		if args[0] != args[1] {
+			cmp = 1
+		}
+		return complex(boolValue(compareResult(task.Operation, cmp)), 0), nil
+	case OperationAnd:
+		return complex(boolValue(args[0] != 0 && args[1] != 0), 0), nil
+	case OperationOr:
+		return complex(boolValue(args[0] != 0 || args[1] != 0), 0), nil
+	case OperationNot:
+		return complex(boolValue(args[0] == 0), 0), nil
+	case OperationSqrt:
+		return cmplx.Sqrt(args[0]), nil
+	case OperationAbs:
+		return complex(cmplx.Abs(args[0]), 0), nil
+	case OperationLog:
+		if args[0] == 0 {
+			return 0, &TaskError{Code: ErrCodeDomainError, Message: "logarithm of zero"}
+		}
+		if len(args) == 1 {
+			return cmplx.Log(args[0]), nil
+		}
+		if args[1] == 0 || args[1] == 1 {
+			return 0, &TaskError{Code: ErrCodeDomainError, Message: "invalid logarithm base"}
+		}
+		return cmplx.Log(args[0]) / cmplx.Log(args[1]), nil
+	case OperationExp:
+		return cmplx.Exp(args[0]), nil
+	case OperationSin:
+		return cmplx.Sin(args[0]), nil
+	case OperationCos:
+		return cmplx.Cos(args[0]), nil
+	case OperationTan:
+		return cmplx.Tan(args[0]), nil
+	case OperationSum:
+		var result complex128
+		for _, arg := range args {
+			result += arg
+		}
+		return result, nil
+	case OperationDot:
+		var result complex128
+		n := len(args) / 2
+		for i := 0; i < n; i++ {
+			result += args[i] * args[n+i]
+		}
+		return result, nil
+	default:
+		return 0, &TaskError{Code: ErrCodeUnknownOperation, Message: fmt.Sprintf("%s is not supported in complex mode", task.Operation)}
+	}
+}
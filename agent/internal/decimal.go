@@ -0,0 +1,238 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+const (
+	// decimalDigits — число значащих десятичных цифр, до которого округляется
+	// каждый результат в режиме decimal.
+	decimalDigits = 50
+	// maxDecimalOrder ограничивает десятичный порядок значений: без предела
+	// цепочка умножений быстро дала бы числа из миллионов цифр.
+	maxDecimalOrder = 100000
+	// maxDecimalExponent ограничивает показатель степени, чтобы одна задача
+	// не считалась неограниченно долго.
+	maxDecimalExponent = 1 << 16
+)
+
+// computeDecimal выполняет задачу над десятичными дробями. Значения хранятся
+// в big.Rat, и у каждого результата не больше decimalDigits значащих цифр,
+// поэтому 0.1 + 0.2 и 1.1 ^ 2 считаются точно. Трансцендентные функции в этом
+// режиме не поддерживаются: оркестратор их не отправляет.
+func computeDecimal(task *Task) (*big.Rat, error) {
+	args := make([]*big.Rat, len(task.Args))
+	for i, arg := range task.Args {
+		var err error
+		if args[i], err = parseDecimal(arg); err != nil {
+			return nil, err
+		}
+	}
+
+	var result *big.Rat
+	switch task.Operation {
+	case OperationAddition:
+		result = new(big.Rat).Add(args[0], args[1])
+	case OperationSubtraction:
+		result = new(big.Rat).Sub(args[0], args[1])
+	case OperationMultiplication:
+		result = new(big.Rat).Mul(args[0], args[1])
+	case OperationDivision:
+		if args[1].Sign() == 0 {
+			return nil, &TaskError{Code: ErrCodeDivisionByZero, Message: "division by zero"}
+		}
+		result = new(big.Rat).Quo(args[0], args[1])
+	case OperationNegation:
+		result = new(big.Rat).Neg(args[0])
+	case OperationExponentiation:
+		var err error
+		if result, err = decimalPow(args[0], args[1]); err != nil {
+			return nil, err
+		}
+	case OperationModulo:
+		if args[1].Sign() == 0 {
+			return nil, &TaskError{Code: ErrCodeDivisionByZero, Message: "modulo by zero"}
+		}
+		// Остаток со знаком делителя, согласованный с "//": a - b*floor(a/b).
+		product := new(big.Rat).Mul(args[1], new(big.Rat).SetInt(ratFloorQuo(args[0], args[1])))
+		result = new(big.Rat).Sub(args[0], product)
+	case OperationIntegerDivision:
+		if args[1].Sign() == 0 {
+			return nil, &TaskError{Code: ErrCodeDivisionByZero, Message: "integer division by zero"}
+		}
+		result = new(big.Rat).SetInt(ratFloorQuo(args[0], args[1]))
+	case OperationLess, OperationLessEqual, OperationGreater, OperationGreaterEqual, OperationEqual, OperationNotEqual:
+		result = new(big.Rat).SetFloat64(boolValue(compareResult(task.Operation, args[0].Cmp(args[1]))))
+	case OperationAnd:
+		result = new(big.Rat).SetFloat64(boolValue(args[0].Sign() != 0 && args[1].Sign() != 0))
+	case OperationOr:
+		result = new(big.Rat).SetFloat64(boolValue(args[0].Sign() != 0 || args[1].Sign() != 0))
+	case OperationNot:
+		result = new(big.Rat).SetFloat64(boolValue(args[0].Sign() == 0))
+	case OperationSqrt:
+		if args[0].Sign() < 0 {
+			return nil, &TaskError{Code: ErrCodeDomainError, Message: "square root of a negative number"}
+		}
+		result = decimalSqrt(args[0])
+	case OperationAbs:
+		result = new(big.Rat).Abs(args[0])
+	case OperationMin, OperationMax:
+		result = args[0]
+		for _, arg := range args[1:] {
+			cmp := arg.Cmp(result)
+			if (task.Operation == OperationMin && cmp < 0) || (task.Operation == OperationMax && cmp > 0) {
+				result = arg
+			}
+		}
+	case OperationSum:
+		result = new(big.Rat)
+		for _, arg := range args {
+			result.Add(result, arg)
+		}
+	case OperationDot:
+		result = new(big.Rat)
+		n := len(args) / 2
+		for i := 0; i < n; i++ {
+			result.Add(result, new(big.Rat).Mul(args[i], args[n+i]))
+		}
+	default:
+		return nil, &TaskError{Code: ErrCodeUnknownOperation, Message: fmt.Sprintf("%s is not supported with decimal precision", task.Operation)}
+	}
+	result = roundDecimal(result)
+	if err := checkDecimalOrder(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// parseDecimal читает аргумент режима decimal — десятичную строку.
+func parseDecimal(arg Operand) (*big.Rat, error) {
+	text, err := textArg(arg)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := new(big.Rat).SetString(text)
+	if !ok || strings.Contains(text, "/") {
+		return nil, &TaskError{Code: ErrCodeInvalidArgument, Message: fmt.Sprintf("invalid argument %q", text)}
+	}
+	if err := checkDecimalOrder(value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// formatDecimal записывает десятичную дробь x без потери цифр и без лишних
+// нулей. У x знаменатель вида 2^a * 5^b, и знаков после точки — max(a, b).
+func formatDecimal(x *big.Rat) string {
+	den := new(big.Int).Set(x.Denom())
+	twos := den.TrailingZeroBits()
+	den.Rsh(den, twos)
+	fives := uint(0)
+	for five := big.NewInt(5); den.Cmp(big.NewInt(1)) > 0; fives++ {
+		den.Quo(den, five)
+	}
+	return x.FloatString(int(max(twos, fives)))
+}
+
+// roundDecimal округляет x до decimalDigits значащих цифр, половину — к чётному.
+func roundDecimal(x *big.Rat) *big.Rat {
+	if x.Sign() == 0 {
+		return new(big.Rat)
+	}
+	num, den := new(big.Int).Abs(x.Num()), x.Denom()
+	lo := new(big.Int).Exp(big.NewInt(10), big.NewInt(decimalDigits-1), nil)
+	hi := new(big.Int).Exp(big.NewInt(10), big.NewInt(decimalDigits), nil)
+	// k — степень десяти, после умножения на которую у |x| ровно decimalDigits
+	// цифр до точки; оценка по длине в битах ошибается не больше чем на единицу.
+	k := decimalDigits - 1 - decimalOrder(x)
+	for {
+		n, d := scaleByPow10(num, den, k)
+		q, r := new(big.Int).QuoRem(n, d, new(big.Int))
+		switch {
+		case q.Cmp(lo) < 0:
+			k++
+			continue
+		case q.Cmp(hi) >= 0:
+			k--
+			continue
+		}
+		if c := r.Lsh(r, 1).Cmp(d); c > 0 || c == 0 && q.Bit(0) == 1 {
+			q.Add(q, big.NewInt(1))
+		}
+		if x.Sign() < 0 {
+			q.Neg(q)
+		}
+		n, d = scaleByPow10(q, big.NewInt(1), -k)
+		return new(big.Rat).SetFrac(n, d)
+	}
+}
+
+// scaleByPow10 возвращает дробь n/d, равную num/den * 10^k.
+func scaleByPow10(num, den *big.Int, k int) (n, d *big.Int) {
+	p := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(max(k, -k))), nil)
+	if k >= 0 {
+		return new(big.Int).Mul(num, p), den
+	}
+	return num, new(big.Int).Mul(den, p)
+}
+
+// decimalOrder оценивает десятичный порядок x ≠ 0 с точностью до единицы.
+func decimalOrder(x *big.Rat) int {
+	return int(math.Floor(float64(x.Num().BitLen()-x.Denom().BitLen()) * math.Log10(2)))
+}
+
+// checkDecimalOrder проверяет, что порядок значения не больше maxDecimalOrder.
+func checkDecimalOrder(x *big.Rat) error {
+	if x.Sign() != 0 && max(decimalOrder(x), -decimalOrder(x)) > maxDecimalOrder {
+		return &TaskError{Code: ErrCodeOverflow, Message: "decimal value is out of range"}
+	}
+	return nil
+}
+
+// decimalSqrt извлекает корень в big.Float с запасом точности и округляет
+// его до decimalDigits цифр; корень из точного квадрата получается точным.
+func decimalSqrt(x *big.Rat) *big.Rat {
+	root := new(big.Float).SetPrec(decimalDigits*4 + 64).SetRat(x)
+	exact, _ := root.Sqrt(root).Rat(nil)
+	return roundDecimal(exact)
+}
+
+// decimalPow возводит base в целую степень exponent двоичным возведением,
+// округляя каждое произведение.
+func decimalPow(base, exponent *big.Rat) (*big.Rat, error) {
+	if !exponent.IsInt() {
+		return nil, &TaskError{Code: ErrCodeDomainError, Message: "decimal precision supports only integer exponents"}
+	}
+	if !exponent.Num().IsInt64() || exponent.Num().Int64() > maxDecimalExponent || exponent.Num().Int64() < -maxDecimalExponent {
+		return nil, &TaskError{Code: ErrCodeOverflow, Message: "exponent is too large"}
+	}
+	n := exponent.Num().Int64()
+	negative := n < 0
+	if negative {
+		if base.Sign() == 0 {
+			return nil, &TaskError{Code: ErrCodeDivisionByZero, Message: "zero raised to a negative power"}
+		}
+		n = -n
+	}
+	// Порядок результата — примерно n * порядок base.
+	if base.Sign() != 0 && int64(max(decimalOrder(base), -decimalOrder(base))+1)*n > maxDecimalOrder {
+		return nil, &TaskError{Code: ErrCodeOverflow, Message: "decimal value is out of range"}
+	}
+	result := big.NewRat(1, 1)
+	square := new(big.Rat).Set(base)
+	for ; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			result = roundDecimal(result.Mul(result, square))
+		}
+		if n > 1 {
+			square = roundDecimal(square.Mul(square, square))
+		}
+	}
+	if negative {
+		result.Inv(result)
+	}
+	return result, nil
+}
@@ -0,0 +1,281 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Interval — значение в режиме interval: отрезок [Lo, Hi], гарантированно
+// содержащий точный результат.
+type Interval struct {
+	Lo float64 `json:"lo"`
+	Hi float64 `json:"hi"`
+}
+
+// tinyResult — порог, ниже которого остаток округления может оказаться
+// субнормальным и потерять знак; такие результаты расширяются в обе стороны.
+const tinyResult = 0x1p-969
+
+func down(x float64) float64 { return math.Nextafter(x, math.Inf(-1)) }
+func up(x float64) float64   { return math.Nextafter(x, math.Inf(1)) }
+
+// roundBounds возвращает границы точного значения по округлённому
+// результату x и остатку e: знак остатка показывает, в какую сторону
+// округление сдвинуло результат.
+func roundBounds(x, e float64) (float64, float64) {
+	switch {
+	case x != 0 && math.Abs(x) < tinyResult:
+		return down(x), up(x)
+	case e > 0:
+		return x, up(x)
+	case e < 0:
+		return down(x), x
+	}
+	return x, x
+}
+
+// addBounds — границы точной суммы a + b; остаток находится преобразованием TwoSum.
+func addBounds(a, b float64) (float64, float64) {
+	s := a + b
+	bb := s - a
+	return roundBounds(s, (a-(s-bb))+(b-bb))
+}
+
+// mulBounds — границы точного произведения; остаток a*b - p считает FMA.
+func mulBounds(a, b float64) (float64, float64) {
+	p := a * b
+	return roundBounds(p, math.FMA(a, b, -p))
+}
+
+// quoBounds — границы точного частного: a/b = q + r/b, где r = a - q*b.
+func quoBounds(a, b float64) (float64, float64) {
+	q := a / b
+	r := math.FMA(-q, b, a)
+	if b < 0 {
+		r = -r
+	}
+	return roundBounds(q, r)
+}
+
+// sqrtBounds — границы точного корня: остаток x - s*s.
+func sqrtBounds(x float64) (float64, float64) {
+	s := math.Sqrt(x)
+	return roundBounds(s, math.FMA(-s, s, x))
+}
+
+func (x Interval) containsZero() bool {
+	return x.Lo <= 0 && x.Hi >= 0
+}
+
+func addInterval(a, b Interval) Interval {
+	lo, _ := addBounds(a.Lo, b.Lo)
+	_, hi := addBounds(a.Hi, b.Hi)
+	return Interval{lo, hi}
+}
+
+func negInterval(a Interval) Interval {
+	return Interval{-a.Hi, -a.Lo}
+}
+
+func subInterval(a, b Interval) Interval {
+	return addInterval(a, negInterval(b))
+}
+
+// hull — наименьший отрезок, содержащий все границы пар bounds.
+func hull(bounds ...[2]float64) Interval {
+	result := Interval{bounds[0][0], bounds[0][1]}
+	for _, b := range bounds[1:] {
+		result.Lo = math.Min(result.Lo, b[0])
+		result.Hi = math.Max(result.Hi, b[1])
+	}
+	return result
+}
+
+func mulInterval(a, b Interval) Interval {
+	var bounds [4][2]float64
+	bounds[0][0], bounds[0][1] = mulBounds(a.Lo, b.Lo)
+	bounds[1][0], bounds[1][1] = mulBounds(a.Lo, b.Hi)
+	bounds[2][0], bounds[2][1] = mulBounds(a.Hi, b.Lo)
+	bounds[3][0], bounds[3][1] = mulBounds(a.Hi, b.Hi)
+	return hull(bounds[:]...)
+}
+
+// quoInterval делит отрезки; делитель, содержащий ноль, — ошибка, а не
+// бесконечный отрезок.
+func quoInterval(a, b Interval) (Interval, error) {
+	if b.containsZero() {
+		return Interval{}, &TaskError{Code: ErrCodeDivisionByZero, Message: "division by an interval containing zero"}
+	}
+	var bounds [4][2]float64
+	bounds[0][0], bounds[0][1] = quoBounds(a.Lo, b.Lo)
+	bounds[1][0], bounds[1][1] = quoBounds(a.Lo, b.Hi)
+	bounds[2][0], bounds[2][1] = quoBounds(a.Hi, b.Lo)
+	bounds[3][0], bounds[3][1] = quoBounds(a.Hi, b.Hi)
+	return hull(bounds[:]...), nil
+}
+
+// powNonNegative возводит неотрицательный отрезок в степень n >= 0
+// двоичным возведением; на неотрицательных отрезках умножение монотонно.
+func powNonNegative(x Interval, n int64) Interval {
+	result := Interval{1, 1}
+	for square := x; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			result = mulInterval(result, square)
+		}
+		square = mulInterval(square, square)
+	}
+	return result
+}
+
+// powInterval возводит отрезок в целую степень. Чётная степень отрезка,
+// содержащего ноль, начинается с нуля, а не с отрицательного произведения.
+func powInterval(x, exponent Interval) (Interval, error) {
+	if exponent.Lo != exponent.Hi || math.Trunc(exponent.Lo) != exponent.Lo {
+		return Interval{}, &TaskError{Code: ErrCodeDomainError, Message: "interval mode supports only integer exponents"}
+	}
+	if math.Abs(exponent.Lo) > maxDecimalExponent {
+		return Interval{}, &TaskError{Code: ErrCodeOverflow, Message: "exponent is too large"}
+	}
+	n := int64(exponent.Lo)
+	if n == 0 {
+		return Interval{1, 1}, nil
+	}
+	if n < 0 {
+		if x.containsZero() {
+			return Interval{}, &TaskError{Code: ErrCodeDivisionByZero, Message: "interval containing zero raised to a negative power"}
+		}
+		positive, _ := powInterval(x, Interval{float64(-n), float64(-n)})
+		return quoInterval(Interval{1, 1}, positive)
+	}
+	odd := n%2 == 1
+	switch {
+	case x.Lo >= 0:
+		return powNonNegative(x, n), nil
+	case x.Hi <= 0:
+		result := powNonNegative(negInterval(x), n)
+		if odd {
+			result = negInterval(result)
+		}
+		return result, nil
+	}
+	left := powNonNegative(Interval{0, -x.Lo}, n)
+	right := powNonNegative(Interval{0, x.Hi}, n)
+	if odd {
+		return Interval{-left.Hi, right.Hi}, nil
+	}
+	return Interval{0, math.Max(left.Hi, right.Hi)}, nil
+}
+
+// logInterval — натуральный логарифм. math.Log ошибается меньше чем на
+// единицу последнего разряда, поэтому границы расширяются на один шаг.
+func logInterval(x Interval) (Interval, error) {
+	if x.Lo <= 0 {
+		return Interval{}, &TaskError{Code: ErrCodeDomainError, Message: "logarithm of an interval with non-positive values"}
+	}
+	return Interval{down(math.Log(x.Lo)), up(math.Log(x.Hi))}, nil
+}
+
+// parseInterval читает аргумент режима interval — объект {"lo": .., "hi": ..}.
+func parseInterval(arg Operand) (Interval, error) {
+	var value Interval
+	if err := json.Unmarshal(arg.Value, &value); err != nil || value.Lo > value.Hi {
+		return Interval{}, &TaskError{Code: ErrCodeInvalidArgument, Message: fmt.Sprintf("invalid argument %s", arg.Value)}
+	}
+	return value, nil
+}
+
+// encodeInterval кодирует результат; к границам прибавляется 0, чтобы -0 не попадал в ответ.
+func encodeInterval(x Interval) (json.RawMessage, error) {
+	if math.IsInf(x.Lo, 0) || math.IsInf(x.Hi, 0) {
+		return nil, &TaskError{Code: ErrCodeOverflow, Message: "result is out of range"}
+	}
+	if math.IsNaN(x.Lo) || math.IsNaN(x.Hi) {
+		return nil, &TaskError{Code: ErrCodeDomainError, Message: "result is undefined"}
+	}
+	return json.Marshal(Interval{Lo: x.Lo + 0, Hi: x.Hi + 0})
+}
+
+// computeInterval выполняет задачу над отрезками: каждая граница округляется
+// наружу, так что результат содержит точное значение. Отрезки не упорядочены,
+// поэтому сравнения, логические операции, % и // недоступны, как и
+// тригонометрия, которой нужен разбор периодов.
+func computeInterval(task *Task) (Interval, error) {
+	args := make([]Interval, len(task.Args))
+	for i, arg := range task.Args {
+		var err error
+		if args[i], err = parseInterval(arg); err != nil {
+			return Interval{}, err
+		}
+	}
+
+	switch task.Operation {
+	case OperationAddition:
+		return addInterval(args[0], args[1]), nil
+	case OperationSubtraction:
+		return subInterval(args[0], args[1]), nil
+	case OperationMultiplication:
+		return mulInterval(args[0], args[1]), nil
+	case OperationDivision:
+		return quoInterval(args[0], args[1])
+	case OperationNegation:
+		return negInterval(args[0]), nil
+	case OperationExponentiation:
+		return powInterval(args[0], args[1])
+	case OperationSqrt:
+		if args[0].Lo < 0 {
+			return Interval{}, &TaskError{Code: ErrCodeDomainError, Message: "square root of an interval with negative values"}
+		}
+		lo, _ := sqrtBounds(args[0].Lo)
+		_, hi := sqrtBounds(args[0].Hi)
+		return Interval{lo, hi}, nil
+	case OperationAbs:
+		x := args[0]
+		switch {
+		case x.Lo >= 0:
+			return x, nil
+		case x.Hi <= 0:
+			return negInterval(x), nil
+		}
+		return Interval{0, math.Max(-x.Lo, x.Hi)}, nil
+	case OperationMin:
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = Interval{math.Min(result.Lo, arg.Lo), math.Min(result.Hi, arg.Hi)}
+		}
+		return result, nil
+	case OperationMax:
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = Interval{math.Max(result.Lo, arg.Lo), math.Max(result.Hi, arg.Hi)}
+		}
+		return result, nil
+	case OperationLog:
+		result, err := logInterval(args[0])
+		if err != nil || len(args) == 1 {
+			return result, err
+		}
+		base, err := logInterval(args[1])
+		if err != nil || base.containsZero() {
+			return Interval{}, &TaskError{Code: ErrCodeDomainError, Message: "invalid logarithm base"}
+		}
+		return quoInterval(result, base)
+	case OperationExp:
+		return Interval{math.Max(0, down(math.Exp(args[0].Lo))), up(math.Exp(args[0].Hi))}, nil
+	case OperationSum:
+		result := Interval{}
+		for _, arg := range args {
+			result = addInterval(result, arg)
+		}
+		return result, nil
+	case OperationDot:
+		result := Interval{}
+		n := len(args) / 2
+		for i := 0; i < n; i++ {
+			result = addInterval(result, mulInterval(args[i], args[n+i]))
+		}
+		return result, nil
+	default:
+		return Interval{}, &TaskError{Code: ErrCodeUnknownOperation, Message: fmt.Sprintf("%s is not supported in interval mode", task.Operation)}
+	}
+}
@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"math/cmplx"
+)
+
+// arithmetic — операции над числами одного режима вычислений, из которых
+// собраны матричные операции, общие для всех режимов.
+type arithmetic[T any] struct {
+	parse  func(Operand) (T, error)
+	encode func(T) (json.RawMessage, error)
+	zero   func() T
+	one    func() T
+	add    func(a, b T) T
+	sub    func(a, b T) T
+	mul    func(a, b T) T
+	quo    func(a, b T) T
+	neg    func(a T) T
+	// cmpAbs сравнивает модули чисел, по нему выбирается ведущий элемент.
+	cmpAbs func(a, b T) int
+}
+
+var floatArithmetic = arithmetic[float64]{
+	parse: parseFloat,
+	encode: func(v float64) (json.RawMessage, error) {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, &TaskError{Code: ErrCodeOverflow, Message: "matrix result is out of range"}
+		}
+		return json.Marshal(v)
+	},
+	zero: func() float64 { return 0 },
+	one:  func() float64 { return 1 },
+	add:  func(a, b float64) float64 { return a + b },
+	sub:  func(a, b float64) float64 { return a - b },
+	mul:  func(a, b float64) float64 { return a * b },
+	quo:  func(a, b float64) float64 { return a / b },
+	neg:  func(a float64) float64 { return -a },
+	cmpAbs: func(a, b float64) int {
+		switch a, b = math.Abs(a), math.Abs(b); {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	},
+}
+
+// decimalArithmetic округляет каждый результат, как и computeDecimal.
+var decimalArithmetic = arithmetic[*big.Rat]{
+	parse: parseDecimal,
+	encode: func(v *big.Rat) (json.RawMessage, error) {
+		if err := checkDecimalOrder(v); err != nil {
+			return nil, err
+		}
+		return json.Marshal(formatDecimal(v))
+	},
+	zero:   func() *big.Rat { return new(big.Rat) },
+	one:    func() *big.Rat { return big.NewRat(1, 1) },
+	add:    func(a, b *big.Rat) *big.Rat { return roundDecimal(new(big.Rat).Add(a, b)) },
+	sub:    func(a, b *big.Rat) *big.Rat { return roundDecimal(new(big.Rat).Sub(a, b)) },
+	mul:    func(a, b *big.Rat) *big.Rat { return roundDecimal(new(big.Rat).Mul(a, b)) },
+	quo:    func(a, b *big.Rat) *big.Rat { return roundDecimal(new(big.Rat).Quo(a, b)) },
+	neg:    func(a *big.Rat) *big.Rat { return new(big.Rat).Neg(a) },
+	cmpAbs: rationalArithmetic.cmpAbs,
+}
+
+var rationalArithmetic = arithmetic[*big.Rat]{
+	parse:  parseRational,
+	encode: func(v *big.Rat) (json.RawMessage, error) { return json.Marshal(v.RatString()) },
+	zero:   func() *big.Rat { return new(big.Rat) },
+	one:    func() *big.Rat { return big.NewRat(1, 1) },
+	add:    func(a, b *big.Rat) *big.Rat { return new(big.Rat).Add(a, b) },
+	sub:    func(a, b *big.Rat) *big.Rat { return new(big.Rat).Sub(a, b) },
+	mul:    func(a, b *big.Rat) *big.Rat { return new(big.Rat).Mul(a, b) },
+	quo:    func(a, b *big.Rat) *big.Rat { return new(big.Rat).Quo(a, b) },
+	neg:    func(a *big.Rat) *big.Rat { return new(big.Rat).Neg(a) },
+	cmpAbs: func(a, b *big.Rat) int { return new(big.Rat).Abs(a).Cmp(new(big.Rat).Abs(b)) },
+}
+
+var complexArithmetic = arithmetic[complex128]{
+	parse:  parseComplex,
+	encode: encodeComplex,
+	zero:   func() complex128 { return 0 },
+	one:    func() complex128 { return 1 },
+	add:    func(a, b complex128) complex128 { return a + b },
+	sub:    func(a, b complex128) complex128 { return a - b },
+	mul:    func(a, b complex128) complex128 { return a * b },
+	quo:    func(a, b complex128) complex128 { return a / b },
+	neg:    func(a complex128) complex128 { return -a },
+	cmpAbs: func(a, b complex128) int { return floatArithmetic.cmpAbs(cmplx.Abs(a), cmplx.Abs(b)) },
+}
+
+// intervalArithmetic — матричные операции над отрезками. det в режиме
+// interval недоступен: деление на ведущий элемент, содержащий ноль, не
+// даёт ограниченного отрезка, поэтому quo и cmpAbs не заданы.
+var intervalArithmetic = arithmetic[Interval]{
+	parse:  parseInterval,
+	encode: encodeInterval,
+	zero:   func() Interval { return Interval{} },
+	one:    func() Interval { return Interval{1, 1} },
+	add:    addInterval,
+	sub:    subInterval,
+	mul:    mulInterval,
+	neg:    negInterval,
+}
+
+// computeMatrix выполняет матричную задачу в её режиме вычислений.
+func computeMatrix(task *Task) (json.RawMessage, error) {
+	switch task.Mode {
+	case "", NumberModeFloat:
+		return matrixOperation(task, floatArithmetic)
+	case NumberModeDecimal:
+		return matrixOperation(task, decimalArithmetic)
+	case NumberModeRational:
+		return matrixOperation(task, rationalArithmetic)
+	case NumberModeComplex:
+		return matrixOperation(task, complexArithmetic)
+	case NumberModeInterval:
+		if task.Operation == OperationDeterminant {
+			return nil, &TaskError{Code: ErrCodeUnknownOperation, Message: "determinant is not supported in interval mode"}
+		}
+		return matrixOperation(task, intervalArithmetic)
+	}
+	return nil, &TaskError{Code: ErrCodeUnknownOperation, Message: fmt.Sprintf("unknown number mode %q", task.Mode)}
+}
+
+func matrixOperation[T any](task *Task, ar arithmetic[T]) (json.RawMessage, error) {
+	args := make([][][]T, len(task.Args))
+	for i, arg := range task.Args {
+		var err error
+		if args[i], err = parseMatrix(arg, ar); err != nil {
+			return nil, err
+		}
+	}
+	if task.Operation == OperationDeterminant {
+		if len(args[0]) != len(args[0][0]) {
+			return nil, &TaskError{Code: ErrCodeInvalidArgument, Message: "matrix is not square"}
+		}
+		return ar.encode(determinant(args[0], ar))
+	}
+	a, b := args[0], args[1]
+	if len(a[0]) != len(b) {
+		return nil, &TaskError{Code: ErrCodeInvalidArgument, Message: "matrix dimensions do not match"}
+	}
+	product := make([][]json.RawMessage, len(a))
+	for i, row := range a {
+		product[i] = make([]json.RawMessage, len(b[0]))
+		for j := range b[0] {
+			sum := ar.zero()
+			for k, value := range row {
+				sum = ar.add(sum, ar.mul(value, b[k][j]))
+			}
+			var err error
+			if product[i][j], err = ar.encode(sum); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return json.Marshal(product)
+}
+
+// parseMatrix читает матрицу — непустой список строк одной длины.
+func parseMatrix[T any](arg Operand, ar arithmetic[T]) ([][]T, error) {
+	if len(arg.List) == 0 || len(arg.List[0].List) == 0 {
+		return nil, &TaskError{Code: ErrCodeInvalidArgument, Message: "argument is not a matrix"}
+	}
+	m := make([][]T, len(arg.List))
+	for i, row := range arg.List {
+		if len(row.List) != len(arg.List[0].List) {
+			return nil, &TaskError{Code: ErrCodeInvalidArgument, Message: "matrix rows must have the same length"}
+		}
+		m[i] = make([]T, len(row.List))
+		for j, cell := range row.List {
+			if cell.Ref != "" || cell.Value == nil {
+				return nil, &TaskError{Code: ErrCodeInvalidArgument, Message: "task has unresolved arguments"}
+			}
+			var err error
+			if m[i][j], err = ar.parse(cell); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// determinant считает определитель методом Гаусса с выбором ведущего
+// элемента по модулю; матрица m изменяется.
+func determinant[T any](m [][]T, ar arithmetic[T]) T {
+	det := ar.one()
+	for col := range m {
+		pivot := col
+		for row := col + 1; row < len(m); row++ {
+			if ar.cmpAbs(m[row][col], m[pivot][col]) > 0 {
+				pivot = row
+			}
+		}
+		if ar.cmpAbs(m[pivot][col], ar.zero()) == 0 {
+			return ar.zero()
+		}
+		if pivot != col {
+			m[pivot], m[col] = m[col], m[pivot]
+			det = ar.neg(det)
+		}
+		det = ar.mul(det, m[col][col])
+		for row := col + 1; row < len(m); row++ {
+			factor := ar.quo(m[row][col], m[col][col])
+			for k := col; k < len(m); k++ {
+				m[row][k] = ar.sub(m[row][k], ar.mul(factor, m[col][k]))
+			}
+		}
+	}
+	return det
+}
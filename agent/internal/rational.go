@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"fmt"
+	"math/big"
+)
+
+const (
+	// maxRationalExponent ограничивает показатель степени в режиме rational:
+	// числитель и знаменатель растут линейно по показателю.
+	maxRationalExponent = 1 << 12
+	// maxRationalBits ограничивает длину числителя и знаменателя степени в битах:
+	// при длинном основании и допустимый показатель дал бы огромное число.
+	maxRationalBits = 1 << 20
+)
+
+// computeRational выполняет задачу над точными дробями big.Rat. Как и в режиме
+// decimal, доступны только операции, результат которых остаётся рациональным.
+func computeRational(task *Task) (*big.Rat, error) {
+	args := make([]*big.Rat, len(task.Args))
+	for i, arg := range task.Args {
+		var err error
+		if args[i], err = parseRational(arg); err != nil {
+			return nil, err
+		}
+	}
+
+	switch task.Operation {
+	case OperationAddition:
+		return new(big.Rat).Add(args[0], args[1]), nil
+	case OperationSubtraction:
+		return new(big.Rat).Sub(args[0], args[1]), nil
+	case OperationMultiplication:
+		return new(big.Rat).Mul(args[0], args[1]), nil
+	case OperationDivision:
+		if args[1].Sign() == 0 {
+			return nil, &TaskError{Code: ErrCodeDivisionByZero, Message: "division by zero"}
+		}
+		return new(big.Rat).Quo(args[0], args[1]), nil
+	case OperationNegation:
+		return new(big.Rat).Neg(args[0]), nil
+	case OperationExponentiation:
+		return ratPow(args[0], args[1])
+	case OperationModulo:
+		if args[1].Sign() == 0 {
+			return nil, &TaskError{Code: ErrCodeDivisionByZero, Message: "modulo by zero"}
+		}
+		// Остаток со знаком делителя, согласованный с "//": a - b*floor(a/b).
+		product := new(big.Rat).Mul(args[1], new(big.Rat).SetInt(ratFloorQuo(args[0], args[1])))
+		return new(big.Rat).Sub(args[0], product), nil
+	case OperationIntegerDivision:
+		if args[1].Sign() == 0 {
+			return nil, &TaskError{Code: ErrCodeDivisionByZero, Message: "integer division by zero"}
+		}
+		return new(big.Rat).SetInt(ratFloorQuo(args[0], args[1])), nil
+	case OperationLess, OperationLessEqual, OperationGreater, OperationGreaterEqual, OperationEqual, OperationNotEqual:
+		return new(big.Rat).SetFloat64(boolValue(compareResult(task.Operation, args[0].Cmp(args[1])))), nil
+	case OperationAnd:
+		return new(big.Rat).SetFloat64(boolValue(args[0].Sign() != 0 && args[1].Sign() != 0)), nil
+	case OperationOr:
+		return new(big.Rat).SetFloat64(boolValue(args[0].Sign() != 0 || args[1].Sign() != 0)), nil
+	case OperationNot:
+		return new(big.Rat).SetFloat64(boolValue(args[0].Sign() == 0)), nil
+	case OperationAbs:
+		return new(big.Rat).Abs(args[0]), nil
+	case OperationMin, OperationMax:
+		result := args[0]
+		for _, arg := range args[1:] {
+			cmp := arg.Cmp(result)
+			if (task.Operation == OperationMin && cmp < 0) || (task.Operation == OperationMax && cmp > 0) {
+				result = arg
+			}
+		}
+		return result, nil
+	case OperationSum:
+		result := new(big.Rat)
+		for _, arg := range args {
+			result.Add(result, arg)
+		}
+		return result, nil
+	case OperationDot:
+		result := new(big.Rat)
+		n := len(args) / 2
+		for i := 0; i < n; i++ {
+			result.Add(result, new(big.Rat).Mul(args[i], args[n+i]))
+		}
+		return result, nil
+	default:
+		return nil, &TaskError{Code: ErrCodeUnknownOperation, Message: fmt.Sprintf("%s is not supported in rational mode", task.Operation)}
+	}
+}
+
+// parseRational читает аргумент режима rational — дробь вида "p/q".
+func parseRational(arg Operand) (*big.Rat, error) {
+	text, err := textArg(arg)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return nil, &TaskError{Code: ErrCodeInvalidArgument, Message: fmt.Sprintf("invalid argument %q", text)}
+	}
+	return value, nil
+}
+
+// ratFloorQuo возвращает floor(a/b); b не равно нулю. big.Int.Div округляет
+// к минус бесконечности при положительном делителе, а знаменатель big.Rat
+// всегда положителен.
+func ratFloorQuo(a, b *big.Rat) *big.Int {
+	quotient := new(big.Rat).Quo(a, b)
+	return new(big.Int).Div(quotient.Num(), quotient.Denom())
+}
+
+// ratPow возводит base в целую степень exponent; дробный показатель дал бы
+// иррациональный результат.
+func ratPow(base, exponent *big.Rat) (*big.Rat, error) {
+	if !exponent.IsInt() {
+		return nil, &TaskError{Code: ErrCodeDomainError, Message: "rational mode supports only integer exponents"}
+	}
+	if !exponent.Num().IsInt64() || exponent.Num().Int64() > maxRationalExponent || exponent.Num().Int64() < -maxRationalExponent {
+		return nil, &TaskError{Code: ErrCodeOverflow, Message: "exponent is too large"}
+	}
+	n := exponent.Num().Int64()
+	if n < 0 {
+		if base.Sign() == 0 {
+			return nil, &TaskError{Code: ErrCodeDivisionByZero, Message: "zero raised to a negative power"}
+		}
+		base = new(big.Rat).Inv(base)
+		n = -n
+	}
+	// Длина степени — примерно n * длина основания.
+	if int64(max(base.Num().BitLen(), base.Denom().BitLen()))*n > maxRationalBits {
+		return nil, &TaskError{Code: ErrCodeOverflow, Message: "result is too large"}
+	}
+	power := big.NewInt(n)
+	num := new(big.Int).Exp(base.Num(), power, nil)
+	denom := new(big.Int).Exp(base.Denom(), power, nil)
+	return new(big.Rat).SetFrac(num, denom), nil
+}
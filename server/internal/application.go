@@ -2,14 +2,19 @@ package application
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/Tuma78/server/models"
+	"github.com/google/uuid"
+	"math/big"
 	"net/http"
 	"os"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"github.com/Tuma78/server/models"
-	"github.com/google/uuid"
+	"time"
 )
 
 type Config struct {
@@ -18,6 +23,27 @@ type Config struct {
 	TimeSubtractionMS     int
 	TimeMultiplicationsMS int
 	TimeDivisionsMS       int
+	TimeNegationMS        int
+	TimeExponentiationMS  int
+	TimeModuloMS          int
+	TimeIntegerDivisionMS int
+	TimeComparisonMS      int
+	TimeLogicalMS         int
+	// FunctionTimesMS — время выполнения встроенных функций по имени,
+	// задаётся переменными TIME_<ИМЯ>_MS, например TIME_SQRT_MS.
+	FunctionTimesMS map[string]int
+	// AggregateChunkSize — наибольшее число элементов, которое сворачивает
+	// одна задача агрегата; большие списки сворачиваются деревом задач.
+	AggregateChunkSize int
+	// MatrixBlockSize — сторона блока результата, который считает одна задача
+	// произведения матриц.
+	MatrixBlockSize int
+	// TaskLeaseGraceMS — запас времени сверх OperationTime, после которого
+	// выданная агенту задача возвращается в очередь.
+	TaskLeaseGraceMS int
+	// AdminToken — токен администратора из ADMIN_TOKEN; запрос с этим токеном
+	// в заголовке X-Admin-Token может регистрировать глобальные функции.
+	AdminToken string
 }
 
 func ConfigFromEnv() *Config {
@@ -42,6 +68,55 @@ func ConfigFromEnv() *Config {
 	if config.TimeDivisionsMS == 0 {
 		config.TimeDivisionsMS = 2000
 	}
+	config.TimeNegationMS, _ = strconv.Atoi(os.Getenv("TIME_NEGATION_MS"))
+	if config.TimeNegationMS == 0 {
+		config.TimeNegationMS = 1000
+	}
+	config.TimeExponentiationMS, _ = strconv.Atoi(os.Getenv("TIME_EXPONENTIATION_MS"))
+	if config.TimeExponentiationMS == 0 {
+		config.TimeExponentiationMS = 2000
+	}
+	config.TimeModuloMS, _ = strconv.Atoi(os.Getenv("TIME_MODULO_MS"))
+	if config.TimeModuloMS == 0 {
+		config.TimeModuloMS = 2000
+	}
+	config.TimeIntegerDivisionMS, _ = strconv.Atoi(os.Getenv("TIME_INTEGER_DIVISION_MS"))
+	if config.TimeIntegerDivisionMS == 0 {
+		config.TimeIntegerDivisionMS = 2000
+	}
+	config.TimeComparisonMS, _ = strconv.Atoi(os.Getenv("TIME_COMPARISON_MS"))
+	if config.TimeComparisonMS == 0 {
+		config.TimeComparisonMS = 1000
+	}
+	config.TimeLogicalMS, _ = strconv.Atoi(os.Getenv("TIME_LOGICAL_MS"))
+	if config.TimeLogicalMS == 0 {
+		config.TimeLogicalMS = 1000
+	}
+	config.FunctionTimesMS = make(map[string]int, len(builtinFunctions))
+	for name, fn := range builtinFunctions {
+		if fn.local {
+			continue
+		}
+		config.FunctionTimesMS[name], _ = strconv.Atoi(os.Getenv("TIME_" + strings.ToUpper(name) + "_MS"))
+		if config.FunctionTimesMS[name] == 0 {
+			config.FunctionTimesMS[name] = 1000
+		}
+	}
+	config.AggregateChunkSize, _ = strconv.Atoi(os.Getenv("AGGREGATE_CHUNK_SIZE"))
+	if config.AggregateChunkSize < 2 {
+		config.AggregateChunkSize = 100
+	}
+	config.MatrixBlockSize, _ = strconv.Atoi(os.Getenv("MATRIX_BLOCK_SIZE"))
+	if config.MatrixBlockSize < 1 {
+		config.MatrixBlockSize = 32
+	}
+	// Нулевой запас допустим; отрицательное или нечисловое значение заменяется
+	// значением по умолчанию.
+	config.TaskLeaseGraceMS = 5000
+	if grace, err := strconv.Atoi(os.Getenv("TASK_LEASE_GRACE_MS")); err == nil && grace >= 0 {
+		config.TaskLeaseGraceMS = grace
+	}
+	config.AdminToken = os.Getenv("ADMIN_TOKEN")
 	return config
 }
 
@@ -56,31 +131,64 @@ const (
 
 // Expression представляет сохранённое выражение.
 type Expression struct {
-	ID               string           `json:"id"`
-	Expression       string           `json:"-"`
-	Status           ExpressionStatus `json:"status"`
-	Result           *float64         `json:"result,omitempty"`
-	Tasks            []*models.Task          `json:"-"` 
-	CurrentTaskIndex int              `json:"-"` 
+	ID         string            `json:"id"`
+	Expression string            `json:"expression"`
+	Status     ExpressionStatus  `json:"status"`
+	Result     json.RawMessage   `json:"result,omitempty"`
+	Error      *models.TaskError `json:"error,omitempty"`
+	Mode       models.NumberMode `json:"-"`
+	Tasks      []*models.Task    `json:"-"`
+	// RPN — разобранное выражение; по нему можно пересчитать выражение
+	// с другими значениями переменных без повторного разбора.
+	RPN []token `json:"-"`
+	// Source — RPN до подстановки функций пользователя, если они были;
+	// по нему строится запись выражения в ответе.
+	Source []token `json:"-"`
+	// Root и Bindings — значение выражения и привязки let; ссылки на задачи
+	// заменяются значениями по мере выполнения задач.
+	Root     models.Operand `json:"-"`
+	Bindings []binding      `json:"-"`
+	// BindingValues — итоговые значения привязок, ShowBindings — включать ли их в ответ.
+	BindingValues map[string]json.RawMessage `json:"-"`
+	ShowBindings  bool                       `json:"-"`
+	// Dim — размерность результата; Unit — единица, в которой возвращается
+	// результат: единица СИ или Target, если запрошен перевод.
+	Dim    dimension `json:"-"`
+	Unit   string    `json:"-"`
+	Target *unit     `json:"-"`
+	// NoOptimize отключает упрощение выражения перед построением задач,
+	// Eliminated — число задач, которые упрощение устранило.
+	NoOptimize bool `json:"-"`
+	Eliminated int  `json:"-"`
 }
 
-
-
 // Application – состояние оркестратора.
 type Application struct {
 	config      *Config
 	expressions map[string]*Expression
-	tasks       map[string]*models.Task
-	taskQueue   []*models.Task // глобальная очередь задач
-	mutex       sync.Mutex
+	templates   map[string]*Template
+	// globalFunctions — функции, доступные всем пользователям, userFunctions —
+	// собственные функции пользователей по их ID.
+	globalFunctions map[string]*userFunction
+	userFunctions   map[string]map[string]*userFunction
+	tasks           map[string]*models.Task
+	taskQueue       []*models.Task          // глобальная очередь задач
+	leased          map[string]*models.Task // задачи, выданные агентам
+	mutex           sync.Mutex
+	now             func() time.Time
 }
 
 func New() *Application {
 	return &Application{
-		config:      ConfigFromEnv(),
-		expressions: make(map[string]*Expression),
-		tasks:       make(map[string]*models.Task),
-		taskQueue:   make([]*models.Task, 0),
+		config:          ConfigFromEnv(),
+		expressions:     make(map[string]*Expression),
+		templates:       make(map[string]*Template),
+		globalFunctions: make(map[string]*userFunction),
+		userFunctions:   make(map[string]map[string]*userFunction),
+		tasks:           make(map[string]*models.Task),
+		taskQueue:       make([]*models.Task, 0),
+		leased:          make(map[string]*models.Task),
+		now:             time.Now,
 	}
 }
 
@@ -89,6 +197,11 @@ func (a *Application) RunServer() error {
 	http.HandleFunc("/api/v1/calculate", a.CalcHandler)
 	http.HandleFunc("/api/v1/expressions", a.ExpressionsHandler)
 	http.HandleFunc("/api/v1/expressions/", a.ExpressionHandler)
+	http.HandleFunc("/api/v1/templates", a.TemplatesHandler)
+	http.HandleFunc("/api/v1/templates/", a.TemplateHandler)
+	http.HandleFunc("/api/v1/derive", a.DeriveHandler)
+	http.HandleFunc("/api/v1/explain", a.ExplainHandler)
+	http.HandleFunc("/api/v1/functions", a.FunctionsHandler)
 	http.HandleFunc("/internal/task", a.giveTaskHandler)
 	return http.ListenAndServe(":"+a.config.Addr, nil)
 }
@@ -105,54 +218,217 @@ func (a *Application) CalcHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	if !isValidExpression(req.Expression) {
+	mode, err := requestMode(req.Precision, req.NumberMode)
+	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusUnprocessableEntity)
-		resp := models.Response{Error: "Expression is not valid"}
-		json.NewEncoder(w).Encode(resp)
+		json.NewEncoder(w).Encode(models.Response{Error: "Unsupported precision", Details: err.Error()})
 		return
 	}
-
-	exprID, err := a.addExpression(req.Expression)
+	expr, err := a.parseExpression(req.Expression, a.requestScope(r), req.Variables, mode, !req.NoOptimize)
+	if err == nil && req.To != "" {
+		err = expr.convertTo(req.To)
+	}
 	if err != nil {
-		http.Error(w, "Error processing expression", http.StatusInternalServerError)
+		writeExpressionCreated(w, "", err)
 		return
 	}
+	expr.ShowBindings = req.IncludeBindings
+	a.registerExpression(expr)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	resp := models.Response{ID: exprID}
-	json.NewEncoder(w).Encode(resp)
+	json.NewEncoder(w).Encode(models.Response{ID: expr.ID, EliminatedTasks: expr.Eliminated})
 }
 
-// addExpression преобразует выражение в RPN, строит последовательность задач и сохраняет выражение.
-func (a *Application) addExpression(exprStr string) (string, error) {
-	exprID := uuid.New().String()
-	tokens, err := infixToRPN(exprStr)
+// writeExpressionCreated отвечает ID созданного выражения или описанием
+// ошибки: синтаксические ошибки и несвязанные переменные дают 422.
+func writeExpressionCreated(w http.ResponseWriter, exprID string, err error) {
+	var syntaxErr *SyntaxError
+	var unboundErr *UnboundVariablesError
+	var conversionErr *ConversionError
+	var functionErr *FunctionError
+	switch {
+	case errors.As(err, &syntaxErr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		resp := models.Response{
+			Error:    "Expression is not valid",
+			Details:  syntaxErr.Error(),
+			Position: &syntaxErr.Pos,
+			Token:    syntaxErr.Token,
+		}
+		json.NewEncoder(w).Encode(resp)
+	case errors.As(err, &unboundErr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		resp := models.Response{
+			Error:   "Expression has unbound variables",
+			Details: unboundErr.Error(),
+			Unbound: unboundErr.Names,
+		}
+		json.NewEncoder(w).Encode(resp)
+	case errors.As(err, &conversionErr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(models.Response{Error: "Unit conversion is not possible", Details: conversionErr.Error()})
+	case errors.As(err, &functionErr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(models.Response{Error: "Function is not valid", Details: functionErr.Error()})
+	case err != nil:
+		http.Error(w, "Error processing expression", http.StatusInternalServerError)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		resp := models.Response{ID: exprID}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// addExpression преобразует выражение в RPN, строит граф задач и сохраняет выражение.
+func (a *Application) addExpression(exprStr string, vars map[string]float64, mode models.NumberMode) (string, error) {
+	expr, err := a.parseExpression(exprStr, nil, vars, mode, false)
 	if err != nil {
 		return "", err
 	}
-	tasks, err := buildTasksFromRPN(tokens, a.config, exprID)
+	a.registerExpression(expr)
+	return expr.ID, nil
+}
+
+// parseExpression разбирает выражение и строит его задачи, не регистрируя
+// выражение: до регистрации можно задать параметры ответа. optimize включает
+// упрощение выражения перед построением задач, scope — доступные функции пользователя.
+func (a *Application) parseExpression(exprStr string, scope *functionScope, vars map[string]float64, mode models.NumberMode, optimize bool) (*Expression, error) {
+	source, tokens, err := parseSource(exprStr, scope, mode)
+	if err != nil {
+		return nil, err
+	}
+	expr, err := a.buildExpression(exprStr, tokens, vars, mode, optimize)
+	if err != nil {
+		return nil, err
+	}
+	expr.Source = source
+	return expr, nil
+}
+
+// parseSource переводит выражение в RPN дважды: source сохраняет вызовы
+// функций пользователя и нужен для записи выражения, в tokens их тела
+// подставлены и по нему строятся задачи.
+func parseSource(exprStr string, scope *functionScope, mode models.NumberMode) (source, tokens []token, err error) {
+	if source, err = parseCalls(exprStr, scope); err != nil {
+		return nil, nil, err
+	}
+	if tokens, err = inlineFunctions(source, scope); err != nil {
+		return nil, nil, err
+	}
+	if mode == models.NumberModeComplex {
+		if source, err = withImaginaryUnit(source); err != nil {
+			return nil, nil, err
+		}
+		if tokens, err = withImaginaryUnit(tokens); err != nil {
+			return nil, nil, err
+		}
+	}
+	return source, tokens, nil
+}
+
+// buildExpression строит выражение по уже разобранному RPN, подставляя
+// значения переменных при построении задач.
+func (a *Application) buildExpression(exprStr string, tokens []token, vars map[string]float64, mode models.NumberMode, optimize bool) (*Expression, error) {
+	if unbound := unboundVariables(tokens, vars); len(unbound) > 0 {
+		return nil, &UnboundVariablesError{Names: unbound}
+	}
+	exprID := uuid.New().String()
+	graph, eliminated, err := buildGraph(tokens, a.config, exprID, vars, mode, optimize)
 	if err != nil {
-		return "", err	
+		return nil, err
 	}
 	expr := &Expression{
-		ID:               exprID,
-		Expression:       exprStr,
-		Status:           StatusPending,
-		Tasks:            tasks,
-		CurrentTaskIndex: 0,
+		ID:         exprID,
+		Expression: exprStr,
+		RPN:        tokens,
+		Source:     tokens,
+		Status:     StatusPending,
+		Mode:       mode,
+		Tasks:      graph.tasks,
+		Root:       graph.root,
+		Bindings:   graph.bindings,
+		Dim:        graph.unit,
+		Unit:       graph.unit.String(),
+		NoOptimize: !optimize,
+		Eliminated: eliminated,
 	}
+	return expr, nil
+}
+
+// buildGraph строит граф задач по RPN, а при optimize — по упрощённому RPN.
+// Упрощение отбрасывает только то, что не может завершиться ошибкой, поэтому
+// граф упрощённого RPN проверяет выражение целиком. eliminated — число задач,
+// устранённых упрощением: только для него строится граф исходного RPN, и только
+// если упрощение что-то изменило.
+func buildGraph(tokens []token, config *Config, exprID string, vars map[string]float64, mode models.NumberMode, optimize bool) (graph *taskGraph, eliminated int, err error) {
+	if !optimize {
+		graph, err = buildTasksFromRPN(tokens, config, exprID, vars, mode)
+		return graph, 0, err
+	}
+	optimized := optimizeRPN(tokens, mode)
+	if graph, err = buildTasksFromRPN(optimized, config, exprID, vars, mode); err != nil {
+		return nil, 0, err
+	}
+	if !slices.EqualFunc(tokens, optimized, sameToken) {
+		if full, err := buildTasksFromRPN(tokens, config, exprID, vars, mode); err == nil {
+			eliminated = len(full.tasks) - len(graph.tasks)
+		}
+	}
+	return graph, eliminated, nil
+}
+
+// convertTo задаёт единицу target, в которой возвращается результат;
+// её размерность должна совпадать с размерностью выражения.
+func (expr *Expression) convertTo(target string) error {
+	u, err := parseUnit(target)
+	if err != nil {
+		return &ConversionError{Message: err.Error()}
+	}
+	if u.dim != expr.Dim {
+		return &ConversionError{Message: fmt.Sprintf("cannot convert %s to %s", unitName(expr.Dim), target)}
+	}
+	expr.Target = &u
+	expr.Unit = target
+	return nil
+}
+
+// ConversionError — запрошенный перевод результата в другую единицу невозможен.
+type ConversionError struct {
+	Message string
+}
+
+func (e *ConversionError) Error() string {
+	return e.Message
+}
+
+// registerExpression сохраняет выражение с построенными задачами и ставит
+// в очередь все задачи, готовые к выполнению.
+func (a *Application) registerExpression(expr *Expression) {
+	tasks := expr.Tasks
 	a.mutex.Lock()
-	a.expressions[exprID] = expr
+	a.expressions[expr.ID] = expr
 	for _, t := range tasks {
 		a.tasks[t.ID] = t
 	}
-	if len(tasks) > 0 && isNumeric(tasks[0].Arg1) && isNumeric(tasks[0].Arg2) {
-		a.taskQueue = append(a.taskQueue, tasks[0])
+	if len(tasks) > 0 {
 		expr.Status = StatusProcessing
 	}
+	// Выражение без задач свелось к числу, агентам считать нечего.
+	a.finishIfDone(expr)
+	// Все задачи без зависимостей можно считать параллельно. Задачи ветвей
+	// if планирует их select, когда выберет ветвь.
+	for _, t := range tasks {
+		if len(t.Guards) == 0 {
+			a.schedule(expr, t)
+		}
+	}
 	a.mutex.Unlock()
-	return expr.ID, nil
 }
 
 // giveTaskHandler обрабатывает GET-запрос на выдачу задачи агенту и POST-запрос с результатом выполнения.
@@ -160,24 +436,32 @@ func (a *Application) giveTaskHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		a.mutex.Lock()
 		defer a.mutex.Unlock()
+		a.requeueExpiredLeases()
 		if len(a.taskQueue) == 0 {
 			http.Error(w, "No task available", http.StatusNotFound)
 			return
 		}
 		task := a.taskQueue[0]
 		a.taskQueue = a.taskQueue[1:]
+		task.LeaseID = uuid.New().String()
+		task.LeaseDeadline = a.now().Add(time.Duration(task.OperationTime+a.config.TaskLeaseGraceMS) * time.Millisecond)
+		a.leased[task.ID] = task
 		outTask := struct {
-			ID            string    `json:"id"`
-			Arg1          string    `json:"arg1"`
-			Arg2          string    `json:"arg2"`
-			Operation     models.Operation `json:"operation"`
-			OperationTime int       `json:"operation_time"`
+			ID            string            `json:"id"`
+			LeaseID       string            `json:"lease_id"`
+			Args          []models.Operand  `json:"args"`
+			Operation     models.Operation  `json:"operation"`
+			OperationTime int               `json:"operation_time"`
+			Mode          models.NumberMode `json:"mode,omitempty"`
+			Unit          string            `json:"unit,omitempty"`
 		}{
 			ID:            task.ID,
-			Arg1:          task.Arg1,
-			Arg2:          task.Arg2,
+			LeaseID:       task.LeaseID,
+			Args:          task.Args,
 			Operation:     task.Operation,
 			OperationTime: task.OperationTime,
+			Mode:          task.Mode,
+			Unit:          task.Unit,
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{"task": outTask})
@@ -192,58 +476,64 @@ func (a *Application) giveTaskHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		a.mutex.Lock()
-		_, ok := a.tasks[req.ID]
+		a.requeueExpiredLeases()
+		task, ok := a.tasks[req.ID]
 		if !ok {
 			a.mutex.Unlock()
 			http.Error(w, "Task not found", http.StatusNotFound)
 			return
 		}
-		var expr *Expression
-		for _, e := range a.expressions {
-			for _, t := range e.Tasks {
-				if t.ID == req.ID {
-					expr = e
-					break
-				}
-			}
-			if expr != nil {
-				break
-			}
-		}
-		if expr == nil {
+		expr, ok := a.expressions[task.ExpressionID]
+		if !ok {
 			a.mutex.Unlock()
 			http.Error(w, "Expression not found", http.StatusNotFound)
 			return
 		}
-		var completedIndex int = -1
-		for i, t := range expr.Tasks {
-			if t.ID == req.ID {
-				completedIndex = i
-				break
-			}
+		if expr.Status == StatusFailed {
+			a.mutex.Unlock()
+			http.Error(w, "Expression has already failed", http.StatusConflict)
+			return
 		}
-		if completedIndex == -1 || completedIndex != expr.CurrentTaskIndex {
+		if task.Done {
 			a.mutex.Unlock()
-			http.Error(w, "Task is not the current one", http.StatusBadRequest)
+			http.Error(w, "Task is already completed", http.StatusBadRequest)
 			return
 		}
-		expr.CurrentTaskIndex++
-		if expr.CurrentTaskIndex < len(expr.Tasks) {
-			nextTask := expr.Tasks[expr.CurrentTaskIndex]
-			placeholder := fmt.Sprintf("T%d", completedIndex)
-			if nextTask.Arg1 == placeholder {
-				nextTask.Arg1 = fmt.Sprintf("%f", req.Result)
-			}
-			if nextTask.Arg2 == placeholder {
-				nextTask.Arg2 = fmt.Sprintf("%f", req.Result)
+		if task.LeaseID == "" || task.LeaseID != req.LeaseID {
+			// Аренда истекла, и задача уже вернулась в очередь или выдана другому агенту.
+			a.mutex.Unlock()
+			http.Error(w, "Task lease expired", http.StatusConflict)
+			return
+		}
+		if req.Unit != "" && req.Unit != task.Unit {
+			a.mutex.Unlock()
+			http.Error(w, "Invalid task result unit", http.StatusUnprocessableEntity)
+			return
+		}
+		var result json.RawMessage
+		if req.Error == nil {
+			var err error
+			if task.Operation == models.OperationMatmul {
+				rows, cols := len(task.Args[0].List), len(task.Args[1].List[0].List)
+				result, err = normalizeMatrix(expr.Mode, req.Result, rows, cols)
+			} else {
+				result, err = normalizeResult(expr.Mode, req.Result)
 			}
-			if isNumeric(nextTask.Arg1) && isNumeric(nextTask.Arg2) {
-				a.taskQueue = append(a.taskQueue, nextTask)
+			if err != nil {
+				a.mutex.Unlock()
+				http.Error(w, "Invalid task result", http.StatusUnprocessableEntity)
+				return
 			}
-		} else {
-			expr.Status = StatusCompleted
-			expr.Result = &req.Result
 		}
+		delete(a.leased, task.ID)
+		task.LeaseID = ""
+		if req.Error != nil {
+			a.failExpression(expr, req.Error)
+			a.mutex.Unlock()
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		a.completeTask(expr, task, result)
 		a.mutex.Unlock()
 		w.WriteHeader(http.StatusOK)
 		return
@@ -252,6 +542,209 @@ func (a *Application) giveTaskHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 }
 
+// completeTask сохраняет результат задачи: подставляет его в корень,
+// привязки и зависимые задачи и планирует их. Вызывается под a.mutex.
+func (a *Application) completeTask(expr *Expression, task *models.Task, result json.RawMessage) {
+	task.Done = true
+	// Результат блока произведения — матрица, на её элементы ссылаются по Index.
+	var cells [][]json.RawMessage
+	if task.Operation == models.OperationMatmul {
+		json.Unmarshal(result, &cells)
+	}
+	expr.Root = substitute(expr.Root, task.ID, result, cells)
+	for i, b := range expr.Bindings {
+		expr.Bindings[i].Operand = substitute(b.Operand, task.ID, result, cells)
+	}
+	defer a.finishIfDone(expr)
+	for _, nextTask := range expr.Tasks {
+		// Результат записывается и в задачи, которые на него ссылаются, но не
+		// ждут его: select ссылается на общую задачу let из ветви, не завися
+		// от неё, и должен знать её значение, когда выберет эту ветвь.
+		for i, arg := range nextTask.Args {
+			nextTask.Args[i] = substitute(arg, task.ID, result, cells)
+		}
+		if dependsOn(nextTask, task.ID) {
+			a.schedule(expr, nextTask)
+		}
+	}
+}
+
+// finishIfDone завершает выражение, когда известны значения корня и всех
+// привязок let. Вызывается под a.mutex.
+func (a *Application) finishIfDone(expr *Expression) {
+	if expr.Status == StatusCompleted || expr.Status == StatusFailed || !expr.Root.Resolved() {
+		return
+	}
+	for _, b := range expr.Bindings {
+		if !b.Operand.Resolved() {
+			return
+		}
+	}
+	// Результат, который не удалось перевести в запрошенную единицу или
+	// в итоговый вид, — ошибка выражения, а не пустой результат.
+	root := expr.Root
+	if expr.Target != nil {
+		var err error
+		if root, err = scaleOperand(expr.Mode, root, new(big.Rat).Inv(expr.Target.scale)); err != nil {
+			a.failExpression(expr, &models.TaskError{Code: "overflow", Message: fmt.Sprintf("cannot convert result to %s: %v", expr.Unit, err)})
+			return
+		}
+	}
+	result, err := operandResult(expr.Mode, root)
+	if err != nil {
+		a.failExpression(expr, &models.TaskError{Code: "invalid_argument", Message: err.Error()})
+		return
+	}
+	var values map[string]json.RawMessage
+	if len(expr.Bindings) > 0 {
+		values = make(map[string]json.RawMessage, len(expr.Bindings))
+		for _, b := range expr.Bindings {
+			if values[b.Name], err = operandResult(expr.Mode, b.Operand); err != nil {
+				a.failExpression(expr, &models.TaskError{Code: "invalid_argument", Message: fmt.Sprintf("binding %s: %v", b.Name, err)})
+				return
+			}
+		}
+	}
+	expr.Status = StatusCompleted
+	expr.Result = result
+	expr.BindingValues = values
+}
+
+// schedule ставит задачу в очередь, если она готова и её ветвь выбрана.
+// Задачу select оркестратор выполняет сам. Вызывается под a.mutex.
+func (a *Application) schedule(expr *Expression, task *models.Task) {
+	if !a.isReady(task) || !a.isEnabled(task) {
+		return
+	}
+	if task.Operation == models.OperationSelect {
+		a.resolveSelect(expr, task)
+		return
+	}
+	a.taskQueue = append(a.taskQueue, task)
+}
+
+// resolveSelect выбирает ветвь if по вычисленному условию и открывает задачи
+// этой ветви; select завершается, когда известно значение выбранной ветви.
+// Задачи другой ветви так и не попадают в очередь. Вызывается под a.mutex.
+func (a *Application) resolveSelect(expr *Expression, task *models.Task) {
+	if task.Chosen == 0 {
+		task.Chosen = 2
+		if isTruthy(expr.Mode, task.Args[0].Value) {
+			task.Chosen = 1
+		}
+		if ref := task.Args[task.Chosen].Ref; ref != "" {
+			task.DependsOn = append(task.DependsOn, ref)
+		}
+		for _, t := range expr.Tasks {
+			if guardedBy(t, task.ID) {
+				a.schedule(expr, t)
+			}
+		}
+	}
+	// Ветвь могла завершиться сразу при открытии и уже завершить select.
+	if a.isReady(task) {
+		a.completeTask(expr, task, task.Args[task.Chosen].Value)
+	}
+}
+
+// requeueExpiredLeases возвращает в очередь задачи, результат которых
+// не пришёл до истечения аренды. Вызывается под a.mutex.
+func (a *Application) requeueExpiredLeases() {
+	now := a.now()
+	for id, task := range a.leased {
+		if now.After(task.LeaseDeadline) {
+			delete(a.leased, id)
+			task.LeaseID = ""
+			a.taskQueue = append(a.taskQueue, task)
+		}
+	}
+}
+
+// failExpression помечает выражение как неуспешное и убирает его
+// оставшиеся задачи из очереди и из аренды. Вызывается под a.mutex.
+func (a *Application) failExpression(expr *Expression, reason *models.TaskError) {
+	expr.Status = StatusFailed
+	expr.Error = reason
+	queue := a.taskQueue[:0]
+	for _, t := range a.taskQueue {
+		if t.ExpressionID != expr.ID {
+			queue = append(queue, t)
+		}
+	}
+	a.taskQueue = queue
+	for id, t := range a.leased {
+		if t.ExpressionID == expr.ID {
+			delete(a.leased, id)
+			t.LeaseID = ""
+		}
+	}
+}
+
+// isReady сообщает, выполнены ли все задачи, от которых зависит task.
+// Вызывается под a.mutex.
+func (a *Application) isReady(task *models.Task) bool {
+	if task.Done {
+		return false
+	}
+	for _, id := range task.DependsOn {
+		dep, ok := a.tasks[id]
+		if !ok || !dep.Done {
+			return false
+		}
+	}
+	return true
+}
+
+// isEnabled сообщает, выбраны ли все ветви if, в которых находится task.
+// Вызывается под a.mutex.
+func (a *Application) isEnabled(task *models.Task) bool {
+	for _, g := range task.Guards {
+		sel, ok := a.tasks[g.Select]
+		if !ok || sel.Chosen != g.Branch {
+			return false
+		}
+	}
+	return true
+}
+
+// substitute заменяет ссылку на задачу id значением value в операнде и в
+// элементах списка; ссылка с Index получает элемент матрицы cells. Список
+// копируется: его элементы могут разделяться с другими задачами и с формой шаблона.
+func substitute(op models.Operand, id string, value json.RawMessage, cells [][]json.RawMessage) models.Operand {
+	if op.Ref == id {
+		if op.Index != nil {
+			return models.Operand{Value: cells[op.Index[0]][op.Index[1]]}
+		}
+		return models.Operand{Value: value}
+	}
+	if !op.IsList() {
+		return op
+	}
+	items := make([]models.Operand, len(op.List))
+	for i, item := range op.List {
+		items[i] = substitute(item, id, value, cells)
+	}
+	return models.Operand{List: items}
+}
+
+func guardedBy(task *models.Task, selectID string) bool {
+	for _, g := range task.Guards {
+		if g.Select == selectID {
+			return true
+		}
+	}
+	return false
+}
+
+func dependsOn(task *models.Task, id string) bool {
+	for _, dep := range task.DependsOn {
+		if dep == id {
+			return true
+		}
+	}
+	return false
+}
+
 // ExpressionsHandler возвращает список всех выражений с их статусами.
 func (a *Application) ExpressionsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -259,35 +752,59 @@ func (a *Application) ExpressionsHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	type OutExpression struct {
-		ID     string           `json:"id"`
-		Status ExpressionStatus `json:"status"`
-		Result *float64         `json:"result,omitempty"`
+		ID         string                     `json:"id"`
+		Expression string                     `json:"expression"`
+		Status     ExpressionStatus           `json:"status"`
+		Result     json.RawMessage            `json:"result,omitempty"`
+		Unit       string                     `json:"unit,omitempty"`
+		Bindings   map[string]json.RawMessage `json:"bindings,omitempty"`
+		Error      *models.TaskError          `json:"error,omitempty"`
+		// EliminatedTasks — число задач, устранённых упрощением выражения.
+		EliminatedTasks int `json:"eliminated_tasks,omitempty"`
 	}
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 	out := make([]OutExpression, 0, len(a.expressions))
 	for _, expr := range a.expressions {
-		out = append(out, OutExpression{
-			ID:     expr.ID,
-			Status: expr.Status,
-			Result: expr.Result,
-		})
+		item := OutExpression{
+			ID:              expr.ID,
+			Expression:      expr.Expression,
+			Status:          expr.Status,
+			Result:          expr.Result,
+			Unit:            expr.Unit,
+			Error:           expr.Error,
+			EliminatedTasks: expr.Eliminated,
+		}
+		if expr.ShowBindings {
+			item.Bindings = expr.BindingValues
+		}
+		out = append(out, item)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"expressions": out})
 }
 
 func (a *Application) ExpressionHandler(w http.ResponseWriter, r *http.Request) {
+	if id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/expressions/"), "/evaluate"); ok {
+		a.evaluateExpressionHandler(w, r, id)
+		return
+	}
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 4 {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/expressions/")
+	if id == "" || strings.Contains(id, "/") {
 		http.Error(w, "ID not provided", http.StatusBadRequest)
 		return
 	}
-	id := parts[3]
+	// format — запись выражения в ответе: infix, latex или mathml.
+	format := r.URL.Query().Get("format")
+	render, ok := expressionFormats[format]
+	if format != "" && !ok {
+		http.Error(w, "Unsupported format", http.StatusBadRequest)
+		return
+	}
 	a.mutex.Lock()
 	expr, ok := a.expressions[id]
 	a.mutex.Unlock()
@@ -295,89 +812,290 @@ func (a *Application) ExpressionHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Expression not found", http.StatusNotFound)
 		return
 	}
+	// Запись строится по разбору оркестратора, а не по исходному тексту,
+	// поэтому совпадает с тем, что было вычислено. Вызовы функций
+	// пользователя в ней остаются вызовами.
+	var formatted string
+	if render != nil {
+		statements, err := rpnToTree(expr.Source)
+		if err != nil {
+			http.Error(w, "Failed to render expression", http.StatusInternalServerError)
+			return
+		}
+		formatted = render(statements)
+	}
 	type OutExpression struct {
-		ID     string           `json:"id"`
-		Status ExpressionStatus `json:"status"`
-		Result *float64         `json:"result,omitempty"`
+		ID         string                     `json:"id"`
+		Expression string                     `json:"expression"`
+		Status     ExpressionStatus           `json:"status"`
+		Result     json.RawMessage            `json:"result,omitempty"`
+		Unit       string                     `json:"unit,omitempty"`
+		Bindings   map[string]json.RawMessage `json:"bindings,omitempty"`
+		Error      *models.TaskError          `json:"error,omitempty"`
+		// EliminatedTasks — число задач, устранённых упрощением выражения.
+		EliminatedTasks int `json:"eliminated_tasks,omitempty"`
+		// Formatted — выражение в формате из параметра format.
+		Formatted string `json:"formatted,omitempty"`
 	}
+	a.mutex.Lock()
 	out := OutExpression{
-		ID:     expr.ID,
-		Status: expr.Status,
-		Result: expr.Result,
+		ID:              expr.ID,
+		Expression:      expr.Expression,
+		Status:          expr.Status,
+		Result:          expr.Result,
+		Unit:            expr.Unit,
+		Error:           expr.Error,
+		EliminatedTasks: expr.Eliminated,
+		Formatted:       formatted,
+	}
+	if expr.ShowBindings {
+		out.Bindings = expr.BindingValues
 	}
+	a.mutex.Unlock()
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"expression": out})
 }
 
-func infixToRPN(expr string) ([]string, error) {
-	tokens := strings.Fields(expr)
-	output := []string{}
-	opStack := []string{}
-	precedence := map[string]int{
-		"+": 1,
-		"-": 1,
-		"*": 2,
-		"/": 2,
-	}
-	for _, token := range tokens {
-		if isNumeric(token) {
-			output = append(output, token)
-		} else if token == "(" {
-			opStack = append(opStack, token)
-		} else if token == ")" {
-			for len(opStack) > 0 && opStack[len(opStack)-1] != "(" {
-				output = append(output, opStack[len(opStack)-1])
-				opStack = opStack[:len(opStack)-1]
-			}
-			if len(opStack) == 0 {
-				return nil, fmt.Errorf("mismatched parentheses")
-			}
-			opStack = opStack[:len(opStack)-1]
-		} else if token == "+" || token == "-" || token == "*" || token == "/" {
-			for len(opStack) > 0 {
-				top := opStack[len(opStack)-1]
-				if top == "(" {
-					break
-				}
-				if precedence[top] >= precedence[token] {
-					output = append(output, top)
-					opStack = opStack[:len(opStack)-1]
-				} else {
-					break
+// evaluateExpressionHandler создаёт новое выражение из сохранённого разбора
+// выражения id с другим набором переменных.
+func (a *Application) evaluateExpressionHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req models.EvaluateRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	a.mutex.Lock()
+	expr, ok := a.expressions[id]
+	a.mutex.Unlock()
+	if !ok {
+		http.Error(w, "Expression not found", http.StatusNotFound)
+		return
+	}
+	next, err := a.buildExpression(expr.Expression, expr.RPN, req.Variables, expr.Mode, !expr.NoOptimize)
+	if err != nil {
+		writeExpressionCreated(w, "", err)
+		return
+	}
+	a.mutex.Lock()
+	next.Source = expr.Source
+	next.ShowBindings = expr.ShowBindings
+	next.Unit, next.Target = expr.Unit, expr.Target
+	a.mutex.Unlock()
+	a.registerExpression(next)
+	writeExpressionCreated(w, next.ID, nil)
+}
+
+// taskGraph — граф задач выражения. root — значение выражения: значение
+// или параметр, если задач нет, иначе ссылка на задачу-корень. bindings —
+// привязки let сценария в порядке объявления, unit — размерность результата.
+type taskGraph struct {
+	tasks    []*models.Task
+	root     models.Operand
+	bindings []binding
+	unit     dimension
+}
+
+// binding — именованное значение let: значение или ссылка на задачу.
+type binding struct {
+	Name    string
+	Operand models.Operand
+}
+
+// stackEntry — операнд на стеке построения задач. Задачи его подвыражения
+// идут в tasks подряд, начиная с first, и заканчиваются там, где начинается
+// следующий операнд; у значений, параметров и привязок let своих задач нет.
+type stackEntry struct {
+	operand models.Operand
+	first   int
+}
+
+// buildTasksFromRPN строит граф задач: каждая задача ссылается на задачи,
+// вычисляющие её операнды, поэтому независимые подвыражения считаются параллельно.
+// Переменные из vars подставляются значениями, остальные становятся
+// параметрами операндов (так строится форма задач шаблона). Привязка let
+// вычисляется одной задачей, на которую ссылаются все её использования.
+// Единицы измерения проверяются до создания задач, числа с единицами
+// переводятся в СИ, а каждая задача получает единицу своего результата.
+func buildTasksFromRPN(tokens []token, config *Config, exprID string, vars map[string]float64, mode models.NumberMode) (*taskGraph, error) {
+	dims, unit, err := checkUnits(tokens)
+	if err != nil {
+		return nil, err
+	}
+	graph := &taskGraph{unit: unit}
+	// taskUnit — единица результата задач текущего токена.
+	var taskUnit string
+	var stack []stackEntry
+	bindings := make(map[string]models.Operand)
+	push := func(op models.Operand, first int) {
+		stack = append(stack, stackEntry{operand: op, first: first})
+	}
+	pop := func(n int) []stackEntry {
+		entries := append([]stackEntry(nil), stack[len(stack)-n:]...)
+		stack = stack[:len(stack)-n]
+		return entries
+	}
+	// dropped — задачи, которые не понадобятся: ветви if с известным заранее
+	// условием и элементы списков, у которых нужна только длина.
+	dropped := make(map[*models.Task]bool)
+	// arguments — аргументы функций пользователя, вынесенные в привязки.
+	var arguments []argumentTasks
+	newTask := func(op models.Operation, opTime int, args ...models.Operand) *models.Task {
+		var deps []string
+		for _, arg := range args {
+			for _, ref := range arg.Refs() {
+				if !slices.Contains(deps, ref) {
+					deps = append(deps, ref)
 				}
 			}
-			opStack = append(opStack, token)
-		} else {
-			return nil, fmt.Errorf("unknown token: %s", token)
 		}
+		task := &models.Task{
+			ID:            uuid.New().String(),
+			ExpressionID:  exprID,
+			Args:          args,
+			Operation:     op,
+			OperationTime: opTime,
+			DependsOn:     deps,
+			Mode:          mode,
+			Unit:          taskUnit,
+		}
+		graph.tasks = append(graph.tasks, task)
+		return task
 	}
-	for len(opStack) > 0 {
-		if opStack[len(opStack)-1] == "(" || opStack[len(opStack)-1] == ")" {
-			return nil, fmt.Errorf("mismatched parentheses")
+	addTask := func(op models.Operation, opTime int, entries ...stackEntry) *models.Task {
+		args := make([]models.Operand, len(entries))
+		first := len(graph.tasks)
+		for i, e := range entries {
+			args[i] = e.operand
+		}
+		if len(entries) > 0 {
+			first = entries[0].first
 		}
-		output = append(output, opStack[len(opStack)-1])
-		opStack = opStack[:len(opStack)-1]
+		task := newTask(op, opTime, args...)
+		push(models.Operand{Ref: task.ID}, first)
+		return task
 	}
-	return output, nil
-}
-
-func buildTasksFromRPN(tokens []string, config *Config, exprID string) ([]*models.Task, error) {
-	var tasks []*models.Task
-	var stack []string 
-	taskCounter := 0
-	for _, token := range tokens {
-		if isNumeric(token) {
-			stack = append(stack, token)
-		} else if token == "+" || token == "-" || token == "*" || token == "/" {
+	// reduce сворачивает элементы операцией op деревом задач: каждая задача
+	// получает список не длиннее config.AggregateChunkSize, а частичные
+	// результаты сворачиваются так же, пока не останется одна задача.
+	reduce := func(op models.Operation, opTime int, items []models.Operand) models.Operand {
+		for len(items) > config.AggregateChunkSize {
+			var partial []models.Operand
+			for i := 0; i < len(items); i += config.AggregateChunkSize {
+				chunk := items[i:min(i+config.AggregateChunkSize, len(items))]
+				partial = append(partial, models.Operand{Ref: newTask(op, opTime, models.Operand{List: chunk}).ID})
+			}
+			items = partial
+		}
+		return models.Operand{Ref: newTask(op, opTime, models.Operand{List: items}).ID}
+	}
+	for idx, token := range tokens {
+		taskUnit = dims[idx].String()
+		if token.kind == tokenNumber {
+			if strings.HasSuffix(token.text, "i") && mode != models.NumberModeComplex {
+				return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: "imaginary numbers require complex mode"}
+			}
+			value, err := encodeValue(mode, token.text)
+			if err != nil {
+				return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: "number is out of range"}
+			}
+			push(models.Operand{Value: value}, len(graph.tasks))
+		} else if token.kind == tokenUnit {
+			// Число с единицей переводится в СИ: 5 km — это 5000 m.
+			e := pop(1)[0]
+			value, err := scaleValue(mode, e.operand.Value, units[token.text].scale)
+			if err != nil {
+				return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: "number is out of range"}
+			}
+			push(models.Operand{Value: value}, e.first)
+		} else if token.kind == tokenIdent {
+			if op, ok := bindings[token.text]; ok {
+				push(op, len(graph.tasks))
+			} else if value, ok := vars[token.text]; ok {
+				push(variableOperand(mode, value), len(graph.tasks))
+			} else {
+				push(models.Operand{Param: token.text}, len(graph.tasks))
+			}
+		} else if token.kind == tokenList {
+			if len(stack) < token.argc {
+				return nil, fmt.Errorf("invalid expression")
+			}
+			entries := pop(token.argc)
+			// Список из списков одной длины — матрица, её строки — списки чисел.
+			items := make([]models.Operand, len(entries))
+			for i, e := range entries {
+				switch {
+				case e.operand.IsMatrix():
+					return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: "nested lists are not supported"}
+				case e.operand.IsList() != entries[0].operand.IsList():
+					return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: "cannot mix numbers and lists"}
+				case e.operand.IsList() && len(e.operand.List) != len(entries[0].operand.List):
+					return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: "matrix rows must have the same length"}
+				}
+				items[i] = e.operand
+			}
+			push(models.Operand{List: items}, entries[0].first)
+		} else if token.kind == tokenBind {
+			if len(stack) < 1 {
+				return nil, fmt.Errorf("invalid expression")
+			}
+			e := pop(1)[0]
+			bindings[token.text] = e.operand
+			if isArgumentName(token.text) {
+				arguments = append(arguments, argumentTasks{operand: e.operand, tasks: slices.Clone(graph.tasks[e.first:])})
+				continue
+			}
+			graph.bindings = append(graph.bindings, binding{Name: token.text, Operand: e.operand})
+		} else if token.kind == tokenUnary {
+			if len(stack) < 1 {
+				return nil, fmt.Errorf("invalid expression")
+			}
+			if stack[len(stack)-1].operand.IsList() {
+				return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: "operator does not accept a list"}
+			}
+			if token.text == "+" {
+				continue
+			}
+			if token.text == "!" && unsupportedOperations[mode][models.OperationNot] {
+				return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: fmt.Sprintf("operator is not supported in %s mode", mode)}
+			}
+			e := pop(1)[0]
+			if token.text == "!" {
+				if e.operand.IsValue() {
+					value, _ := encodeValue(mode, "1")
+					if isTruthy(mode, e.operand.Value) {
+						value, _ = encodeValue(mode, "0")
+					}
+					push(models.Operand{Value: value}, e.first)
+					continue
+				}
+				addTask(models.OperationNot, config.TimeLogicalMS, e)
+				continue
+			}
+			if e.operand.IsValue() {
+				// Отрицание значения сворачиваем сразу, без задачи для агента.
+				value, err := negateValue(mode, e.operand.Value)
+				if err != nil {
+					return nil, err
+				}
+				push(models.Operand{Value: value}, e.first)
+				continue
+			}
+			addTask(models.OperationNegation, config.TimeNegationMS, e)
+		} else if token.kind == tokenOperator {
 			if len(stack) < 2 {
 				return nil, fmt.Errorf("invalid expression")
 			}
-			op2 := stack[len(stack)-1]
-			op1 := stack[len(stack)-2]
-			stack = stack[:len(stack)-2]
+			if stack[len(stack)-1].operand.IsList() || stack[len(stack)-2].operand.IsList() {
+				return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: "operator does not accept a list"}
+			}
 			var op models.Operation
 			var opTime int
-			switch token {
+			switch token.text {
 			case "+":
 				op = models.OperationAddition
 				opTime = config.TimeAdditionMS
@@ -390,46 +1108,348 @@ func buildTasksFromRPN(tokens []string, config *Config, exprID string) ([]*model
 			case "/":
 				op = models.OperationDivision
 				opTime = config.TimeDivisionsMS
+			case "^":
+				op = models.OperationExponentiation
+				opTime = config.TimeExponentiationMS
+			case "%":
+				op = models.OperationModulo
+				opTime = config.TimeModuloMS
+			case "//":
+				op = models.OperationIntegerDivision
+				opTime = config.TimeIntegerDivisionMS
+			case "<":
+				op = models.OperationLess
+				opTime = config.TimeComparisonMS
+			case "<=":
+				op = models.OperationLessEqual
+				opTime = config.TimeComparisonMS
+			case ">":
+				op = models.OperationGreater
+				opTime = config.TimeComparisonMS
+			case ">=":
+				op = models.OperationGreaterEqual
+				opTime = config.TimeComparisonMS
+			case "==":
+				op = models.OperationEqual
+				opTime = config.TimeComparisonMS
+			case "!=":
+				op = models.OperationNotEqual
+				opTime = config.TimeComparisonMS
+			case "&&":
+				op = models.OperationAnd
+				opTime = config.TimeLogicalMS
+			case "||":
+				op = models.OperationOr
+				opTime = config.TimeLogicalMS
+			default:
+				return nil, fmt.Errorf("unknown operator in RPN: %s", token.text)
+			}
+			if unsupportedOperations[mode][op] {
+				return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: fmt.Sprintf("operator is not supported in %s mode", mode)}
+			}
+			addTask(op, opTime, pop(2)...)
+		} else if token.kind == tokenFunction {
+			fn, ok := builtinFunctions[token.text]
+			if !ok {
+				return nil, fmt.Errorf("unknown function in RPN: %s", token.text)
+			}
+			if !fn.supports(mode) {
+				return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: fmt.Sprintf("function is not supported in %s mode", mode)}
+			}
+			if len(stack) < token.argc {
+				return nil, fmt.Errorf("invalid expression")
+			}
+			args := pop(token.argc)
+			lists, matrices := 0, 0
+			for _, e := range args {
+				if e.operand.IsList() {
+					lists++
+				}
+				if e.operand.IsMatrix() {
+					matrices++
+				}
+			}
+			if lists > 0 && !fn.list {
+				return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: "function does not accept a list"}
+			}
+			if matrices > 0 && !fn.matrix {
+				return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: "function does not accept a matrix"}
+			}
+			if (token.text == "matmul" || token.text == "transpose" || token.text == "det") && matrices != len(args) {
+				return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: "function expects a matrix"}
+			}
+			opTime := config.FunctionTimesMS[token.text]
+			switch {
+			case token.text == "dot":
+				if lists != 2 {
+					return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: "function expects lists"}
+				}
+				a, b := args[0].operand.List, args[1].operand.List
+				if len(a) != len(b) {
+					return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: "lists must have the same length"}
+				}
+				// Скалярное произведение считается по частям, частичные суммы сводятся деревом.
+				var partial []models.Operand
+				for i := 0; i < len(a); i += config.AggregateChunkSize {
+					j := min(i+config.AggregateChunkSize, len(a))
+					t := newTask(models.OperationDot, opTime, models.Operand{List: a[i:j]}, models.Operand{List: b[i:j]})
+					partial = append(partial, models.Operand{Ref: t.ID})
+				}
+				root := partial[0]
+				if len(partial) > 1 {
+					root = reduce(models.OperationSum, config.FunctionTimesMS["sum"], partial)
+				}
+				push(root, args[0].first)
+				continue
+			case token.text == "len":
+				// Длина известна при построении, задачи элементов не нужны.
+				for _, t := range graph.tasks[args[0].first:] {
+					dropped[t] = true
+				}
+				value, _ := encodeValue(mode, strconv.Itoa(len(listItems(args))))
+				push(models.Operand{Value: value}, args[0].first)
+				continue
+			case token.text == "avg":
+				items := listItems(args)
+				sum := reduce(models.OperationSum, config.FunctionTimesMS["sum"], items)
+				count, _ := encodeValue(mode, strconv.Itoa(len(items)))
+				t := newTask(models.OperationDivision, opTime, sum, models.Operand{Value: count})
+				push(models.Operand{Ref: t.ID}, args[0].first)
+				continue
+			case token.text == "matmul":
+				product, err := multiplyMatrices(args[0].operand.List, args[1].operand.List, config.MatrixBlockSize, func(a, b []models.Operand) string {
+					return newTask(models.OperationMatmul, opTime, models.Operand{List: a}, models.Operand{List: b}).ID
+				})
+				if err != nil {
+					return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: err.Error()}
+				}
+				push(models.Operand{List: product}, args[0].first)
+				continue
+			case token.text == "transpose":
+				push(models.Operand{List: transpose(args[0].operand.List)}, args[0].first)
+				continue
+			case token.text == "det":
+				if m := args[0].operand.List; len(m) != len(m[0].List) {
+					return nil, &SyntaxError{Pos: token.pos, Token: token.text, Message: "matrix is not square"}
+				}
+				addTask(fn.operation, opTime, args...)
+				continue
+			case lists > 0:
+				push(reduce(fn.operation, opTime, listItems(args)), args[0].first)
+				continue
+			case fn.operation != models.OperationSelect:
+				addTask(fn.operation, opTime, args...)
+				continue
+			}
+			cond, then, otherwise := args[0], args[1], args[2]
+			thenTasks := graph.tasks[then.first:otherwise.first]
+			otherwiseTasks := graph.tasks[otherwise.first:]
+			if cond.operand.IsValue() {
+				// Условие известно заранее: задачи другой ветви не нужны.
+				chosen, other := otherwise.operand, thenTasks
+				if isTruthy(mode, cond.operand.Value) {
+					chosen, other = then.operand, otherwiseTasks
+				}
+				for _, t := range other {
+					dropped[t] = true
+				}
+				push(chosen, cond.first)
+				continue
+			}
+			sel := addTask(models.OperationSelect, 0, args...)
+			// Select ждёт только условия, а ветвь добавляет в зависимости после выбора.
+			sel.DependsOn = nil
+			if cond.operand.Ref != "" {
+				sel.DependsOn = []string{cond.operand.Ref}
+			}
+			for branch, tasks := range [][]*models.Task{thenTasks, otherwiseTasks} {
+				for _, t := range tasks {
+					t.Guards = append(t.Guards, models.Guard{Select: sel.ID, Branch: branch + 1})
+				}
 			}
-			task := &models.Task{
-				ID:            uuid.New().String(),
-				Arg1:          op1,
-				Arg2:          op2,
-				Operation:     op,
-				OperationTime: opTime,
-			}
-			tasks = append(tasks, task)
-			placeholder := fmt.Sprintf("T%d", taskCounter)
-			stack = append(stack, placeholder)
-			taskCounter++
 		} else {
-			return nil, fmt.Errorf("unknown token in RPN: %s", token)
+			return nil, fmt.Errorf("unknown token in RPN: %s", token.text)
 		}
 	}
 	if len(stack) != 1 {
 		return nil, fmt.Errorf("invalid expression, remaining stack: %v", stack)
 	}
-	return tasks, nil
+	graph.root = stack[0].operand
+	guardArguments(graph, arguments, dropped)
+	if len(dropped) > 0 {
+		kept := graph.tasks[:0]
+		for _, t := range graph.tasks {
+			if !dropped[t] {
+				kept = append(kept, t)
+			}
+		}
+		graph.tasks = kept
+	}
+	return graph, nil
 }
 
-func isValidExpression(expression string) bool {
-	for _, char := range expression {
-		if !isValidChar(char) {
-			return false
+// argumentTasks — аргумент вызова функции пользователя, вынесенный
+// в привязку, и задачи, которые его вычисляют.
+type argumentTasks struct {
+	operand models.Operand
+	tasks   []*models.Task
+}
+
+// guardArguments ставит задачам вынесенного аргумента общие условия задач,
+// которые его используют: аргумент вызова из ветви if вычисляется, только
+// если ветвь выбрана, а аргумент, нужный лишь отброшенным задачам,
+// отбрасывается. Аргументы обходятся с конца: задачи аргумента могут
+// использовать аргументы, вынесенные раньше.
+func guardArguments(graph *taskGraph, arguments []argumentTasks, dropped map[*models.Task]bool) {
+	if len(arguments) == 0 {
+		return
+	}
+	// users — задачи, в аргументах которых есть ссылка на задачу с данным ID;
+	// shared — задачи, на которые ссылаются корень и привязки let.
+	users := make(map[string][]*models.Task)
+	for _, t := range graph.tasks {
+		for _, arg := range t.Args {
+			for _, ref := range arg.Refs() {
+				if list := users[ref]; len(list) == 0 || list[len(list)-1] != t {
+					users[ref] = append(list, t)
+				}
+			}
 		}
 	}
-	return true
+	shared := make(map[string]bool)
+	for _, ref := range graph.root.Refs() {
+		shared[ref] = true
+	}
+	for _, b := range graph.bindings {
+		for _, ref := range b.Operand.Refs() {
+			shared[ref] = true
+		}
+	}
+	for i := len(arguments) - 1; i >= 0; i-- {
+		arg := arguments[i]
+		own := make(map[*models.Task]bool, len(arg.tasks))
+		for _, t := range arg.tasks {
+			own[t] = true
+		}
+		// guards — условия, общие для всех задач, которые используют аргумент;
+		// unconditional — аргумент нужен без условий.
+		var guards []models.Guard
+		used, unused, unconditional := false, false, false
+		for _, ref := range arg.operand.Refs() {
+			if shared[ref] {
+				used, unconditional = true, true
+			}
+			for _, t := range users[ref] {
+				switch {
+				case own[t]:
+				case dropped[t]:
+					unused = true
+				case !used:
+					guards, used = t.Guards, true
+				default:
+					guards = slices.DeleteFunc(slices.Clone(guards), func(g models.Guard) bool { return !slices.Contains(t.Guards, g) })
+				}
+			}
+		}
+		unconditional = unconditional || len(guards) == 0
+		for _, t := range arg.tasks {
+			switch {
+			case !used && unused:
+				dropped[t] = true
+			case !unconditional:
+				t.Guards = append(t.Guards, guards...)
+			}
+		}
+	}
+}
+
+// listItems раскрывает аргументы агрегата в один список: списки дают свои
+// элементы, числа — себя.
+func listItems(args []stackEntry) []models.Operand {
+	var items []models.Operand
+	for _, e := range args {
+		if e.operand.IsList() {
+			items = append(items, e.operand.List...)
+		} else {
+			items = append(items, e.operand)
+		}
+	}
+	return items
+}
+
+// multiplyMatrices строит произведение матриц a и b по блокам: результат
+// делится на блоки со стороной block, и каждый блок считает своя задача,
+// которую создаёт newBlock по строкам a и столбцам b. Элементы результата —
+// ссылки с Index на элементы блоков.
+func multiplyMatrices(a, b []models.Operand, block int, newBlock func(rows, cols []models.Operand) string) ([]models.Operand, error) {
+	if len(a[0].List) != len(b) {
+		return nil, fmt.Errorf("matrix dimensions do not match (%dx%d and %dx%d)", len(a), len(a[0].List), len(b), len(b[0].List))
+	}
+	n, m := len(a), len(b[0].List)
+	product := make([]models.Operand, n)
+	for i := range product {
+		product[i] = models.Operand{List: make([]models.Operand, m)}
+	}
+	for i0 := 0; i0 < n; i0 += block {
+		i1 := min(i0+block, n)
+		for j0 := 0; j0 < m; j0 += block {
+			j1 := min(j0+block, m)
+			cols := make([]models.Operand, len(b))
+			for k, row := range b {
+				cols[k] = models.Operand{List: row.List[j0:j1]}
+			}
+			id := newBlock(a[i0:i1], cols)
+			for i := i0; i < i1; i++ {
+				for j := j0; j < j1; j++ {
+					product[i].List[j] = models.Operand{Ref: id, Index: []int{i - i0, j - j0}}
+				}
+			}
+		}
+	}
+	return product, nil
 }
 
-func isValidChar(char rune) bool {
-	return (char >= '0' && char <= '9') ||
-		char == '+' || char == '-' ||
-		char == '*' || char == '/' ||
-		char == '(' || char == ')' ||
-		char == '.' || char == ' '
+// transpose переставляет элементы матрицы m: строки становятся столбцами.
+func transpose(m []models.Operand) []models.Operand {
+	out := make([]models.Operand, len(m[0].List))
+	for j := range out {
+		row := make([]models.Operand, len(m))
+		for i := range m {
+			row[i] = m[i].List[j]
+		}
+		out[j] = models.Operand{List: row}
+	}
+	return out
+}
+
+// UnboundVariablesError перечисляет переменные выражения, для которых не передано значение.
+type UnboundVariablesError struct {
+	Names []string
+}
+
+func (e *UnboundVariablesError) Error() string {
+	return "unbound variables: " + strings.Join(e.Names, ", ")
 }
 
-func isNumeric(s string) bool {
-	_, err := strconv.ParseFloat(s, 64)
-	return err == nil
+// unboundVariables возвращает отсортированный список переменных из tokens,
+// отсутствующих в vars. Имена, уже привязанные let, переменными не считаются.
+func unboundVariables(tokens []token, vars map[string]float64) []string {
+	seen := make(map[string]bool)
+	bound := make(map[string]bool)
+	var names []string
+	for _, t := range tokens {
+		if t.kind == tokenBind {
+			bound[t.text] = true
+			continue
+		}
+		if t.kind != tokenIdent || seen[t.text] || bound[t.text] {
+			continue
+		}
+		seen[t.text] = true
+		if _, ok := vars[t.text]; !ok {
+			names = append(names, t.text)
+		}
+	}
+	sort.Strings(names)
+	return names
 }
@@ -6,7 +6,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/Tuma78/server/models"
 )
 
 func TestConfigFromEnv(t *testing.T) {
@@ -44,6 +49,25 @@ func TestConfigFromEnv(t *testing.T) {
 	}
 }
 
+func TestTaskLeaseGraceFromEnv(t *testing.T) {
+	tests := []struct {
+		env      string
+		expected int
+	}{
+		{"", 5000},
+		{"1500", 1500},
+		{"0", 0},
+		{"-100", 5000},
+		{"abc", 5000},
+	}
+	for _, tc := range tests {
+		t.Setenv("TASK_LEASE_GRACE_MS", tc.env)
+		if got := ConfigFromEnv().TaskLeaseGraceMS; got != tc.expected {
+			t.Errorf("For TASK_LEASE_GRACE_MS=%q: expected %d, got %d", tc.env, tc.expected, got)
+		}
+	}
+}
+
 func TestNew(t *testing.T) {
 	app := New()
 	if app == nil {
@@ -58,29 +82,34 @@ func TestCalcHandler(t *testing.T) {
 	tests := []struct {
 		name           string
 		method         string
-		body           Request
+		body           models.Request
 		expectedStatus int
-		expectedBody   Response
+		expectedBody   models.Response
 	}{
 		{
 			name:           "Valid expression",
 			method:         http.MethodPost,
-			body:           Request{Expression: "2 + 2"},
-			expectedStatus: http.StatusOK,
-			expectedBody:   Response{Result: "4.000000"},
+			body:           models.Request{Expression: "2 + 2"},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "Expression without spaces",
+			method:         http.MethodPost,
+			body:           models.Request{Expression: "2+2*2"},
+			expectedStatus: http.StatusCreated,
 		},
 		{
 			name:           "Invalid method",
 			method:         http.MethodGet,
-			body:           Request{},
+			body:           models.Request{},
 			expectedStatus: http.StatusMethodNotAllowed,
 		},
 		{
 			name:           "Invalid expression characters",
 			method:         http.MethodPost,
-			body:           Request{Expression: "2 + 2 = ?"},
+			body:           models.Request{Expression: "2 + 2 = ?"},
 			expectedStatus: http.StatusUnprocessableEntity,
-			expectedBody:   Response{Error: "Expression is not valid"},
+			expectedBody:   models.Response{Error: "Expression is not valid", Token: "?"},
 		},
 	}
 
@@ -90,25 +119,28 @@ func TestCalcHandler(t *testing.T) {
 			req := httptest.NewRequest(tc.method, "/api/v1/calculate", bytes.NewBuffer(bodyBytes))
 			w := httptest.NewRecorder()
 
-			CalcHandler(w, req)
+			New().CalcHandler(w, req)
 
 			if w.Code != tc.expectedStatus {
 				t.Errorf("Expected status code %d, got %d", tc.expectedStatus, w.Code)
 			}
 
-			if tc.expectedStatus == http.StatusOK || tc.expectedStatus == http.StatusUnprocessableEntity {
-				var response Response
+			if tc.expectedStatus == http.StatusCreated || tc.expectedStatus == http.StatusUnprocessableEntity {
+				var response models.Response
 				err := json.NewDecoder(w.Body).Decode(&response)
 				if err != nil {
 					t.Fatalf("Failed to decode response body: %v", err)
 				}
 
-				if tc.expectedBody.Result != "" && response.Result != tc.expectedBody.Result {
-					t.Errorf("Expected result %s, got %s", tc.expectedBody.Result, response.Result)
+				if tc.expectedStatus == http.StatusCreated && response.ID == "" {
+					t.Errorf("Expected expression id in response")
 				}
 				if tc.expectedBody.Error != "" && response.Error != tc.expectedBody.Error {
 					t.Errorf("Expected error %s, got %s", tc.expectedBody.Error, response.Error)
 				}
+				if tc.expectedBody.Token != "" && (response.Token != tc.expectedBody.Token || response.Position == nil) {
+					t.Errorf("Expected error position at token %q, got %q", tc.expectedBody.Token, response.Token)
+				}
 			}
 		})
 	}
@@ -123,8 +155,10 @@ func TestIsValidExpression(t *testing.T) {
 		{"2.5 * 3.7", true},
 		{"(1 + 2) * 3", true},
 		{"2 + 2 = 4", false},
-		{"hello", false},
-		{"2 ^ 2", false},
+		{"hello", true},
+		{"hello world", false},
+		{"2 ^ 2", true},
+		{"2 ^^ 2", false},
 	}
 
 	for _, tc := range tests {
@@ -137,8 +171,9 @@ func TestIsValidExpression(t *testing.T) {
 
 func TestIsValidChar(t *testing.T) {
 	validChars := []rune{'0', '1', '2', '3', '4', '5', '6', '7', '8', '9',
-		'+', '-', '*', '/', '(', ')', '.', ' '}
-	invalidChars := []rune{'=', '^', 'a', '$', '&'}
+		'+', '-', '*', '/', '^', '%', '(', ')', '.', ' ', ',', 'a', 'Z', '_',
+		'<', '>', '=', '!', '&', '|'}
+	invalidChars := []rune{'$', '#', '@', '~'}
 
 	for _, char := range validChars {
 		if !isValidChar(char) {
@@ -151,4 +186,843 @@ func TestIsValidChar(t *testing.T) {
 			t.Errorf("Character %q should be invalid", char)
 		}
 	}
-}
\ No newline at end of file
+}
+func TestBuildTasksFromRPNDependencies(t *testing.T) {
+	tokens, err := infixToRPN("( 1 + 2 ) * ( 3 + 4 )")
+	if err != nil {
+		t.Fatalf("infixToRPN: %v", err)
+	}
+	graph, err := buildTasksFromRPN(tokens, ConfigFromEnv(), "expr", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("buildTasksFromRPN: %v", err)
+	}
+	tasks := graph.tasks
+	if len(tasks) != 3 {
+		t.Fatalf("Expected 3 tasks, got %d", len(tasks))
+	}
+	if len(tasks[0].DependsOn) != 0 || len(tasks[1].DependsOn) != 0 {
+		t.Errorf("Expected leaf tasks without dependencies")
+	}
+	root := tasks[2]
+	if len(root.DependsOn) != 2 || root.DependsOn[0] != tasks[0].ID || root.DependsOn[1] != tasks[1].ID {
+		t.Errorf("Expected root to depend on both leaf tasks, got %v", root.DependsOn)
+	}
+}
+
+func TestBuildTasksFromRPNUnary(t *testing.T) {
+	config := ConfigFromEnv()
+
+	rpn, _ := infixToRPN("- 5 + 3")
+	graph, err := buildTasksFromRPN(rpn, config, "expr", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("buildTasksFromRPN: %v", err)
+	}
+	tasks := graph.tasks
+	if len(tasks) != 1 || argText(tasks[0].Args[0]) != "-5" {
+		t.Errorf("Expected negated literal to be folded, got %+v", tasks)
+	}
+
+	rpn, _ = infixToRPN("- ( 1 + 2 )")
+	graph, err = buildTasksFromRPN(rpn, config, "expr", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("buildTasksFromRPN: %v", err)
+	}
+	tasks = graph.tasks
+	if len(tasks) != 2 || tasks[1].Operation != models.OperationNegation || tasks[1].DependsOn[0] != tasks[0].ID {
+		t.Errorf("Expected negation task depending on the sum, got %+v", tasks)
+	}
+
+	app := New()
+	exprID, err := app.addExpression("- - 5", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	expr := app.expressions[exprID]
+	if expr.Status != StatusCompleted || string(expr.Result) != "5" {
+		t.Errorf("Expected literal expression to complete immediately, got %s", expr.Status)
+	}
+}
+
+func TestBuildTasksFromRPNFunctions(t *testing.T) {
+	config := ConfigFromEnv()
+	rpn, err := infixToRPN("max(1 + 2, 3, sqrt(4))")
+	if err != nil {
+		t.Fatalf("infixToRPN: %v", err)
+	}
+	graph, err := buildTasksFromRPN(rpn, config, "expr", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("buildTasksFromRPN: %v", err)
+	}
+	tasks := graph.tasks
+	if len(tasks) != 3 {
+		t.Fatalf("Expected 3 tasks, got %d", len(tasks))
+	}
+	root := tasks[2]
+	if root.Operation != models.OperationMax || len(root.Args) != 3 || argText(root.Args[1]) != "3" {
+		t.Errorf("Unexpected max task %+v", root)
+	}
+	if len(root.DependsOn) != 2 {
+		t.Errorf("Expected max to depend on two tasks, got %v", root.DependsOn)
+	}
+	if tasks[1].OperationTime != config.FunctionTimesMS["sqrt"] {
+		t.Errorf("Expected sqrt to use its own cost")
+	}
+}
+
+func TestVariables(t *testing.T) {
+	app := New()
+	_, err := app.addExpression("price * qty * (1 + tax)", map[string]float64{"price": 9.5}, models.NumberModeFloat)
+	unboundErr, ok := err.(*UnboundVariablesError)
+	if !ok || strings.Join(unboundErr.Names, ",") != "qty,tax" {
+		t.Fatalf("Expected unbound qty and tax, got %v", err)
+	}
+
+	exprID, err := app.addExpression("price * qty * (1 + tax)", map[string]float64{"price": 9.5, "qty": 3, "tax": 0.2}, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	tasks := app.expressions[exprID].Tasks
+	if argText(tasks[0].Args[0]) != "9.5" || argText(tasks[0].Args[1]) != "3" || argText(tasks[1].Args[1]) != "0.2" {
+		t.Errorf("Expected variables to be substituted, got %v %v", tasks[0].Args, tasks[1].Args)
+	}
+
+	body, _ := json.Marshal(models.EvaluateRequest{Variables: map[string]float64{"price": 1, "qty": 2, "tax": 0}})
+	w := httptest.NewRecorder()
+	app.ExpressionHandler(w, httptest.NewRequest(http.MethodPost, "/api/v1/expressions/"+exprID+"/evaluate", bytes.NewBuffer(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected re-evaluation to create an expression, got %d", w.Code)
+	}
+	var resp models.Response
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.ID == "" || resp.ID == exprID || argText(app.expressions[resp.ID].Tasks[0].Args[0]) != "1" {
+		t.Errorf("Expected a new expression with the new binding")
+	}
+
+	body, _ = json.Marshal(models.EvaluateRequest{Variables: map[string]float64{"price": 1}})
+	w = httptest.NewRecorder()
+	app.ExpressionHandler(w, httptest.NewRequest(http.MethodPost, "/api/v1/expressions/"+exprID+"/evaluate", bytes.NewBuffer(body)))
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusUnprocessableEntity || len(resp.Unbound) != 2 {
+		t.Errorf("Expected 422 listing unbound variables, got %d %v", w.Code, resp.Unbound)
+	}
+}
+
+func TestOperandReferences(t *testing.T) {
+	app := New()
+	exprID, err := app.addExpression("(0.1 + 0.2) * 3", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	tasks := app.expressions[exprID].Tasks
+	if tasks[1].Args[0].Ref != tasks[0].ID || tasks[1].Args[0].Value != nil {
+		t.Fatalf("Expected a reference to the addition task, got %+v", tasks[1].Args[0])
+	}
+
+	addition := fetchTask(t, app)
+	postResult(t, app, addition, 0.30000000000000004, http.StatusOK)
+	multiplication := fetchTask(t, app)
+	if got := string(multiplication.Args[0].Value); got != "0.30000000000000004" {
+		t.Errorf("Expected result to be substituted without rounding, got %s", got)
+	}
+
+	// Параметр с именем, похожим на прежние плейсхолдеры, не путается со ссылкой.
+	rpn, _ := infixToRPN("(1 + 2) * T0")
+	graph, err := buildTasksFromRPN(rpn, app.config, "", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("buildTasksFromRPN: %v", err)
+	}
+	tasks = graph.tasks
+	if tasks[1].Args[1].Param != "T0" || len(tasks[1].DependsOn) != 1 {
+		t.Errorf("Expected T0 to stay a parameter, got %+v", tasks[1])
+	}
+}
+
+func TestConditionalDispatchesOnlyChosenBranch(t *testing.T) {
+	app := New()
+	exprID, err := app.addExpression("if(a > b, a - b, sqrt(a) * 2) + 1", map[string]float64{"a": 9, "b": 4}, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	if len(app.taskQueue) != 1 {
+		t.Fatalf("Expected only the condition to be queued, got %d tasks", len(app.taskQueue))
+	}
+	cond := fetchTask(t, app)
+	if cond.Operation != models.OperationGreater {
+		t.Fatalf("Expected comparison task, got %s", cond.Operation)
+	}
+	postResult(t, app, cond, 1, http.StatusOK)
+
+	branch := fetchTask(t, app)
+	if branch.Operation != models.OperationSubtraction {
+		t.Fatalf("Expected the then-branch to be dispatched, got %s", branch.Operation)
+	}
+	if len(app.taskQueue) != 0 {
+		t.Fatalf("The other branch must not be dispatched")
+	}
+	postResult(t, app, branch, 5, http.StatusOK)
+	addition := fetchTask(t, app)
+	if addition.Operation != models.OperationAddition || argText(addition.Args[0]) != "5" {
+		t.Fatalf("Expected the selected value to flow into the addition, got %+v", addition)
+	}
+	postResult(t, app, addition, 6, http.StatusOK)
+	if expr := app.expressions[exprID]; expr.Status != StatusCompleted || string(expr.Result) != "6" {
+		t.Errorf("Expected result 6, got %s %s", expr.Status, expr.Result)
+	}
+	for _, task := range app.expressions[exprID].Tasks {
+		if task.Operation == models.OperationSqrt && (task.Done || task.LeaseID != "") {
+			t.Errorf("Unchosen branch task was dispatched")
+		}
+	}
+
+	// Ветвь ссылается на общую задачу let, которая завершилась раньше условия.
+	exprID, err = app.addExpression("let a = sqrt(x); if(x > 0, a, 0)", map[string]float64{"x": 4}, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	shared, cond := fetchTask(t, app), fetchTask(t, app)
+	if shared.Operation != models.OperationSqrt || cond.Operation != models.OperationGreater {
+		t.Fatalf("Expected sqrt and comparison tasks, got %s and %s", shared.Operation, cond.Operation)
+	}
+	postResult(t, app, shared, 2, http.StatusOK)
+	postResult(t, app, cond, 1, http.StatusOK)
+	if expr := app.expressions[exprID]; expr.Status != StatusCompleted || string(expr.Result) != "2" {
+		t.Errorf("Expected the shared binding value 2, got %s %s", expr.Status, expr.Result)
+	}
+
+	// Условие из литералов выбирает ветвь сразу, задачи другой ветви не создаются.
+	graph, err := buildTasksFromRPN(mustInfixToRPN(t, "if(0, 1 + 2, 3 * 4)"), app.config, "", nil, models.NumberModeFloat)
+	if err != nil || len(graph.tasks) != 1 || graph.tasks[0].Operation != models.OperationMultiplication || graph.root.Ref != graph.tasks[0].ID {
+		t.Errorf("Expected the constant condition to be folded, got %+v %v", graph, err)
+	}
+
+	// Вложенный if шаблона выбирает обе ветви при регистрации, без агентов.
+	tplID, err := app.addTemplate("if(x, if(y, 1, 2), 3)", nil, []string{"x", "y"}, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addTemplate: %v", err)
+	}
+	exprID, _ = app.instantiateTemplate(app.templates[tplID], map[string]float64{"x": 1, "y": 0})
+	if expr := app.expressions[exprID]; expr.Status != StatusCompleted || string(expr.Result) != "2" {
+		t.Errorf("Expected nested conditional to resolve to 2, got %s %s", expr.Status, expr.Result)
+	}
+}
+
+func TestScriptBindings(t *testing.T) {
+	app := New()
+	w := postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{
+		Expression:      "let r = 5; let area = 3.14159 * r ^ 2; area * 2 + area",
+		IncludeBindings: true,
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created models.Response
+	json.NewDecoder(w.Body).Decode(&created)
+	expr := app.expressions[created.ID]
+	if len(expr.Tasks) != 4 {
+		t.Fatalf("Expected area to be computed by shared tasks, got %d tasks", len(expr.Tasks))
+	}
+
+	power := fetchTask(t, app)
+	postResult(t, app, power, 25, http.StatusOK)
+	area := fetchTask(t, app)
+	postResult(t, app, area, 78.53975, http.StatusOK)
+	double := fetchTask(t, app)
+	if double.Operation != models.OperationMultiplication || len(app.taskQueue) != 0 {
+		t.Fatalf("Expected only the multiplication to be ready, got %s", double.Operation)
+	}
+	postResult(t, app, double, 157.0795, http.StatusOK)
+	sum := fetchTask(t, app)
+	if argText(sum.Args[1]) != "78.53975" {
+		t.Errorf("Expected the shared area value, got %v", sum.Args)
+	}
+	postResult(t, app, sum, 235.61925, http.StatusOK)
+
+	w = httptest.NewRecorder()
+	app.ExpressionHandler(w, httptest.NewRequest(http.MethodGet, "/api/v1/expressions/"+created.ID, nil))
+	var resp struct {
+		Expression struct {
+			Result   json.RawMessage            `json:"result"`
+			Bindings map[string]json.RawMessage `json:"bindings"`
+		} `json:"expression"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if string(resp.Expression.Result) != "235.61925" || string(resp.Expression.Bindings["r"]) != "5" || string(resp.Expression.Bindings["area"]) != "78.53975" {
+		t.Errorf("Unexpected result %s with bindings %v", resp.Expression.Result, resp.Expression.Bindings)
+	}
+
+	// Привязка, не влияющая на результат, всё равно вычисляется до завершения.
+	exprID, err := app.addExpression("let unused = 2 * 3; 1", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	if app.expressions[exprID].Status != StatusProcessing {
+		t.Fatalf("Expected the script to wait for its bindings")
+	}
+	postResult(t, app, fetchTask(t, app), 6, http.StatusOK)
+	if expr := app.expressions[exprID]; expr.Status != StatusCompleted || string(expr.Result) != "1" {
+		t.Errorf("Expected result 1, got %s %s", expr.Status, expr.Result)
+	}
+
+	if _, err := app.addExpression("let a = b + 1; a", nil, models.NumberModeFloat); err == nil {
+		t.Error("Expected unbound variable b to be reported")
+	}
+}
+
+func TestListAggregates(t *testing.T) {
+	app := New()
+	exprID, err := app.addExpression("sum([1, 2, 3, 4]) / len([1, 2, 3, 4])", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	if n := len(app.expressions[exprID].Tasks); n != 2 {
+		t.Fatalf("Expected sum and division tasks, got %d", n)
+	}
+	sum := fetchTask(t, app)
+	if sum.Operation != models.OperationSum || len(sum.Args) != 1 || len(sum.Args[0].List) != 4 {
+		t.Fatalf("Expected sum over a list of 4, got %s %v", sum.Operation, sum.Args)
+	}
+	postResult(t, app, sum, 10, http.StatusOK)
+	division := fetchTask(t, app)
+	if argText(division.Args[0]) != "10" || argText(division.Args[1]) != "4" {
+		t.Fatalf("Expected 10 / 4, got %v", division.Args)
+	}
+	postResult(t, app, division, 2.5, http.StatusOK)
+	if expr := app.expressions[exprID]; expr.Status != StatusCompleted || string(expr.Result) != "2.5" {
+		t.Errorf("Expected result 2.5, got %s %s", expr.Status, expr.Result)
+	}
+
+	// Длина известна при построении, поэтому элементы не вычисляются.
+	exprID, err = app.addExpression("len([1 + 2, 3])", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	if expr := app.expressions[exprID]; len(expr.Tasks) != 0 || string(expr.Result) != "2" {
+		t.Errorf("Expected len to be folded to 2, got %d tasks and %s", len(expr.Tasks), expr.Result)
+	}
+
+	exprID, err = app.addExpression("let v = [1 + 1, 3]; sum(v) * len(v)", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	postResult(t, app, fetchTask(t, app), 2, http.StatusOK)
+	sum = fetchTask(t, app)
+	if items := sum.Args[0].List; len(items) != 2 || argText(items[0]) != "2" || argText(items[1]) != "3" {
+		t.Fatalf("Expected resolved list [2, 3], got %v", sum.Args)
+	}
+	postResult(t, app, sum, 5, http.StatusOK)
+	postResult(t, app, fetchTask(t, app), 10, http.StatusOK)
+	expr := app.expressions[exprID]
+	if string(expr.Result) != "10" || string(expr.BindingValues["v"]) != "[2,3]" {
+		t.Errorf("Expected 10 with v = [2,3], got %s with %s", expr.Result, expr.BindingValues["v"])
+	}
+
+	for _, expression := range []string{"[1, 2] + 1", "sum([[1], 2])", "sqrt([4])", "dot([1, 2], [3])", "dot(1, 2)", "if([1], 2, 3)"} {
+		if _, err := app.addExpression(expression, nil, models.NumberModeFloat); err == nil {
+			t.Errorf("Expected error for %q", expression)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("Expected SyntaxError for %q, got %v", expression, err)
+		}
+	}
+}
+
+func TestAggregateReductionTree(t *testing.T) {
+	app := New()
+	app.config.AggregateChunkSize = 4
+	exprID, err := app.addExpression("sum([1, 2, 3, 4, 5, 6, 7, 8, 9, 10])", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	if len(app.taskQueue) != 3 {
+		t.Fatalf("Expected 3 partial sums to be ready at once, got %d", len(app.taskQueue))
+	}
+	for _, partial := range []float64{10, 26, 19} {
+		postResult(t, app, fetchTask(t, app), partial, http.StatusOK)
+	}
+	root := fetchTask(t, app)
+	if items := root.Args[0].List; len(items) != 3 || argText(items[1]) != "26" {
+		t.Fatalf("Expected the root to sum partial results, got %v", root.Args)
+	}
+	postResult(t, app, root, 55, http.StatusOK)
+	if expr := app.expressions[exprID]; string(expr.Result) != "55" {
+		t.Errorf("Expected result 55, got %s", expr.Result)
+	}
+
+	exprID, err = app.addExpression("dot([1, 2, 3, 4, 5], [1, 1, 1, 1, 1])", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	tasks := app.expressions[exprID].Tasks
+	if len(tasks) != 3 || tasks[0].Operation != models.OperationDot || tasks[2].Operation != models.OperationSum {
+		t.Fatalf("Expected two partial dot products and a sum, got %d tasks", len(tasks))
+	}
+	if len(tasks[1].Args[0].List) != 1 || len(tasks[1].Args[1].List) != 1 {
+		t.Errorf("Expected the second chunk to hold the last pair, got %v", tasks[1].Args)
+	}
+}
+
+func TestMatrixOperations(t *testing.T) {
+	app := New()
+	app.config.MatrixBlockSize = 1
+	exprID, err := app.addExpression("matmul([[1, 2], [3, 4]], [[5, 6], [7, 8]])", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	if len(app.taskQueue) != 4 {
+		t.Fatalf("Expected 4 independent block tasks, got %d", len(app.taskQueue))
+	}
+	for i := 0; i < 4; i++ {
+		block := fetchTask(t, app)
+		a, b := block.Args[0].List, block.Args[1].List
+		if len(a) != 1 || len(b) != 2 || len(b[0].List) != 1 {
+			t.Fatalf("Expected a row of A and a column of B, got %v", block.Args)
+		}
+		var sum float64
+		for k := range b {
+			x, _ := strconv.ParseFloat(argText(a[0].List[k]), 64)
+			y, _ := strconv.ParseFloat(argText(b[k].List[0]), 64)
+			sum += x * y
+		}
+		postResult(t, app, block, [][]float64{{sum}}, http.StatusOK)
+	}
+	if expr := app.expressions[exprID]; expr.Status != StatusCompleted || string(expr.Result) != "[[19,22],[43,50]]" {
+		t.Errorf("Expected the assembled product, got %s %s", expr.Status, expr.Result)
+	}
+
+	// Транспонирование переставляет элементы без задач.
+	exprID, err = app.addExpression("transpose([[1, 2, 3], [4, 5, 6]])", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	if expr := app.expressions[exprID]; len(expr.Tasks) != 0 || string(expr.Result) != "[[1,4],[2,5],[3,6]]" {
+		t.Errorf("Expected a folded transpose, got %d tasks and %s", len(expr.Tasks), expr.Result)
+	}
+
+	app.config.MatrixBlockSize = 32
+	exprID, err = app.addExpression("det(matmul([[1, 2], [3, 4]], [[1, 0], [0, 1]]))", nil, models.NumberModeRational)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	product := fetchTask(t, app)
+	postResult(t, app, product, [][]int{{1, 2}}, http.StatusUnprocessableEntity)
+	postResult(t, app, product, [][]string{{"1", "2"}, {"3", "4"}}, http.StatusOK)
+	det := fetchTask(t, app)
+	if det.Operation != models.OperationDeterminant || argText(det.Args[0].List[1].List[0]) != "3" {
+		t.Fatalf("Expected det over the resolved product, got %s %v", det.Operation, det.Args)
+	}
+	postResult(t, app, det, "-2", http.StatusOK)
+	if expr := app.expressions[exprID]; !strings.Contains(string(expr.Result), `"exact":"-2"`) {
+		t.Errorf("Expected det -2, got %s", expr.Result)
+	}
+
+	for _, expression := range []string{"matmul([[1, 2]], [[1, 2]])", "det([[1, 2]])", "matmul([1], [[1]])", "sum([[1], [2]])", "[[1, 2], [3]]", "[[1], 2]", "[[[1]]]", "[[1]] * 2"} {
+		if _, err := app.addExpression(expression, nil, models.NumberModeFloat); err == nil {
+			t.Errorf("Expected error for %q", expression)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("Expected SyntaxError for %q, got %v", expression, err)
+		}
+	}
+}
+
+func TestParallelScheduling(t *testing.T) {
+	app := New()
+	exprID, err := app.addExpression("( 1 + 2 ) * ( 3 + 4 )", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	if len(app.taskQueue) != 2 {
+		t.Fatalf("Expected both independent tasks to be queued, got %d", len(app.taskQueue))
+	}
+
+	first := fetchTask(t, app)
+	second := fetchTask(t, app)
+	postResult(t, app, second, 7, http.StatusOK)
+	if len(app.taskQueue) != 0 {
+		t.Fatalf("Root task must wait for both operands")
+	}
+	postResult(t, app, first, 3, http.StatusOK)
+	root := fetchTask(t, app)
+	if argText(root.Args[0]) != "3" || argText(root.Args[1]) != "7" {
+		t.Errorf("Unexpected root args %v", root.Args)
+	}
+	postResult(t, app, root, 21, http.StatusOK)
+	postResult(t, app, root, 21, http.StatusBadRequest)
+
+	expr := app.expressions[exprID]
+	if expr.Status != StatusCompleted || string(expr.Result) != "21" {
+		t.Errorf("Expected completed expression with result 21, got %s %s", expr.Status, expr.Result)
+	}
+}
+
+func TestTaskLeaseExpiry(t *testing.T) {
+	app := New()
+	now := time.Now()
+	app.now = func() time.Time { return now }
+	exprID, err := app.addExpression("2 + 2", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+
+	stale := fetchTask(t, app)
+	if stale.LeaseID == "" {
+		t.Fatalf("Expected lease id in issued task")
+	}
+	w := httptest.NewRecorder()
+	app.giveTaskHandler(w, httptest.NewRequest(http.MethodGet, "/internal/task", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Leased task must not be handed out twice, got %d", w.Code)
+	}
+
+	now = now.Add(time.Duration(stale.OperationTime+app.config.TaskLeaseGraceMS+1) * time.Millisecond)
+	fresh := fetchTask(t, app)
+	if fresh.ID != stale.ID || fresh.LeaseID == stale.LeaseID {
+		t.Fatalf("Expected expired task to be requeued with a new lease")
+	}
+	postResult(t, app, stale, 4, http.StatusConflict)
+	postResult(t, app, fresh, 4, http.StatusOK)
+	if app.expressions[exprID].Status != StatusCompleted {
+		t.Errorf("Expected expression to complete with the fresh lease")
+	}
+}
+
+func TestTaskFailureFailsExpression(t *testing.T) {
+	app := New()
+	exprID, err := app.addExpression("( 1 / 0 ) + ( 2 + 3 ) * 4", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	division := fetchTask(t, app)
+	if division.Operation != models.OperationDivision {
+		t.Fatalf("Expected division task first, got %s", division.Operation)
+	}
+	addition := fetchTask(t, app)
+
+	body, _ := json.Marshal(models.TaskResultRequest{
+		ID:      division.ID,
+		LeaseID: division.LeaseID,
+		Error:   &models.TaskError{Code: "division_by_zero", Message: "division by zero"},
+	})
+	w := httptest.NewRecorder()
+	app.giveTaskHandler(w, httptest.NewRequest(http.MethodPost, "/internal/task", bytes.NewBuffer(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected failure report to be accepted, got %d", w.Code)
+	}
+	postResult(t, app, addition, 5, http.StatusConflict)
+	if len(app.taskQueue) != 0 || len(app.leased) != 0 {
+		t.Errorf("Expected remaining tasks to be dropped")
+	}
+
+	w = httptest.NewRecorder()
+	app.ExpressionHandler(w, httptest.NewRequest(http.MethodGet, "/api/v1/expressions/"+exprID, nil))
+	var resp struct {
+		Expression struct {
+			Status ExpressionStatus  `json:"status"`
+			Error  *models.TaskError `json:"error"`
+		} `json:"expression"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode expression: %v", err)
+	}
+	if resp.Expression.Status != StatusFailed || resp.Expression.Error == nil || resp.Expression.Error.Code != "division_by_zero" {
+		t.Errorf("Expected failed expression with reason, got %+v", resp.Expression)
+	}
+}
+
+func TestDecimalPrecision(t *testing.T) {
+	app := New()
+	exprID, err := app.addExpression("1 / 3 * 3", nil, models.NumberModeDecimal)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	division := fetchTask(t, app)
+	if division.Mode != models.NumberModeDecimal {
+		t.Fatalf("Expected task in decimal mode, got %q", division.Mode)
+	}
+	third := "0.33333333333333333333333333333333333333333333333333333333333333333333333333333"
+	postResult(t, app, division, third, http.StatusOK)
+	multiplication := fetchTask(t, app)
+	if argText(multiplication.Args[0]) != third {
+		t.Errorf("Expected decimal result to be passed without truncation, got %s", multiplication.Args[0].Value)
+	}
+	postResult(t, app, multiplication, "0.99999999999999999999999999999999999999999999999999999999999999999999999999999", http.StatusOK)
+	if got := string(app.expressions[exprID].Result); got != `"1"` {
+		t.Errorf("Expected result rounded to \"1\", got %s", got)
+	}
+
+	// Свёрнутое оркестратором выражение округляется так же.
+	w := postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{Expression: "1 / 3 * 3 + 0.1", Precision: models.NumberModeDecimal})
+	var created models.Response
+	json.NewDecoder(w.Body).Decode(&created)
+	if got := string(app.expressions[created.ID].Result); got != `"1.1"` {
+		t.Errorf("Expected folded result \"1.1\", got %s", got)
+	}
+
+	_, err = app.addExpression("sin(1)", nil, models.NumberModeDecimal)
+	if _, ok := err.(*SyntaxError); !ok {
+		t.Errorf("Expected sin to be rejected in decimal mode, got %v", err)
+	}
+
+	w = postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{Expression: "1", Precision: "quad"})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for unsupported precision, got %d", w.Code)
+	}
+}
+
+func TestRationalMode(t *testing.T) {
+	app := New()
+	w := postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{Expression: "1/3 + 1/6", NumberMode: models.NumberModeRational, NoOptimize: true})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created models.Response
+	json.NewDecoder(w.Body).Decode(&created)
+
+	first := fetchTask(t, app)
+	second := fetchTask(t, app)
+	if first.Mode != models.NumberModeRational || argText(first.Args[0]) != "1" || argText(first.Args[1]) != "3" {
+		t.Fatalf("Unexpected first task: %+v", first)
+	}
+	postResult(t, app, first, "1/3", http.StatusOK)
+	postResult(t, app, second, "1/6", http.StatusOK)
+	addition := fetchTask(t, app)
+	if argText(addition.Args[0]) != "1/3" || argText(addition.Args[1]) != "1/6" {
+		t.Fatalf("Expected exact fractions as arguments, got %v", addition.Args)
+	}
+	postResult(t, app, addition, "1/2", http.StatusOK)
+	if got := string(app.expressions[created.ID].Result); got != `{"exact":"1/2","approx":0.5}` {
+		t.Errorf("Unexpected rational result %s", got)
+	}
+
+	exprID, _ := app.addExpression("1 / 0", nil, models.NumberModeRational)
+	division := fetchTask(t, app)
+	body, _ := json.Marshal(models.TaskResultRequest{ID: division.ID, LeaseID: division.LeaseID, Error: &models.TaskError{Code: "division_by_zero", Message: "division by zero"}})
+	app.giveTaskHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/internal/task", bytes.NewBuffer(body)))
+	if app.expressions[exprID].Status != StatusFailed {
+		t.Errorf("Expected division by zero to fail the expression, got %s", app.expressions[exprID].Status)
+	}
+
+	if _, err := app.addExpression("sqrt(2)", nil, models.NumberModeRational); err == nil {
+		t.Error("Expected sqrt to be rejected in rational mode")
+	}
+	w = postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{Expression: "1", Precision: models.NumberModeDecimal, NumberMode: models.NumberModeRational})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for conflicting modes, got %d", w.Code)
+	}
+}
+
+// agentTask — задача в том виде, в котором её получает агент.
+type agentTask struct {
+	ID            string            `json:"id"`
+	LeaseID       string            `json:"lease_id"`
+	Args          []models.Operand  `json:"args"`
+	Operation     models.Operation  `json:"operation"`
+	OperationTime int               `json:"operation_time"`
+	Mode          models.NumberMode `json:"mode"`
+	Unit          string            `json:"unit"`
+}
+
+func TestComplexMode(t *testing.T) {
+	app := New()
+	w := postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{Expression: "(1 + 2i) * (3 - i)", NumberMode: models.NumberModeComplex})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created models.Response
+	json.NewDecoder(w.Body).Decode(&created)
+
+	addition := fetchTask(t, app)
+	if addition.Mode != models.NumberModeComplex || string(addition.Args[1].Value) != `{"re":0,"im":2}` {
+		t.Fatalf("Expected complex operands, got %s %v", addition.Mode, addition.Args)
+	}
+	postResult(t, app, addition, 3, http.StatusUnprocessableEntity)
+	postResult(t, app, addition, models.Complex{Re: 1, Im: 2}, http.StatusOK)
+	subtraction := fetchTask(t, app)
+	if string(subtraction.Args[1].Value) != `{"re":0,"im":1}` {
+		t.Fatalf("Expected i to be the imaginary unit, got %v", subtraction.Args)
+	}
+	postResult(t, app, subtraction, models.Complex{Re: 3, Im: -1}, http.StatusOK)
+	postResult(t, app, fetchTask(t, app), models.Complex{Re: 5, Im: 5}, http.StatusOK)
+	if expr := app.expressions[created.ID]; string(expr.Result) != `{"re":5,"im":5}` {
+		t.Errorf("Expected {re: 5, im: 5}, got %s", expr.Result)
+	}
+
+	exprID, err := app.addExpression("sqrt(-4)", nil, models.NumberModeComplex)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	sqrt := fetchTask(t, app)
+	if string(sqrt.Args[0].Value) != `{"re":-4,"im":0}` {
+		t.Fatalf("Expected folded -4, got %v", sqrt.Args)
+	}
+	postResult(t, app, sqrt, models.Complex{Im: 2}, http.StatusOK)
+	if expr := app.expressions[exprID]; string(expr.Result) != `{"re":0,"im":2}` {
+		t.Errorf("Expected 2i, got %s", expr.Result)
+	}
+
+	for _, tc := range []struct {
+		expression string
+		mode       models.NumberMode
+	}{
+		{"2i + 1", models.NumberModeFloat},
+		{"1 < 2i", models.NumberModeComplex},
+		{"7 % 2", models.NumberModeComplex},
+		{"max(1, 2)", models.NumberModeComplex},
+		{"let i = 1; i", models.NumberModeComplex},
+	} {
+		if _, err := app.addExpression(tc.expression, nil, tc.mode); err == nil {
+			t.Errorf("Expected error for %q in %s mode", tc.expression, tc.mode)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("Expected SyntaxError for %q, got %v", tc.expression, err)
+		}
+	}
+}
+
+func TestIntervalMode(t *testing.T) {
+	app := New()
+	w := postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{Expression: "0.1 + 0.25", NumberMode: models.NumberModeInterval})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created models.Response
+	json.NewDecoder(w.Body).Decode(&created)
+
+	addition := fetchTask(t, app)
+	if addition.Mode != models.NumberModeInterval || string(addition.Args[0].Value) != `{"lo":0.09999999999999999,"hi":0.1}` || string(addition.Args[1].Value) != `{"lo":0.25,"hi":0.25}` {
+		t.Fatalf("Expected literal enclosures, got %s %v", addition.Mode, addition.Args)
+	}
+	postResult(t, app, addition, 0.35, http.StatusUnprocessableEntity)
+	postResult(t, app, addition, models.Interval{Lo: 0.4, Hi: 0.3}, http.StatusUnprocessableEntity)
+	postResult(t, app, addition, models.Interval{Lo: 0.35, Hi: 0.35000000000000003}, http.StatusOK)
+	if expr := app.expressions[created.ID]; string(expr.Result) != `{"lo":0.35,"hi":0.35000000000000003}` {
+		t.Errorf("Expected bounds of the sum, got %s", expr.Result)
+	}
+
+	if _, err := app.addExpression("sqrt(-x)", map[string]float64{"x": -2}, models.NumberModeInterval); err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	if sqrt := fetchTask(t, app); string(sqrt.Args[0].Value) != `{"lo":2,"hi":2}` {
+		t.Fatalf("Expected a folded point interval, got %v", sqrt.Args)
+	}
+
+	for _, expression := range []string{"1 < 2", "!1", "1 && 2", "7 % 2", "sin(1)", "if(1, 2, 3)", "det([[1, 2], [3, 4]])"} {
+		if _, err := app.addExpression(expression, nil, models.NumberModeInterval); err == nil {
+			t.Errorf("Expected error for %q in interval mode", expression)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("Expected SyntaxError for %q, got %v", expression, err)
+		}
+	}
+}
+
+func TestUnits(t *testing.T) {
+	app := New()
+	w := postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{Expression: "5 km / 2 h", NumberMode: models.NumberModeRational, To: "km/h"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created models.Response
+	json.NewDecoder(w.Body).Decode(&created)
+	division := fetchTask(t, app)
+	if argText(division.Args[0]) != "5000" || argText(division.Args[1]) != "7200" || division.Unit != "m/s" {
+		t.Fatalf("Expected 5000 / 7200 in m/s, got %v in %q", division.Args, division.Unit)
+	}
+	postResult(t, app, division, "25/36", http.StatusOK)
+
+	w = httptest.NewRecorder()
+	app.ExpressionHandler(w, httptest.NewRequest(http.MethodGet, "/api/v1/expressions/"+created.ID, nil))
+	var resp struct {
+		Expression struct {
+			Result json.RawMessage `json:"result"`
+			Unit   string          `json:"unit"`
+		} `json:"expression"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if string(resp.Expression.Result) != `{"exact":"5/2","approx":2.5}` || resp.Expression.Unit != "km/h" {
+		t.Errorf("Expected 5/2 km/h, got %s %q", resp.Expression.Result, resp.Expression.Unit)
+	}
+
+	// Результат, который переполняется при переводе в единицу, завершает выражение ошибкой.
+	w = postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{Expression: "x * 2 m", Variables: map[string]float64{"x": 1}, To: "mm"})
+	json.NewDecoder(w.Body).Decode(&created)
+	multiplication := fetchTask(t, app)
+	postResult(t, app, multiplication, 1e306, http.StatusOK)
+	if expr := app.expressions[created.ID]; expr.Status != StatusFailed || expr.Error == nil || expr.Error.Code != "overflow" || expr.Result != nil {
+		t.Errorf("Expected an overflow failure, got %s %s %+v", expr.Status, expr.Result, expr.Error)
+	}
+
+	exprID, err := app.addExpression("3 m * 4 m", nil, models.NumberModeFloat)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	if expr := app.expressions[exprID]; expr.Unit != "m^2" {
+		t.Errorf("Expected m^2, got %q", expr.Unit)
+	}
+	if exprID, err = app.addExpression("2 + 3", nil, models.NumberModeFloat); err != nil || app.expressions[exprID].Unit != "" {
+		t.Errorf("Expected a dimensionless result, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		expression string
+		to         string
+	}{
+		{"2 m + 3 s", ""},
+		{"sin(2 m)", ""},
+		{"2 m ^ 0.5", ""},
+		{"3 furlong", ""},
+		{"5 km / 2 h", "kg"},
+		{"5 km / 2 h", "km/parsec"},
+	} {
+		w := postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{Expression: tc.expression, To: tc.to})
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %q to %q, got %d: %s", tc.expression, tc.to, w.Code, w.Body.String())
+		}
+	}
+}
+
+func fetchTask(t *testing.T, app *Application) agentTask {
+	t.Helper()
+	w := httptest.NewRecorder()
+	app.giveTaskHandler(w, httptest.NewRequest(http.MethodGet, "/internal/task", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected task, got status %d", w.Code)
+	}
+	var wrapper struct {
+		Task agentTask `json:"task"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&wrapper); err != nil {
+		t.Fatalf("Failed to decode task: %v", err)
+	}
+	return wrapper.Task
+}
+
+// postResult отправляет результат задачи: число в режиме float или строку в режиме decimal.
+func postResult(t *testing.T, app *Application, task agentTask, result interface{}, expectedStatus int) {
+	t.Helper()
+	raw, _ := json.Marshal(result)
+	body, _ := json.Marshal(models.TaskResultRequest{ID: task.ID, LeaseID: task.LeaseID, Result: raw})
+	w := httptest.NewRecorder()
+	app.giveTaskHandler(w, httptest.NewRequest(http.MethodPost, "/internal/task", bytes.NewBuffer(body)))
+	if w.Code != expectedStatus {
+		t.Fatalf("Expected status %d posting result, got %d: %s", expectedStatus, w.Code, w.Body.String())
+	}
+}
+
+// argText возвращает значение операнда текстом: строку без кавычек, число
+// как есть, параметр шаблона — по имени.
+func argText(arg models.Operand) string {
+	if arg.Param != "" {
+		return arg.Param
+	}
+	var text string
+	if json.Unmarshal(arg.Value, &text) == nil {
+		return text
+	}
+	return string(arg.Value)
+}
+
+func mustInfixToRPN(t *testing.T, expression string) []token {
+	t.Helper()
+	rpn, err := infixToRPN(expression)
+	if err != nil {
+		t.Fatalf("infixToRPN(%q): %v", expression, err)
+	}
+	return rpn
+}
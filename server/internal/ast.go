@@ -0,0 +1,181 @@
+package application
+
+import (
+	"fmt"
+	"strings"
+)
+
+// node — узел дерева выражения, восстановленного из RPN: токен и операнды,
+// которые он снимает со стека, в исходном порядке.
+type node struct {
+	tok  token
+	args []*node
+}
+
+// tokenArity — число операндов, которые токен RPN снимает со стека.
+func tokenArity(t token) int {
+	switch t.kind {
+	case tokenOperator:
+		return 2
+	case tokenUnary, tokenBind, tokenUnit:
+		return 1
+	case tokenFunction, tokenList:
+		return t.argc
+	}
+	return 0
+}
+
+// rpnToTree восстанавливает дерево выражения из RPN. Сценарий даёт несколько
+// деревьев: привязки let в порядке объявления (корень — tokenBind) и итоговое
+// выражение последним.
+func rpnToTree(tokens []token) ([]*node, error) {
+	var stack, statements []*node
+	for _, tok := range tokens {
+		n := tokenArity(tok)
+		if len(stack) < n {
+			return nil, fmt.Errorf("invalid expression")
+		}
+		nd := &node{tok: tok, args: append([]*node(nil), stack[len(stack)-n:]...)}
+		stack = stack[:len(stack)-n]
+		if tok.kind == tokenBind {
+			statements = append(statements, nd)
+			continue
+		}
+		stack = append(stack, nd)
+	}
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("invalid expression")
+	}
+	return append(statements, stack[0]), nil
+}
+
+// treeToRPN записывает деревья обратно в RPN.
+func treeToRPN(statements []*node) []token {
+	var out []token
+	var walk func(nd *node)
+	walk = func(nd *node) {
+		for _, arg := range nd.args {
+			walk(arg)
+		}
+		out = append(out, nd.tok)
+	}
+	for _, st := range statements {
+		walk(st)
+	}
+	return out
+}
+
+// atomPrecedence — приоритет чисел, имён, вызовов и списков: их не нужно
+// заключать в скобки.
+const atomPrecedence = 10
+
+// nodePrecedence — приоритет узла при записи в инфиксной форме;
+// отрицательное число записывается как унарный минус.
+func nodePrecedence(nd *node) int {
+	switch nd.tok.kind {
+	case tokenOperator:
+		return precedence[nd.tok.text]
+	case tokenUnary:
+		return unaryPrecedence
+	case tokenNumber:
+		if strings.HasPrefix(nd.tok.text, "-") {
+			return unaryPrecedence
+		}
+	}
+	return atomPrecedence
+}
+
+// formatInfix записывает деревья выражения в инфиксной форме с минимумом
+// скобок; запись разбирается infixToRPN обратно в то же дерево.
+func formatInfix(statements []*node) string {
+	parts := make([]string, len(statements))
+	for i, st := range statements {
+		parts[i] = st.infix()
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (nd *node) infix() string {
+	switch nd.tok.kind {
+	case tokenBind:
+		return "let " + nd.tok.text + " = " + nd.args[0].infix()
+	case tokenUnit:
+		return nd.args[0].infix() + " " + nd.tok.text
+	case tokenUnary:
+		arg := nd.args[0].infix()
+		if nd.parenthesized(0, nodePrecedence) {
+			arg = "(" + arg + ")"
+		}
+		return nd.tok.text + arg
+	case tokenOperator:
+		left, right := nd.args[0].infix(), nd.args[1].infix()
+		if nd.parenthesized(0, nodePrecedence) {
+			left = "(" + left + ")"
+		}
+		if nd.parenthesized(1, nodePrecedence) {
+			right = "(" + right + ")"
+		}
+		return left + " " + nd.tok.text + " " + right
+	case tokenFunction:
+		return nd.tok.text + "(" + joinInfix(nd.args) + ")"
+	case tokenList:
+		return "[" + joinInfix(nd.args) + "]"
+	}
+	return nd.tok.text
+}
+
+// parenthesized сообщает, нужно ли взять в скобки i-й операнд унарного
+// или бинарного оператора при записи с приоритетами prec.
+func (nd *node) parenthesized(i int, prec func(*node) int) bool {
+	pa := prec(nd.args[i])
+	if nd.tok.kind == tokenUnary {
+		// Вложенный унарный оператор берётся в скобки, чтобы "--" не склеилось.
+		return pa <= unaryPrecedence
+	}
+	p := precedence[nd.tok.text]
+	if i == 0 {
+		return pa < p || pa == p && rightAssociative[nd.tok.text]
+	}
+	// Префиксный оператор справа не требует скобок: "2 ^ -1", "3 - -x".
+	return pa != unaryPrecedence && (pa < p || pa == p && !rightAssociative[nd.tok.text])
+}
+
+func joinInfix(nodes []*node) string {
+	parts := make([]string, len(nodes))
+	for i, nd := range nodes {
+		parts[i] = nd.infix()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// astNode — узел дерева выражения в ответах API. Type — "number",
+// "variable", "operator", "unary", "function", "list", "unit", "let" или
+// "script" (сценарий из привязок и итогового выражения); Value — число,
+// имя, оператор, функция или единица.
+type astNode struct {
+	Type  string     `json:"type"`
+	Value string     `json:"value,omitempty"`
+	Args  []*astNode `json:"args,omitempty"`
+}
+
+var astTypes = map[tokenKind]string{
+	tokenNumber:   "number",
+	tokenIdent:    "variable",
+	tokenOperator: "operator",
+	tokenUnary:    "unary",
+	tokenFunction: "function",
+	tokenList:     "list",
+	tokenUnit:     "unit",
+	tokenBind:     "let",
+}
+
+func (nd *node) ast() *astNode {
+	out := &astNode{Type: astTypes[nd.tok.kind]}
+	if nd.tok.kind != tokenList {
+		out.Value = nd.tok.text
+	}
+	for _, arg := range nd.args {
+		out.Args = append(out.Args, arg.ast())
+	}
+	return out
+}
@@ -0,0 +1,230 @@
+package application
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Tuma78/server/models"
+)
+
+// DeriveHandler возвращает производную выражения по переменной в виде
+// записи и дерева. Если передана точка, производная вычисляется в ней
+// обычным образом — задачами агентов, и ответ содержит ID выражения.
+func (a *Application) DeriveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req models.DeriveRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if tokens, err := tokenize(req.Variable); err != nil || len(tokens) != 1 || tokens[0].kind != tokenIdent {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(models.Response{Error: "Invalid variable", Details: "variable must be a name"})
+		return
+	}
+	mode, err := requestMode("", req.NumberMode)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(models.Response{Error: "Unsupported precision", Details: err.Error()})
+		return
+	}
+	tokens, err := infixToRPNWith(req.Expression, a.requestScope(r))
+	if err == nil && mode == models.NumberModeComplex {
+		tokens, err = withImaginaryUnit(tokens)
+	}
+	var derivative *node
+	if err == nil {
+		derivative, err = deriveRPN(tokens, req.Variable)
+	}
+	if err != nil {
+		writeExpressionCreated(w, "", err)
+		return
+	}
+	resp := struct {
+		Derivative string   `json:"derivative"`
+		AST        *astNode `json:"ast"`
+		ID         string   `json:"id,omitempty"`
+	}{
+		Derivative: derivative.infix(),
+		AST:        derivative.ast(),
+	}
+	if req.Point != nil {
+		vars := make(map[string]float64, len(req.Variables)+1)
+		for name, value := range req.Variables {
+			vars[name] = value
+		}
+		vars[req.Variable] = *req.Point
+		expr, err := a.buildExpression(resp.Derivative, treeToRPN([]*node{derivative}), vars, mode, true)
+		if err != nil {
+			writeExpressionCreated(w, "", err)
+			return
+		}
+		a.registerExpression(expr)
+		resp.ID = expr.ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// deriveRPN дифференцирует выражение по переменной v и упрощает результат.
+// Привязки let подставляются в итоговое выражение, остальные имена
+// считаются постоянными.
+func deriveRPN(tokens []token, v string) (*node, error) {
+	statements, err := rpnToTree(tokens)
+	if err != nil {
+		return nil, err
+	}
+	d := deriver{v: v, bindings: make(map[string]*node)}
+	for _, st := range statements[:len(statements)-1] {
+		d.bindings[st.tok.text] = d.inline(st.args[0])
+	}
+	expr := d.inline(statements[len(statements)-1])
+	if expandedSize(expr, make(map[*node]int)) > maxInlinedNodes {
+		return nil, &SyntaxError{Pos: expr.tok.pos, Message: "expression is too large to differentiate"}
+	}
+	result, err := d.derive(expr)
+	if err != nil {
+		return nil, err
+	}
+	o := optimizer{lists: make(map[string]bool), symbolic: true}
+	return o.simplify(result), nil
+}
+
+// expandedSize — число узлов дерева, в котором общее поддерево привязки
+// считается при каждом использовании; счёт останавливается за maxInlinedNodes.
+func expandedSize(nd *node, sizes map[*node]int) int {
+	if n, ok := sizes[nd]; ok {
+		return n
+	}
+	n := 1
+	for _, arg := range nd.args {
+		n = min(n+expandedSize(arg, sizes), maxInlinedNodes+1)
+	}
+	sizes[nd] = n
+	return n
+}
+
+// deriver хранит переменную дифференцирования и подставленные привязки let.
+type deriver struct {
+	v        string
+	bindings map[string]*node
+}
+
+// inline заменяет имена привязок их выражениями.
+func (d *deriver) inline(nd *node) *node {
+	if nd.tok.kind == tokenIdent {
+		if bound, ok := d.bindings[nd.tok.text]; ok {
+			return bound
+		}
+	}
+	args := make([]*node, len(nd.args))
+	for i, arg := range nd.args {
+		args[i] = d.inline(arg)
+	}
+	return &node{tok: nd.tok, args: args}
+}
+
+// depends сообщает, зависит ли выражение от переменной дифференцирования.
+func (d *deriver) depends(nd *node) bool {
+	if nd.tok.kind == tokenIdent {
+		return nd.tok.text == d.v
+	}
+	for _, arg := range nd.args {
+		if d.depends(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *deriver) derive(nd *node) (*node, error) {
+	at := nd.tok
+	num := func(text string) *node { return &node{tok: token{kind: tokenNumber, text: text, pos: at.pos}} }
+	op := func(text string, a, b *node) *node {
+		return &node{tok: token{kind: tokenOperator, text: text, pos: at.pos}, args: []*node{a, b}}
+	}
+	neg := func(a *node) *node {
+		return &node{tok: token{kind: tokenUnary, text: "-", pos: at.pos}, args: []*node{a}}
+	}
+	call := func(name string, args ...*node) *node {
+		return &node{tok: token{kind: tokenFunction, text: name, pos: at.pos, argc: len(args)}, args: args}
+	}
+
+	switch {
+	case nd.tok.kind == tokenUnit:
+		return nil, &SyntaxError{Pos: at.pos, Token: at.text, Message: "units are not supported in derivatives"}
+	case nd.tok.kind == tokenList:
+		return nil, &SyntaxError{Pos: at.pos, Token: at.text, Message: "cannot differentiate a list"}
+	case !d.depends(nd):
+		return num("0"), nil
+	case nd.tok.kind == tokenIdent:
+		return num("1"), nil
+	}
+
+	args := make([]*node, len(nd.args))
+	for i, arg := range nd.args {
+		var err error
+		if args[i], err = d.derive(arg); err != nil {
+			return nil, err
+		}
+	}
+	switch nd.tok.kind {
+	case tokenUnary:
+		switch at.text {
+		case "+":
+			return args[0], nil
+		case "-":
+			return neg(args[0]), nil
+		}
+	case tokenOperator:
+		u, v := nd.args[0], nd.args[1]
+		du, dv := args[0], args[1]
+		switch at.text {
+		case "+", "-":
+			return op(at.text, du, dv), nil
+		case "*":
+			return op("+", op("*", du, v), op("*", u, dv)), nil
+		case "/":
+			return op("/", op("-", op("*", du, v), op("*", u, dv)), op("^", v, num("2"))), nil
+		case "^":
+			switch {
+			case !d.depends(v):
+				return op("*", op("*", v, op("^", u, op("-", v, num("1")))), du), nil
+			case !d.depends(u):
+				return op("*", op("*", nd, call("log", u)), dv), nil
+			}
+			// (u^v)' = u^v * (v' * log(u) + v * u' / u).
+			return op("*", nd, op("+", op("*", dv, call("log", u)), op("/", op("*", v, du), u))), nil
+		}
+	case tokenFunction:
+		u, du := nd.args[0], args[0]
+		switch at.text {
+		case "sqrt":
+			return op("/", du, op("*", num("2"), nd)), nil
+		case "abs":
+			return op("/", op("*", u, du), nd), nil
+		case "exp":
+			return op("*", nd, du), nil
+		case "log":
+			if len(nd.args) == 2 {
+				// log(u, b) = log(u) / log(b).
+				return d.derive(op("/", call("log", u), call("log", nd.args[1])))
+			}
+			return op("/", du, u), nil
+		case "sin":
+			return op("*", call("cos", u), du), nil
+		case "cos":
+			return op("*", neg(call("sin", u)), du), nil
+		case "tan":
+			return op("/", du, op("^", call("cos", u), num("2"))), nil
+		}
+		return nil, &SyntaxError{Pos: at.pos, Token: at.text, Message: "cannot differentiate function"}
+	}
+	return nil, &SyntaxError{Pos: at.pos, Token: at.text, Message: "cannot differentiate operator"}
+}
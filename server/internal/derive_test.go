@@ -0,0 +1,116 @@
+package application
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/Tuma78/server/models"
+)
+
+func TestDeriveRPN(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"x^3 + 2*x", "3 * x ^ 2 + 2"},
+		{"5", "0"},
+		{"a * x", "a"},
+		{"x * x", "x + x"},
+		{"1 / x", "-1 / x ^ 2"},
+		{"x ^ 0.5", "0.5 * x ^ -0.5"},
+		{"sin(2 * x)", "cos(2 * x) * 2"},
+		{"cos(x)", "-sin(x)"},
+		{"exp(x) - log(x)", "exp(x) - 1 / x"},
+		{"2 ^ x", "2 ^ x * log(2)"},
+		{"sqrt(x)", "1 / (2 * sqrt(x))"},
+		{"-(x ^ 2)", "-(2 * x)"},
+		{"let y = x ^ 2; y * 3", "2 * x * 3"},
+		{"x / x", "0"},
+		{"log(x, 2)", "1 / x / log(2)"},
+		{"log(x ^ 2, 10)", "2 * x / x ^ 2 / log(10)"},
+	}
+	for _, tc := range tests {
+		derivative, err := deriveRPN(mustInfixToRPN(t, tc.expression), "x")
+		if err != nil {
+			t.Errorf("For %q: unexpected error %v", tc.expression, err)
+			continue
+		}
+		got := derivative.infix()
+		if got != tc.expected {
+			t.Errorf("For %q: expected %q, got %q", tc.expression, tc.expected, got)
+		}
+		// Запись производной разбирается обратно в то же выражение.
+		if statements, err := rpnToTree(mustInfixToRPN(t, got)); err != nil || formatInfix(statements) != got {
+			t.Errorf("For %q: %q does not parse back: %v", tc.expression, got, err)
+		}
+	}
+
+	for _, expression := range []string{"max(x, 1)", "x < 1", "2 m * x", "sum([x, 1])"} {
+		if _, err := deriveRPN(mustInfixToRPN(t, expression), "x"); err == nil {
+			t.Errorf("Expected error for %q", expression)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("Expected SyntaxError for %q, got %v", expression, err)
+		}
+	}
+}
+
+func TestFormatInfix(t *testing.T) {
+	for _, expression := range []string{
+		"(1 + 2) * 3",
+		"2 ^ 3 ^ 2",
+		"(2 ^ 3) ^ 2",
+		"(-2) ^ 2",
+		"-2 ^ 2",
+		"1 - (2 - 3)",
+		"2 ^ -x * 3",
+		"-(-x)",
+		"let r = 5; max([1, r], 2) * 3 km",
+	} {
+		statements, err := rpnToTree(mustInfixToRPN(t, expression))
+		if err != nil {
+			t.Fatalf("rpnToTree(%q): %v", expression, err)
+		}
+		if got := formatInfix(statements); got != expression {
+			t.Errorf("Expected %q, got %q", expression, got)
+		}
+	}
+}
+
+func TestDeriveHandler(t *testing.T) {
+	app := New()
+	w := postJSON(app.DeriveHandler, "/api/v1/derive", map[string]interface{}{"expression": "x^3 + 2*x", "variable": "x", "point": 2})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Derivative string   `json:"derivative"`
+		AST        *astNode `json:"ast"`
+		ID         string   `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Derivative != "3 * x ^ 2 + 2" || resp.AST.Type != "operator" || resp.AST.Value != "+" || resp.AST.Args[1].Type != "number" {
+		t.Fatalf("Unexpected derivative %q with AST %+v", resp.Derivative, resp.AST)
+	}
+	exponentiation := fetchTask(t, app)
+	if exponentiation.Operation != models.OperationExponentiation || argText(exponentiation.Args[0]) != "2" {
+		t.Fatalf("Expected 2 ^ 2, got %s %v", exponentiation.Operation, exponentiation.Args)
+	}
+	postResult(t, app, exponentiation, 4, http.StatusOK)
+	postResult(t, app, fetchTask(t, app), 12, http.StatusOK)
+	postResult(t, app, fetchTask(t, app), 14, http.StatusOK)
+	if expr := app.expressions[resp.ID]; string(expr.Result) != "14" {
+		t.Errorf("Expected 14, got %s", expr.Result)
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"expression": "x +", "variable": "x"},
+		{"expression": "x", "variable": "2x"},
+		{"expression": "max(x, 1)", "variable": "x"},
+		{"expression": "x * y", "variable": "x", "point": 1},
+	} {
+		if w := postJSON(app.DeriveHandler, "/api/v1/derive", body); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %v, got %d: %s", body, w.Code, w.Body.String())
+		}
+	}
+}
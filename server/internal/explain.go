@@ -0,0 +1,194 @@
+package application
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Tuma78/server/models"
+)
+
+// explainTask — задача плана вычисления. Start — самое раннее время
+// начала в миллисекундах, если свободных агентов достаточно.
+type explainTask struct {
+	ID            string           `json:"id"`
+	Operation     models.Operation `json:"operation"`
+	Args          []models.Operand `json:"args"`
+	DependsOn     []string         `json:"depends_on,omitempty"`
+	OperationTime int              `json:"operation_time"`
+	Start         int              `json:"start"`
+	Unit          string           `json:"unit,omitempty"`
+}
+
+// ExplainHandler разбирает выражение и строит граф задач, не выполняя его,
+// и возвращает дерево выражения, RPN и план с оценкой времени. Тело запроса —
+// как у /api/v1/calculate; переменные без значений остаются параметрами.
+func (a *Application) ExplainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req models.Request
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	mode, err := requestMode(req.Precision, req.NumberMode)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(models.Response{Error: "Unsupported precision", Details: err.Error()})
+		return
+	}
+	tokens, err := infixToRPNWith(req.Expression, a.requestScope(r))
+	if err == nil && mode == models.NumberModeComplex {
+		tokens, err = withImaginaryUnit(tokens)
+	}
+	var statements []*node
+	if err == nil {
+		statements, err = rpnToTree(tokens)
+	}
+	var graph *taskGraph
+	eliminated := 0
+	if err == nil {
+		graph, eliminated, err = buildGraph(tokens, a.config, "", req.Variables, mode, !req.NoOptimize)
+	}
+	if err != nil {
+		writeExpressionCreated(w, "", err)
+		return
+	}
+
+	rpn := make([]string, len(tokens))
+	for i, tok := range tokens {
+		rpn[i] = tok.String()
+	}
+	tasks, total, critical, path := explainPlan(graph.tasks)
+	resp := struct {
+		AST             *astNode       `json:"ast"`
+		RPN             []string       `json:"rpn"`
+		Tasks           []explainTask  `json:"tasks"`
+		Root            models.Operand `json:"root"`
+		Unit            string         `json:"unit,omitempty"`
+		Unbound         []string       `json:"unbound,omitempty"`
+		EliminatedTasks int            `json:"eliminated_tasks"`
+		TotalTime       int            `json:"total_time_ms"`
+		CriticalPath    int            `json:"critical_path_ms"`
+		CriticalTasks   []string       `json:"critical_path"`
+	}{
+		AST:             scriptAST(statements),
+		RPN:             rpn,
+		Tasks:           tasks,
+		Root:            graph.root,
+		Unit:            graph.unit.String(),
+		Unbound:         unboundVariables(tokens, req.Variables),
+		EliminatedTasks: eliminated,
+		TotalTime:       total,
+		CriticalPath:    critical,
+		CriticalTasks:   path,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// explainPlan оценивает время графа задач: total — суммарное время всех
+// задач, то есть время на одном агенте, critical — длина критического пути,
+// то есть время при неограниченном числе агентов, path — его задачи по
+// порядку. Задачи обеих ветвей if учитываются, поэтому оценка — верхняя.
+func explainPlan(tasks []*models.Task) (out []explainTask, total, critical int, path []string) {
+	byID := make(map[string]*models.Task, len(tasks))
+	for _, task := range tasks {
+		byID[task.ID] = task
+	}
+	// У select два момента: выбор ветви, когда готово условие, — его ждут
+	// задачи ветвей, — и готовность значения, когда готова ещё и выбранная
+	// ветвь, — его ждут задачи, использующие результат if.
+	type planNode struct {
+		id     string
+		choice bool
+	}
+	finish := make(map[planNode]int, len(tasks))
+	// prev — вершина, которая завершается последней, по ней восстанавливается путь.
+	prev := make(map[planNode]planNode, len(tasks))
+	var visit func(n planNode) int
+	visit = func(n planNode) int {
+		if f, ok := finish[n]; ok {
+			return f
+		}
+		task := byID[n.id]
+		if task == nil {
+			return 0
+		}
+		var deps []planNode
+		if task.Operation == models.OperationSelect && !n.choice {
+			deps = append(deps, planNode{task.ID, true})
+			for _, arg := range task.Args[1:] {
+				if arg.Ref != "" {
+					deps = append(deps, planNode{arg.Ref, false})
+				}
+			}
+		} else {
+			for _, dep := range task.DependsOn {
+				deps = append(deps, planNode{dep, false})
+			}
+			// Задача ветви if ждёт ещё и выбора ветви.
+			for _, g := range task.Guards {
+				deps = append(deps, planNode{g.Select, true})
+			}
+		}
+		start := 0
+		for i, dep := range deps {
+			if f := visit(dep); i == 0 || f > start {
+				start, prev[n] = f, dep
+			}
+		}
+		finish[n] = start
+		if task.Operation != models.OperationSelect {
+			finish[n] += task.OperationTime
+		}
+		return finish[n]
+	}
+
+	var last planNode
+	for _, task := range tasks {
+		n := planNode{task.ID, task.Operation == models.OperationSelect}
+		visit(n)
+		start := 0
+		if p, ok := prev[n]; ok {
+			start = finish[p]
+		}
+		total += task.OperationTime
+		if f := visit(planNode{task.ID, false}); last.id == "" || f > critical {
+			critical, last = f, planNode{task.ID, false}
+		}
+		out = append(out, explainTask{
+			ID:            task.ID,
+			Operation:     task.Operation,
+			Args:          task.Args,
+			DependsOn:     task.DependsOn,
+			OperationTime: task.OperationTime,
+			Start:         start,
+			Unit:          task.Unit,
+		})
+	}
+	for n, ok := last, last.id != ""; ok; n, ok = prev[n] {
+		// Готовность значения select — не отдельный шаг: он попадает в путь
+		// один раз, в момент выбора ветви.
+		if byID[n.id].Operation != models.OperationSelect || n.choice {
+			path = append([]string{n.id}, path...)
+		}
+	}
+	return out, total, critical, path
+}
+
+// scriptAST — дерево выражения для ответа; у сценария корень "script",
+// его аргументы — привязки let и итоговое выражение.
+func scriptAST(statements []*node) *astNode {
+	if len(statements) == 1 {
+		return statements[0].ast()
+	}
+	out := &astNode{Type: "script"}
+	for _, st := range statements {
+		out.Args = append(out.Args, st.ast())
+	}
+	return out
+}
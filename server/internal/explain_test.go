@@ -0,0 +1,100 @@
+package application
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestExplainHandler(t *testing.T) {
+	app := New()
+	add, mul, cmp := app.config.TimeAdditionMS, app.config.TimeMultiplicationsMS, app.config.TimeComparisonMS
+
+	type plan struct {
+		AST     *astNode      `json:"ast"`
+		RPN     []string      `json:"rpn"`
+		Tasks   []explainTask `json:"tasks"`
+		Unbound []string      `json:"unbound"`
+		Total   int           `json:"total_time_ms"`
+		Time    int           `json:"critical_path_ms"`
+		Path    []string      `json:"critical_path"`
+	}
+	explain := func(body map[string]interface{}) plan {
+		t.Helper()
+		w := postJSON(app.ExplainHandler, "/api/v1/explain", body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %v, got %d: %s", body, w.Code, w.Body.String())
+		}
+		var p plan
+		json.NewDecoder(w.Body).Decode(&p)
+		return p
+	}
+
+	p := explain(map[string]interface{}{"expression": "(1 + 2) * (3 + 4)", "no_optimize": true})
+	if len(p.RPN) != 7 || p.RPN[6] != "*" || p.AST.Type != "operator" || p.AST.Value != "*" {
+		t.Errorf("Unexpected RPN %v or AST %+v", p.RPN, p.AST)
+	}
+	if len(p.Tasks) != 3 || p.Tasks[2].Start != add || len(p.Tasks[2].DependsOn) != 2 {
+		t.Fatalf("Unexpected tasks %+v", p.Tasks)
+	}
+	if p.Total != 2*add+mul || p.Time != add+mul {
+		t.Errorf("Expected total %d and critical path %d, got %d and %d", 2*add+mul, add+mul, p.Total, p.Time)
+	}
+	if len(p.Path) != 2 || p.Path[1] != p.Tasks[2].ID {
+		t.Errorf("Unexpected critical path %v", p.Path)
+	}
+	if len(app.taskQueue) != 0 || len(app.expressions) != 0 {
+		t.Errorf("Explain must not enqueue tasks or register expressions")
+	}
+
+	p = explain(map[string]interface{}{"expression": "let r = x + 1; r * 2 + 0"})
+	if p.AST.Type != "script" || len(p.AST.Args) != 2 || p.AST.Args[0].Type != "let" {
+		t.Errorf("Unexpected script AST %+v", p.AST)
+	}
+	if len(p.Tasks) != 2 || p.Tasks[0].Args[0].Param != "x" || len(p.Unbound) != 1 || p.Unbound[0] != "x" {
+		t.Errorf("Expected 2 tasks with parameter x, got %+v, unbound %v", p.Tasks, p.Unbound)
+	}
+
+	// Ветвь if начинается только после условия, даже если select стоит в
+	// плане позже задач ветви.
+	p = explain(map[string]interface{}{"expression": "if(x > 0, y * y * y, 2)"})
+	if p.Total != cmp+2*mul || p.Time != cmp+2*mul {
+		t.Errorf("Expected total and critical path %d, got %d and %d", cmp+2*mul, p.Total, p.Time)
+	}
+	ops := make(map[string]string, len(p.Tasks))
+	for _, task := range p.Tasks {
+		ops[task.ID] = string(task.Operation)
+	}
+	var pathOps []string
+	for _, id := range p.Path {
+		pathOps = append(pathOps, ops[id])
+	}
+	if fmt.Sprint(pathOps) != "[greater select multiplication multiplication]" {
+		t.Errorf("Expected critical path through the predicate and the branch, got %v", pathOps)
+	}
+	for _, task := range p.Tasks {
+		if task.Operation == "multiplication" && task.Start < cmp {
+			t.Errorf("Branch task %s starts at %d, before the predicate finishes", task.ID, task.Start)
+		}
+	}
+
+	// Элемент блока произведения матриц виден в плане вместе с позицией в блоке.
+	p = explain(map[string]interface{}{"expression": "det(matmul([[1, 2], [3, 4]], [[x, 1], [6, 1]]))"})
+	if len(p.Tasks) != 2 || p.Tasks[1].Operation != "determinant" {
+		t.Fatalf("Expected matmul and det tasks, got %+v", p.Tasks)
+	}
+	if cell := p.Tasks[1].Args[0].List[1].List[0]; cell.Ref != p.Tasks[0].ID || fmt.Sprint(cell.Index) != "[1 0]" {
+		t.Errorf("Expected a reference to cell [1 0] of %s, got %+v", p.Tasks[0].ID, cell)
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"expression": "1 +"},
+		{"expression": "det([[1, 2]])"},
+		{"expression": "1", "precision": "bogus"},
+	} {
+		if w := postJSON(app.ExplainHandler, "/api/v1/explain", body); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %v, got %d: %s", body, w.Code, w.Body.String())
+		}
+	}
+}
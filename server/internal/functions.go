@@ -0,0 +1,98 @@
+package application
+
+import "github.com/Tuma78/server/models"
+
+// builtinFunction описывает встроенную функцию: операцию, которую выполняет
+// агент, и допустимое число аргументов. maxArgs < 0 означает вариадическую функцию.
+// decimal, rational, complex и interval отмечают функции, которые агент умеет считать
+// в соответствующих режимах; в режиме float доступны все функции.
+// local отмечает функции, которые выполняет сам оркестратор. list отмечает
+// агрегаты, принимающие списки: аргументы-списки раскрываются в элементы.
+// matrix отмечает функции, принимающие матрицы.
+type builtinFunction struct {
+	operation models.Operation
+	minArgs   int
+	maxArgs   int
+	decimal   bool
+	rational  bool
+	complex   bool
+	interval  bool
+	local     bool
+	list      bool
+	matrix    bool
+}
+
+var builtinFunctions = map[string]builtinFunction{
+	"sqrt": {operation: models.OperationSqrt, minArgs: 1, maxArgs: 1, decimal: true, complex: true, interval: true},
+	"abs":  {operation: models.OperationAbs, minArgs: 1, maxArgs: 1, decimal: true, rational: true, complex: true, interval: true},
+	"min":  {operation: models.OperationMin, minArgs: 1, maxArgs: -1, decimal: true, rational: true, interval: true, list: true},
+	"max":  {operation: models.OperationMax, minArgs: 1, maxArgs: -1, decimal: true, rational: true, interval: true, list: true},
+	// log(x) — натуральный логарифм, log(x, b) — логарифм по основанию b.
+	"log": {operation: models.OperationLog, minArgs: 1, maxArgs: 2, complex: true, interval: true},
+	"exp": {operation: models.OperationExp, minArgs: 1, maxArgs: 1, complex: true, interval: true},
+	"sin": {operation: models.OperationSin, minArgs: 1, maxArgs: 1, complex: true},
+	"cos": {operation: models.OperationCos, minArgs: 1, maxArgs: 1, complex: true},
+	"tan": {operation: models.OperationTan, minArgs: 1, maxArgs: 1, complex: true},
+	// if(условие, a, b) — ленивое условие: вычисляется только выбранная ветвь.
+	"if": {operation: models.OperationSelect, minArgs: 3, maxArgs: 3, decimal: true, rational: true, complex: true, local: true},
+	// Агрегаты: sum, avg и len сворачивают списки и числа вперемешку,
+	// dot(a, b) — скалярное произведение двух списков одной длины.
+	// Время avg — время итогового деления суммы на число элементов.
+	"sum": {operation: models.OperationSum, minArgs: 1, maxArgs: -1, decimal: true, rational: true, complex: true, interval: true, list: true},
+	"avg": {minArgs: 1, maxArgs: -1, decimal: true, rational: true, complex: true, interval: true, list: true},
+	"len": {minArgs: 1, maxArgs: -1, decimal: true, rational: true, complex: true, interval: true, local: true, list: true, matrix: true},
+	"dot": {operation: models.OperationDot, minArgs: 2, maxArgs: 2, decimal: true, rational: true, complex: true, interval: true, list: true},
+	// Матрицы: matmul(a, b) считается блоками, transpose переставляет
+	// элементы без задач, det — определитель квадратной матрицы.
+	"matmul":    {operation: models.OperationMatmul, minArgs: 2, maxArgs: 2, decimal: true, rational: true, complex: true, interval: true, list: true, matrix: true},
+	"transpose": {minArgs: 1, maxArgs: 1, decimal: true, rational: true, complex: true, interval: true, local: true, list: true, matrix: true},
+	"det":       {operation: models.OperationDeterminant, minArgs: 1, maxArgs: 1, decimal: true, rational: true, complex: true, list: true, matrix: true},
+}
+
+// unsupportedOperations — операции, не определённые в режиме вычислений:
+// комплексные числа не упорядочены, а у пересекающихся отрезков нет ни
+// порядка, ни однозначной истинности, поэтому в режиме interval недоступны
+// и логические операции.
+var unsupportedOperations = map[models.NumberMode]map[models.Operation]bool{
+	models.NumberModeComplex: {
+		models.OperationLess:            true,
+		models.OperationLessEqual:       true,
+		models.OperationGreater:         true,
+		models.OperationGreaterEqual:    true,
+		models.OperationModulo:          true,
+		models.OperationIntegerDivision: true,
+	},
+	models.NumberModeInterval: {
+		models.OperationLess:            true,
+		models.OperationLessEqual:       true,
+		models.OperationGreater:         true,
+		models.OperationGreaterEqual:    true,
+		models.OperationEqual:           true,
+		models.OperationNotEqual:        true,
+		models.OperationAnd:             true,
+		models.OperationOr:              true,
+		models.OperationNot:             true,
+		models.OperationModulo:          true,
+		models.OperationIntegerDivision: true,
+	},
+}
+
+// acceptsArgs сообщает, можно ли вызвать функцию с n аргументами.
+func (f builtinFunction) acceptsArgs(n int) bool {
+	return n >= f.minArgs && (f.maxArgs < 0 || n <= f.maxArgs)
+}
+
+// supports сообщает, доступна ли функция в режиме вычислений mode.
+func (f builtinFunction) supports(mode models.NumberMode) bool {
+	switch mode {
+	case models.NumberModeDecimal:
+		return f.decimal
+	case models.NumberModeRational:
+		return f.rational
+	case models.NumberModeComplex:
+		return f.complex
+	case models.NumberModeInterval:
+		return f.interval
+	}
+	return true
+}
@@ -0,0 +1,440 @@
+package application
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/Tuma78/server/models"
+)
+
+const (
+	// decimalDigits — число значащих цифр, до которого агент округляет каждый
+	// результат в режиме decimal.
+	decimalDigits = 50
+	// decimalResultDigits — число значащих цифр итогового результата: так
+	// ошибка округления в последних цифрах не попадает в ответ, и 1 / 3 * 3
+	// возвращается как "1".
+	decimalResultDigits = 48
+	// maxDecimalOrder — предельный десятичный порядок значений, совпадает с агентом.
+	maxDecimalOrder = 100000
+)
+
+// requestMode выбирает режим вычислений из полей precision и number_mode
+// запроса; если заданы оба, они должны совпадать.
+func requestMode(precision, numberMode models.NumberMode) (models.NumberMode, error) {
+	if precision != "" && numberMode != "" && precision != numberMode {
+		return "", fmt.Errorf("precision %q conflicts with number_mode %q", precision, numberMode)
+	}
+	if numberMode != "" {
+		return parseMode(numberMode)
+	}
+	return parseMode(precision)
+}
+
+// parseMode проверяет режим вычислений из запроса; пустой режим означает float.
+func parseMode(mode models.NumberMode) (models.NumberMode, error) {
+	switch mode {
+	case "", models.NumberModeFloat:
+		return models.NumberModeFloat, nil
+	case models.NumberModeDecimal, models.NumberModeRational, models.NumberModeComplex, models.NumberModeInterval:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unsupported number mode %q", mode)
+}
+
+// rationalResult — итоговый результат в режиме rational: точная дробь
+// и её приближение в float64.
+type rationalResult struct {
+	Exact  string  `json:"exact"`
+	Approx float64 `json:"approx"`
+}
+
+// encodeValue переводит текст числа в значение операнда: число JSON в режиме
+// float, строку в режимах decimal и rational, чтобы агент получил его без потерь,
+// объект Complex в режиме complex, где текст с суффиксом "i" — мнимое число,
+// и наименьший содержащий число отрезок Interval в режиме interval.
+func encodeValue(mode models.NumberMode, text string) (json.RawMessage, error) {
+	switch mode {
+	case models.NumberModeInterval:
+		value, ok := new(big.Rat).SetString(text)
+		if !ok {
+			return nil, fmt.Errorf("invalid number %q", text)
+		}
+		bounds, err := enclose(value)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(bounds)
+	case models.NumberModeComplex:
+		part, imaginary := strings.CutSuffix(text, "i")
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, err
+		}
+		if imaginary {
+			return json.Marshal(models.Complex{Im: value})
+		}
+		return json.Marshal(models.Complex{Re: value})
+	case models.NumberModeDecimal:
+		if _, err := parseDecimal(text); err != nil {
+			return nil, err
+		}
+		return json.Marshal(text)
+	case models.NumberModeRational:
+		if _, ok := new(big.Rat).SetString(text); !ok {
+			return nil, fmt.Errorf("invalid rational %q", text)
+		}
+		return json.Marshal(text)
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// parseDecimal читает десятичную строку режима decimal; дроби "p/q" в этом
+// режиме не допускаются.
+func parseDecimal(text string) (*big.Rat, error) {
+	value, ok := new(big.Rat).SetString(text)
+	if !ok || strings.Contains(text, "/") {
+		return nil, fmt.Errorf("invalid decimal %q", text)
+	}
+	return value, nil
+}
+
+// formatDecimal записывает десятичную дробь x без потери цифр и без лишних
+// нулей. У x знаменатель вида 2^a * 5^b, и знаков после точки — max(a, b).
+func formatDecimal(x *big.Rat) string {
+	den := new(big.Int).Set(x.Denom())
+	twos := den.TrailingZeroBits()
+	den.Rsh(den, twos)
+	fives := uint(0)
+	for five := big.NewInt(5); den.Cmp(big.NewInt(1)) > 0; fives++ {
+		den.Quo(den, five)
+	}
+	return x.FloatString(int(max(twos, fives)))
+}
+
+// roundDecimal округляет x до digits значащих цифр, половину — к чётному,
+// так же, как агент.
+func roundDecimal(x *big.Rat, digits int) *big.Rat {
+	if x.Sign() == 0 {
+		return new(big.Rat)
+	}
+	num, den := new(big.Int).Abs(x.Num()), x.Denom()
+	lo := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits-1)), nil)
+	hi := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	// k — степень десяти, после умножения на которую у |x| ровно digits цифр
+	// до точки; оценка по длине в битах ошибается не больше чем на единицу.
+	k := digits - 1 - decimalOrder(x)
+	for {
+		n, d := scaleByPow10(num, den, k)
+		q, r := new(big.Int).QuoRem(n, d, new(big.Int))
+		switch {
+		case q.Cmp(lo) < 0:
+			k++
+			continue
+		case q.Cmp(hi) >= 0:
+			k--
+			continue
+		}
+		if c := r.Lsh(r, 1).Cmp(d); c > 0 || c == 0 && q.Bit(0) == 1 {
+			q.Add(q, big.NewInt(1))
+		}
+		if x.Sign() < 0 {
+			q.Neg(q)
+		}
+		n, d = scaleByPow10(q, big.NewInt(1), -k)
+		return new(big.Rat).SetFrac(n, d)
+	}
+}
+
+// scaleByPow10 возвращает дробь n/d, равную num/den * 10^k.
+func scaleByPow10(num, den *big.Int, k int) (n, d *big.Int) {
+	p := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(max(k, -k))), nil)
+	if k >= 0 {
+		return new(big.Int).Mul(num, p), den
+	}
+	return num, new(big.Int).Mul(den, p)
+}
+
+// decimalOrder оценивает десятичный порядок x ≠ 0 с точностью до единицы.
+func decimalOrder(x *big.Rat) int {
+	return int(math.Floor(float64(x.Num().BitLen()-x.Denom().BitLen()) * math.Log10(2)))
+}
+
+// enclose возвращает наименьший отрезок из чисел float64, содержащий x:
+// точка, если x представимо точно, иначе два соседних числа.
+func enclose(x *big.Rat) (models.Interval, error) {
+	f, exact := x.Float64()
+	if math.IsInf(f, 0) {
+		return models.Interval{}, fmt.Errorf("value is out of range")
+	}
+	bounds := models.Interval{Lo: f, Hi: f}
+	if !exact {
+		if new(big.Rat).SetFloat64(f).Cmp(x) < 0 {
+			bounds.Hi = math.Nextafter(f, math.Inf(1))
+		} else {
+			bounds.Lo = math.Nextafter(f, math.Inf(-1))
+		}
+	}
+	return bounds, nil
+}
+
+// isTruthy сообщает, истинно ли значение операнда: истинно любое ненулевое число.
+func isTruthy(mode models.NumberMode, raw json.RawMessage) bool {
+	switch mode {
+	case models.NumberModeDecimal, models.NumberModeRational:
+		var text string
+		json.Unmarshal(raw, &text)
+		value, ok := new(big.Rat).SetString(text)
+		return ok && value.Sign() != 0
+	case models.NumberModeComplex:
+		var value models.Complex
+		json.Unmarshal(raw, &value)
+		return value.Re != 0 || value.Im != 0
+	case models.NumberModeInterval:
+		var value models.Interval
+		json.Unmarshal(raw, &value)
+		return value.Lo != 0 || value.Hi != 0
+	}
+	var value float64
+	json.Unmarshal(raw, &value)
+	return value != 0
+}
+
+// variableOperand подставляет значение переменной в операнд.
+func variableOperand(mode models.NumberMode, value float64) models.Operand {
+	raw, _ := encodeValue(mode, strconv.FormatFloat(value, 'f', -1, 64))
+	return models.Operand{Value: raw}
+}
+
+// negateValue меняет знак значения операнда, не теряя точности.
+func negateValue(mode models.NumberMode, raw json.RawMessage) (json.RawMessage, error) {
+	if mode == models.NumberModeDecimal || mode == models.NumberModeRational {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, err
+		}
+		if len(text) > 0 && text[0] == '-' {
+			return json.Marshal(text[1:])
+		}
+		return json.Marshal("-" + text)
+	}
+	if mode == models.NumberModeComplex {
+		var value models.Complex
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		// 0 - x, а не -x: нулевая часть не превращается в -0.
+		return json.Marshal(models.Complex{Re: 0 - value.Re, Im: 0 - value.Im})
+	}
+	if mode == models.NumberModeInterval {
+		var value models.Interval
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		return json.Marshal(models.Interval{Lo: 0 - value.Hi, Hi: 0 - value.Lo})
+	}
+	var value float64
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(-value)
+}
+
+// normalizeResult проверяет результат задачи, присланный агентом, и приводит
+// его к значению операнда зависимой задачи.
+func normalizeResult(mode models.NumberMode, raw json.RawMessage) (json.RawMessage, error) {
+	switch mode {
+	case models.NumberModeDecimal, models.NumberModeRational:
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, err
+		}
+		if mode == models.NumberModeRational {
+			value, ok := new(big.Rat).SetString(text)
+			if !ok {
+				return nil, fmt.Errorf("invalid rational %q", text)
+			}
+			text = value.RatString()
+		}
+		return encodeValue(mode, text)
+	case models.NumberModeComplex:
+		var value models.Complex
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		return json.Marshal(value)
+	case models.NumberModeInterval:
+		var value models.Interval
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		if !(value.Lo <= value.Hi) {
+			return nil, fmt.Errorf("invalid interval [%v, %v]", value.Lo, value.Hi)
+		}
+		return json.Marshal(value)
+	}
+	var value float64
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// finalResult переводит значение корня в итоговый результат выражения:
+// число JSON в режиме float, строку в режиме decimal, rationalResult
+// в режиме rational, объект {"re", "im"} в режиме complex и границы
+// {"lo", "hi"} в режиме interval.
+func finalResult(mode models.NumberMode, raw json.RawMessage) (json.RawMessage, error) {
+	switch mode {
+	case models.NumberModeDecimal:
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, err
+		}
+		value, err := parseDecimal(text)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(formatDecimal(roundDecimal(value, decimalResultDigits)))
+	case models.NumberModeRational:
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, err
+		}
+		value, ok := new(big.Rat).SetString(text)
+		if !ok {
+			return nil, fmt.Errorf("invalid rational %q", text)
+		}
+		approx, _ := value.Float64()
+		return json.Marshal(rationalResult{Exact: value.RatString(), Approx: approx})
+	}
+	return normalizeResult(mode, raw)
+}
+
+// operandResult переводит вычисленный операнд в итоговый результат: число —
+// как finalResult, список и матрица — массивами JSON из итоговых значений элементов.
+func operandResult(mode models.NumberMode, op models.Operand) (json.RawMessage, error) {
+	if !op.IsList() {
+		return finalResult(mode, op.Value)
+	}
+	items := make([]json.RawMessage, len(op.List))
+	for i, item := range op.List {
+		var err error
+		if items[i], err = operandResult(mode, item); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(items)
+}
+
+// normalizeMatrix проверяет результат задачи, который должен быть матрицей
+// rows×cols, и нормализует каждый её элемент как normalizeResult.
+func normalizeMatrix(mode models.NumberMode, raw json.RawMessage, rows, cols int) (json.RawMessage, error) {
+	var cells [][]json.RawMessage
+	if err := json.Unmarshal(raw, &cells); err != nil {
+		return nil, err
+	}
+	if len(cells) != rows {
+		return nil, fmt.Errorf("expected %d rows, got %d", rows, len(cells))
+	}
+	for _, row := range cells {
+		if len(row) != cols {
+			return nil, fmt.Errorf("expected %d columns, got %d", cols, len(row))
+		}
+		for j, cell := range row {
+			var err error
+			if row[j], err = normalizeResult(mode, cell); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return json.Marshal(cells)
+}
+
+// scaleValue умножает значение операнда на точный множитель factor, например
+// при переводе единиц измерения.
+func scaleValue(mode models.NumberMode, raw json.RawMessage, factor *big.Rat) (json.RawMessage, error) {
+	if factor.Cmp(big.NewRat(1, 1)) == 0 {
+		return raw, nil
+	}
+	switch mode {
+	case models.NumberModeDecimal:
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, err
+		}
+		value, err := parseDecimal(text)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(formatDecimal(roundDecimal(value.Mul(value, factor), decimalDigits)))
+	case models.NumberModeRational:
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, err
+		}
+		value, ok := new(big.Rat).SetString(text)
+		if !ok {
+			return nil, fmt.Errorf("invalid rational %q", text)
+		}
+		return json.Marshal(value.Mul(value, factor).RatString())
+	}
+	if mode == models.NumberModeInterval {
+		// Множитель положителен, но может не представляться точно: границы
+		// умножаются на границы его отрезка и сдвигаются наружу.
+		var value models.Interval
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		k, err := enclose(factor)
+		if err != nil {
+			return nil, err
+		}
+		lo := math.Min(value.Lo*k.Lo, value.Lo*k.Hi)
+		hi := math.Max(value.Hi*k.Lo, value.Hi*k.Hi)
+		if math.IsInf(lo, 0) || math.IsInf(hi, 0) {
+			return nil, fmt.Errorf("value is out of range")
+		}
+		return json.Marshal(models.Interval{Lo: math.Nextafter(lo, math.Inf(-1)), Hi: math.Nextafter(hi, math.Inf(1))})
+	}
+	f, _ := factor.Float64()
+	if mode == models.NumberModeComplex {
+		var value models.Complex
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		return json.Marshal(models.Complex{Re: value.Re * f, Im: value.Im * f})
+	}
+	var value float64
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	if math.IsInf(value*f, 0) {
+		return nil, fmt.Errorf("value is out of range")
+	}
+	return json.Marshal(value * f)
+}
+
+// scaleOperand применяет scaleValue к значению операнда или ко всем элементам списка.
+func scaleOperand(mode models.NumberMode, op models.Operand, factor *big.Rat) (models.Operand, error) {
+	if !op.IsList() {
+		value, err := scaleValue(mode, op.Value, factor)
+		return models.Operand{Value: value}, err
+	}
+	items := make([]models.Operand, len(op.List))
+	for i, item := range op.List {
+		var err error
+		if items[i], err = scaleOperand(mode, item, factor); err != nil {
+			return models.Operand{}, err
+		}
+	}
+	return models.Operand{List: items}, nil
+}
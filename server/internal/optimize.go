@@ -0,0 +1,419 @@
+package application
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/Tuma78/server/models"
+)
+
+// optimizeRPN упрощает выражение перед построением задач: применяет
+// тождества x + 0, x - 0, 0 - x, -(-x), x * 1, x / 1, x ^ 1, 0 * x, x ^ 0,
+// x - x, 0 / x и x / x и сворачивает операторы над числами в режимах, где
+// оркестратор считает так же, как агент. Тождества применяются только
+// к числам: оператор над списком остаётся ошибкой, а 0 * x, x ^ 0 и x - x —
+// только к числам и переменным: остальное x может завершиться ошибкой,
+// которую упрощение скрыло бы. 0 / x и x / x требуют ещё и ненулевого
+// делителя, поэтому при вычислении применяются только к литералам. Выражения
+// с единицами измерения не упрощаются, чтобы проверка размерностей видела
+// выражение целиком.
+func optimizeRPN(tokens []token, mode models.NumberMode) []token {
+	for _, tok := range tokens {
+		if tok.kind == tokenUnit {
+			return tokens
+		}
+	}
+	statements, err := rpnToTree(tokens)
+	if err != nil {
+		return tokens
+	}
+	o := optimizer{mode: mode, lists: make(map[string]bool)}
+	for i, st := range statements {
+		statements[i] = o.simplify(st)
+		if st.tok.kind == tokenBind {
+			o.lists[st.tok.text] = !o.scalar(st.args[0])
+		}
+	}
+	return treeToRPN(statements)
+}
+
+// optimizer хранит режим вычислений и привязки let, значения которых — списки.
+// В режиме symbolic числа сворачиваются точно и только тогда, когда результат
+// записывается конечной десятичной дробью: так упрощается запись производной.
+type optimizer struct {
+	mode     models.NumberMode
+	lists    map[string]bool
+	symbolic bool
+}
+
+// simplify возвращает упрощённую копию узла; исходное дерево не меняется.
+func (o *optimizer) simplify(nd *node) *node {
+	args := make([]*node, len(nd.args))
+	for i, arg := range nd.args {
+		args[i] = o.simplify(arg)
+	}
+	nd = &node{tok: nd.tok, args: args}
+	switch nd.tok.kind {
+	case tokenUnary:
+		arg := nd.args[0]
+		if nd.tok.text != "-" {
+			break
+		}
+		// Отрицание числа становится отрицательным числом, чтобы его можно было свернуть дальше.
+		if arg.tok.kind == tokenNumber {
+			text, negative := strings.CutPrefix(arg.tok.text, "-")
+			if !negative {
+				text = "-" + text
+			}
+			return o.number(nd.tok, text)
+		}
+		if arg.tok.kind == tokenUnary && arg.tok.text == "-" && o.scalar(arg.args[0]) {
+			return arg.args[0]
+		}
+	case tokenOperator:
+		a, b := nd.args[0], nd.args[1]
+		if a.tok.kind == tokenNumber && b.tok.kind == tokenNumber {
+			if text, ok := o.fold(nd.tok.text, a.tok.text, b.tok.text); ok {
+				return o.number(nd.tok, text)
+			}
+		}
+		switch nd.tok.text {
+		case "+":
+			if isLiteral(a, 0) && o.scalar(b) {
+				return b
+			}
+			if isLiteral(b, 0) && o.scalar(a) {
+				return a
+			}
+		case "-":
+			if isLiteral(b, 0) && o.scalar(a) {
+				return a
+			}
+			if isLiteral(a, 0) && o.scalar(b) {
+				return o.simplify(&node{tok: token{kind: tokenUnary, text: "-", pos: nd.tok.pos}, args: []*node{b}})
+			}
+			if sameNode(a, b) && o.infallible(a) {
+				return o.number(nd.tok, "0")
+			}
+		case "*":
+			if isLiteral(a, 1) && o.scalar(b) {
+				return b
+			}
+			if isLiteral(b, 1) && o.scalar(a) {
+				return a
+			}
+			if isLiteral(a, 0) && o.infallible(b) {
+				return a
+			}
+			if isLiteral(b, 0) && o.infallible(a) {
+				return b
+			}
+		case "/":
+			if isLiteral(b, 1) && o.scalar(a) {
+				return a
+			}
+			if isLiteral(a, 0) && o.infallible(b) && o.nonzero(b) {
+				return a
+			}
+			if sameNode(a, b) && o.infallible(a) && o.nonzero(a) {
+				return o.number(nd.tok, "1")
+			}
+			if o.symbolic {
+				if cancelled := o.cancel(nd); cancelled != nil {
+					return cancelled
+				}
+			}
+		case "^":
+			if isLiteral(b, 1) && o.scalar(a) {
+				return a
+			}
+			if isLiteral(b, 0) && o.infallible(a) {
+				return o.number(nd.tok, "1")
+			}
+		}
+	}
+	return nd
+}
+
+// fold сворачивает оператор над двумя литералами, см. foldOperator.
+func (o *optimizer) fold(op, a, b string) (string, bool) {
+	if !o.symbolic {
+		return foldOperator(o.mode, op, a, b)
+	}
+	text, ok := foldOperator(models.NumberModeRational, op, a, b)
+	if !ok {
+		return "", false
+	}
+	x, _ := new(big.Rat).SetString(text)
+	// Знаменатель конечной десятичной дроби — 2^a * 5^b, и у неё max(a, b) знаков после точки.
+	den := new(big.Int).Set(x.Denom())
+	prec := 0
+	for _, p := range []int64{2, 5} {
+		n := 0
+		for new(big.Int).Mod(den, big.NewInt(p)).Sign() == 0 {
+			den.Quo(den, big.NewInt(p))
+			n++
+		}
+		prec = max(prec, n)
+	}
+	if den.Cmp(big.NewInt(1)) != 0 {
+		return "", false
+	}
+	return x.FloatString(prec), true
+}
+
+// number — числовой литерал на месте упрощённого узла.
+func (o *optimizer) number(at token, text string) *node {
+	return &node{tok: token{kind: tokenNumber, text: text, pos: at.pos}}
+}
+
+// scalar сообщает, что значение узла — число, а не список или матрица.
+func (o *optimizer) scalar(nd *node) bool {
+	switch nd.tok.kind {
+	case tokenList:
+		return false
+	case tokenIdent:
+		return !o.lists[nd.tok.text]
+	case tokenFunction:
+		switch nd.tok.text {
+		case "matmul", "transpose":
+			return false
+		case "if":
+			return o.scalar(nd.args[1]) && o.scalar(nd.args[2])
+		}
+	}
+	return true
+}
+
+// infallible сообщает, что значение узла — число, вычисление которого не
+// может завершиться ошибкой: литерал или переменная. Аргумент функции,
+// вынесенный в привязку, вычисляется, только если его используют, поэтому
+// не подходит. Производная — формула, а не вычисление, поэтому в режиме
+// symbolic подходит любое число.
+func (o *optimizer) infallible(nd *node) bool {
+	if o.symbolic {
+		return o.scalar(nd)
+	}
+	switch nd.tok.kind {
+	case tokenNumber:
+		return true
+	case tokenIdent:
+		return !o.lists[nd.tok.text] && !isArgumentName(nd.tok.text)
+	}
+	return false
+}
+
+// nonzero сообщает, что на значение узла можно делить: при вычислении —
+// только ненулевой литерал, в режиме symbolic — любое число, как и
+// в остальных формулах производной.
+func (o *optimizer) nonzero(nd *node) bool {
+	if o.symbolic {
+		return o.scalar(nd)
+	}
+	if nd.tok.kind != tokenNumber {
+		return false
+	}
+	x, ok := new(big.Rat).SetString(strings.TrimSuffix(nd.tok.text, "i"))
+	return ok && x.Sign() != 0
+}
+
+// factor — множитель произведения base ^ power.
+type factor struct {
+	base  *node
+	power *big.Rat
+}
+
+// factors раскладывает произведение на множители; степень с числовым
+// показателем даёт множитель с этим показателем.
+func factors(nd *node) []factor {
+	if nd.tok.kind == tokenOperator && nd.tok.text == "*" {
+		return append(factors(nd.args[0]), factors(nd.args[1])...)
+	}
+	if nd.tok.kind == tokenOperator && nd.tok.text == "^" && nd.args[1].tok.kind == tokenNumber {
+		if power, ok := new(big.Rat).SetString(nd.args[1].tok.text); ok && power.Sign() > 0 {
+			return []factor{{nd.args[0], power}}
+		}
+	}
+	return []factor{{nd, big.NewRat(1, 1)}}
+}
+
+// cancel сокращает дробь nd на множители без переменных, общие для
+// числителя и знаменателя, и возвращает nil, если сокращать нечего.
+func (o *optimizer) cancel(nd *node) *node {
+	num, den := factors(nd.args[0]), factors(nd.args[1])
+	cancelled := false
+	for _, f := range num {
+		if !constant(f.base) {
+			continue
+		}
+		for _, g := range den {
+			if g.power.Sign() == 0 || !sameNode(f.base, g.base) {
+				continue
+			}
+			common := f.power
+			if g.power.Cmp(common) < 0 {
+				common = g.power
+			}
+			common = new(big.Rat).Set(common)
+			f.power.Sub(f.power, common)
+			g.power.Sub(g.power, common)
+			cancelled = true
+			break
+		}
+	}
+	if !cancelled {
+		return nil
+	}
+	product := func(fs []factor) *node {
+		var out *node
+		for _, f := range fs {
+			if f.power.Sign() == 0 {
+				continue
+			}
+			term := f.base
+			if f.power.Cmp(big.NewRat(1, 1)) != 0 {
+				term = &node{tok: token{kind: tokenOperator, text: "^", pos: nd.tok.pos}, args: []*node{f.base, o.number(nd.tok, f.power.RatString())}}
+			}
+			if out == nil {
+				out = term
+			} else {
+				out = &node{tok: token{kind: tokenOperator, text: "*", pos: nd.tok.pos}, args: []*node{out, term}}
+			}
+		}
+		if out == nil {
+			return o.number(nd.tok, "1")
+		}
+		return out
+	}
+	return o.simplify(&node{tok: nd.tok, args: []*node{product(num), product(den)}})
+}
+
+// constant сообщает, что в узле нет имён.
+func constant(nd *node) bool {
+	if nd.tok.kind == tokenIdent {
+		return false
+	}
+	for _, arg := range nd.args {
+		if !constant(arg) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameToken сообщает, что токены совпадают без учёта позиции.
+func sameToken(a, b token) bool {
+	return a.kind == b.kind && a.text == b.text && a.argc == b.argc
+}
+
+// sameNode сообщает, что деревья a и b совпадают.
+func sameNode(a, b *node) bool {
+	if !sameToken(a.tok, b.tok) || len(a.args) != len(b.args) {
+		return false
+	}
+	for i := range a.args {
+		if !sameNode(a.args[i], b.args[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isLiteral сообщает, что узел — вещественный числовой литерал со значением value.
+func isLiteral(nd *node, value int64) bool {
+	if nd.tok.kind != tokenNumber {
+		return false
+	}
+	x, ok := new(big.Rat).SetString(nd.tok.text)
+	return ok && x.Cmp(big.NewRat(value, 1)) == 0
+}
+
+// foldOperator вычисляет оператор над двумя литералами так же, как агент:
+// в float64 в режиме float, с округлением до decimalDigits цифр в режиме decimal
+// и точно в режиме rational. Деление на ноль, переполнение и режимы complex
+// и interval не сворачиваются — такие задачи выполняет агент.
+func foldOperator(mode models.NumberMode, op, a, b string) (string, bool) {
+	switch mode {
+	case models.NumberModeFloat:
+		x, errX := strconv.ParseFloat(a, 64)
+		y, errY := strconv.ParseFloat(b, 64)
+		if errX != nil || errY != nil {
+			return "", false
+		}
+		var result float64
+		switch op {
+		case "+":
+			result = x + y
+		case "-":
+			result = x - y
+		case "*":
+			result = x * y
+		case "/":
+			if y == 0 {
+				return "", false
+			}
+			result = x / y
+		case "^":
+			result = math.Pow(x, y)
+		default:
+			return "", false
+		}
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(result, 'g', -1, 64), true
+	case models.NumberModeDecimal:
+		x, errX := parseDecimal(a)
+		y, errY := parseDecimal(b)
+		if errX != nil || errY != nil {
+			return "", false
+		}
+		result := new(big.Rat)
+		switch op {
+		case "+":
+			result.Add(x, y)
+		case "-":
+			result.Sub(x, y)
+		case "*":
+			result.Mul(x, y)
+		case "/":
+			if y.Sign() == 0 {
+				return "", false
+			}
+			result.Quo(x, y)
+		default:
+			return "", false
+		}
+		// Значение вне диапазона агента остаётся задачей, и агент вернёт ошибку.
+		if result.Sign() != 0 && max(decimalOrder(result), -decimalOrder(result)) > maxDecimalOrder {
+			return "", false
+		}
+		return formatDecimal(roundDecimal(result, decimalDigits)), true
+	case models.NumberModeRational:
+		x, okX := new(big.Rat).SetString(a)
+		y, okY := new(big.Rat).SetString(b)
+		if !okX || !okY {
+			return "", false
+		}
+		result := new(big.Rat)
+		switch op {
+		case "+":
+			result.Add(x, y)
+		case "-":
+			result.Sub(x, y)
+		case "*":
+			result.Mul(x, y)
+		case "/":
+			if y.Sign() == 0 {
+				return "", false
+			}
+			result.Quo(x, y)
+		default:
+			return "", false
+		}
+		return result.RatString(), true
+	}
+	return "", false
+}
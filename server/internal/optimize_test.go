@@ -0,0 +1,113 @@
+package application
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/Tuma78/server/models"
+)
+
+func TestOptimizeRPN(t *testing.T) {
+	tests := []struct {
+		expression string
+		mode       models.NumberMode
+		expected   string
+	}{
+		{"x * 1 + 0", models.NumberModeFloat, "x"},
+		{"1 * x / 1 - 0", models.NumberModeFloat, "x"},
+		{"0 * x + y * 0", models.NumberModeFloat, "0"},
+		// 0 * x и x ^ 0 не отбрасывают x, вычисление которого может завершиться ошибкой.
+		{"0 * (1 / 0)", models.NumberModeFloat, "0 1 0 / *"},
+		{"(1 / 0) ^ 0", models.NumberModeFloat, "1 0 / 0 ^"},
+		{"sqrt(y) * 0", models.NumberModeFloat, "y sqrt/1 0 *"},
+		{"x ^ 1 + y ^ 0", models.NumberModeFloat, "x 1 +"},
+		{"x - x + y", models.NumberModeFloat, "y"},
+		{"sqrt(y) - sqrt(y)", models.NumberModeFloat, "y sqrt/1 y sqrt/1 -"},
+		// x может быть нулём, поэтому 0 / x и x / x остаются делением.
+		{"0 / x + x / x", models.NumberModeFloat, "0 x / x x / +"},
+		{"0 / 2i + 2i / 2i", models.NumberModeComplex, "1"},
+		{"2 * 3 + x", models.NumberModeFloat, "6 x +"},
+		{"-2 * (1 + 0.5)", models.NumberModeFloat, "-3"},
+		{"0.1 + 0.2", models.NumberModeFloat, "0.30000000000000004"},
+		{"2 ^ 10 / 4", models.NumberModeFloat, "256"},
+		{"1 / 3 + 1 / 6", models.NumberModeRational, "1/2"},
+		{"0.1 + 0.2", models.NumberModeDecimal, "0.3"},
+		{"1 / 3 * 3", models.NumberModeDecimal, "0.99999999999999999999999999999999999999999999999999"},
+		{"1e60000 * 1e60000", models.NumberModeDecimal, "1e60000 1e60000 *"},
+		// Деление на ноль и режимы complex и interval оставляются агенту.
+		{"1 / 0", models.NumberModeFloat, "1 0 /"},
+		{"1 + 2", models.NumberModeInterval, "1 2 +"},
+		{"x * 1", models.NumberModeComplex, "x"},
+		// Оператор над списком остаётся ошибкой, а не исчезает.
+		{"[1, 2] * 1", models.NumberModeFloat, "1 2 [2] 1 *"},
+		{"-(-[1, 2])", models.NumberModeFloat, "1 2 [2] u- u-"},
+		{"let v = [1, 2]; sum(v) * 1 + 0 * v", models.NumberModeFloat, "1 2 [2] =v v sum/1 0 v * +"},
+		{"let a = 2 * 3; a * 1", models.NumberModeFloat, "6 =a a"},
+		{"if(c, x * 1, 0)", models.NumberModeFloat, "c x 0 if/3"},
+		// Выражения с единицами не упрощаются.
+		{"2 m * 1", models.NumberModeFloat, "2 [m] 1 *"},
+	}
+	for _, tc := range tests {
+		got := rpnString(optimizeRPN(mustInfixToRPN(t, tc.expression), tc.mode))
+		if got != tc.expected {
+			t.Errorf("For %q in %s mode: expected %q, got %q", tc.expression, tc.mode, tc.expected, got)
+		}
+	}
+}
+
+func TestOptimizationEliminatesTasks(t *testing.T) {
+	app := New()
+	w := postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{Expression: "(2 + 3) * x * 1", Variables: map[string]float64{"x": 4}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created models.Response
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.EliminatedTasks != 2 {
+		t.Errorf("Expected 2 eliminated tasks, got %d", created.EliminatedTasks)
+	}
+	multiplication := fetchTask(t, app)
+	if argText(multiplication.Args[0]) != "5" || argText(multiplication.Args[1]) != "4" {
+		t.Fatalf("Expected 5 * 4, got %v", multiplication.Args)
+	}
+	postResult(t, app, multiplication, 20, http.StatusOK)
+	if expr := app.expressions[created.ID]; string(expr.Result) != "20" {
+		t.Errorf("Expected 20, got %s", expr.Result)
+	}
+
+	// Выражение, целиком свёрнутое оркестратором, завершается без задач.
+	w = postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{Expression: "2 * 3 + 1"})
+	json.NewDecoder(w.Body).Decode(&created)
+	if expr := app.expressions[created.ID]; expr.Status != StatusCompleted || string(expr.Result) != "7" {
+		t.Errorf("Expected a completed result 7, got %s %s", expr.Status, expr.Result)
+	}
+
+	w = postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{Expression: "2 * 3 + 1", NoOptimize: true})
+	created = models.Response{}
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.EliminatedTasks != 0 || len(app.expressions[created.ID].Tasks) != 2 {
+		t.Errorf("Expected every operation to be distributed, got %d tasks", len(app.expressions[created.ID].Tasks))
+	}
+
+	// Упрощение не скрывает ошибки в отброшенной части выражения.
+	app = New()
+	w = postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{Expression: "0 * (1 / 0)"})
+	created = models.Response{}
+	json.NewDecoder(w.Body).Decode(&created)
+	if expr := app.expressions[created.ID]; expr.Status == StatusCompleted {
+		t.Errorf("Expected 0 * (1 / 0) to be computed by agents, got a completed result %s", expr.Result)
+	}
+	if division := fetchTask(t, app); division.Operation != models.OperationDivision {
+		t.Errorf("Expected the division to be distributed, got %s", division.Operation)
+	}
+
+	// Граф строится только по упрощённому выражению, поэтому ошибки
+	// выражения должны сохраниться в нём.
+	for _, expression := range []string{"0 * det([[1, 2]])", "-(-[1, 2])", "[1, 2] * 1 + 0"} {
+		w = postJSON(app.CalcHandler, "/api/v1/calculate", models.Request{Expression: expression})
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %q, got %d", expression, w.Code)
+		}
+	}
+}
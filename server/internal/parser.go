@@ -0,0 +1,601 @@
+package application
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenNumber tokenKind = iota
+	tokenOperator
+	tokenUnary
+	tokenLParen
+	tokenRParen
+	tokenIdent
+	tokenComma
+	// tokenFunction — вызов функции в RPN, argc — число её аргументов.
+	tokenFunction
+	tokenAssign
+	tokenSemicolon
+	// tokenBind — привязка let в RPN: значение на вершине стека получает имя text.
+	tokenBind
+	tokenLBracket
+	tokenRBracket
+	// tokenList — литерал списка в RPN, argc — число его элементов.
+	tokenList
+	// tokenUnit — единица измерения числа в RPN, идёт сразу после него: "5 km".
+	tokenUnit
+)
+
+// token — лексема выражения. pos — смещение в символах от начала строки.
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+	argc int
+}
+
+// String возвращает запись токена в RPN: унарные операторы получают префикс "u",
+// вызовы функций — число аргументов, например "max/3", привязки — префикс "=",
+// списки — число элементов в скобках, например "[3]", единицы измерения —
+// обозначение в скобках, например "[km]".
+func (t token) String() string {
+	switch t.kind {
+	case tokenUnit:
+		return "[" + t.text + "]"
+	case tokenUnary:
+		return "u" + t.text
+	case tokenBind:
+		return "=" + t.text
+	case tokenList:
+		return fmt.Sprintf("[%d]", t.argc)
+	case tokenFunction:
+		return fmt.Sprintf("%s/%d", t.text, t.argc)
+	}
+	return t.text
+}
+
+// SyntaxError описывает ошибку разбора с позицией и токеном, на котором она произошла.
+type SyntaxError struct {
+	Pos     int
+	Token   string
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%s at position %d", e.Message, e.Pos)
+	}
+	return fmt.Sprintf("%s %q at position %d", e.Message, e.Token, e.Pos)
+}
+
+// tokenize разбивает выражение на лексемы независимо от пробелов.
+func tokenize(expr string) ([]token, error) {
+	runes := []rune(expr)
+	var tokens []token
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		if unicode.IsSpace(c) {
+			i++
+			continue
+		}
+		if !isValidChar(c) {
+			return nil, &SyntaxError{Pos: i, Token: string(c), Message: "unexpected character"}
+		}
+		switch {
+		case isDigit(c) || c == '.':
+			start := i
+			prefixed := c == '0' && i+1 < len(runes) && isBasePrefix(runes[i+1])
+			// Литерал читается целиком вместе с буквами, чтобы "12abc"
+			// было одной ошибкой, а не числом и идентификатором.
+			for i < len(runes) {
+				r := runes[i]
+				exponentSign := (r == '+' || r == '-') && !prefixed && (runes[i-1] == 'e' || runes[i-1] == 'E')
+				if !isDigit(r) && !isLetter(r) && r != '.' && !exponentSign {
+					break
+				}
+				i++
+			}
+			if !prefixed {
+				// Единица, записанная слитно с числом ("5km"), становится отдельным токеном.
+				i -= unitSuffix(string(runes[start:i]))
+			}
+			literal := string(runes[start:i])
+			text, err := parseNumberLiteral(literal)
+			if err != nil {
+				return nil, &SyntaxError{Pos: start, Token: literal, Message: err.Error()}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: text, pos: start})
+		case isLetter(c):
+			start := i
+			for i < len(runes) && (isLetter(runes[i]) || isDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[start:i]), pos: start})
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case c == '[':
+			tokens = append(tokens, token{kind: tokenLBracket, text: "[", pos: i})
+			i++
+		case c == ']':
+			tokens = append(tokens, token{kind: tokenRBracket, text: "]", pos: i})
+			i++
+		case c == '/' && i+1 < len(runes) && runes[i+1] == '/':
+			tokens = append(tokens, token{kind: tokenOperator, text: "//", pos: i})
+			i += 2
+		case i+1 < len(runes) && twoCharOperators[string(runes[i:i+2])]:
+			tokens = append(tokens, token{kind: tokenOperator, text: string(runes[i : i+2]), pos: i})
+			i += 2
+		case c == '=':
+			tokens = append(tokens, token{kind: tokenAssign, text: "=", pos: i})
+			i++
+		case c == ';':
+			tokens = append(tokens, token{kind: tokenSemicolon, text: ";", pos: i})
+			i++
+		case c == '&' || c == '|':
+			// Допустимы только в составе "&&" и "||".
+			return nil, &SyntaxError{Pos: i, Token: string(c), Message: "unexpected character"}
+		default:
+			tokens = append(tokens, token{kind: tokenOperator, text: string(c), pos: i})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// twoCharOperators — операторы сравнения и логики из двух символов.
+var twoCharOperators = map[string]bool{
+	"<=": true,
+	">=": true,
+	"==": true,
+	"!=": true,
+	"&&": true,
+	"||": true,
+}
+
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3,
+	"!=": 3,
+	"<":  4,
+	"<=": 4,
+	">":  4,
+	">=": 4,
+	"+":  5,
+	"-":  5,
+	"*":  6,
+	"/":  6,
+	"%":  6,
+	"//": 6,
+	"^":  8,
+}
+
+// unaryPrecedence — приоритет унарных "+", "-" и "!": выше умножения и деления,
+// но ниже степени, поэтому -2^2 = -(2^2).
+const unaryPrecedence = 7
+
+// rightAssociative — операторы, которые группируются справа: 2^3^2 = 2^(3^2).
+var rightAssociative = map[string]bool{
+	"^": true,
+}
+
+func tokenPrecedence(t token) int {
+	if t.kind == tokenUnary {
+		return unaryPrecedence
+	}
+	return precedence[t.text]
+}
+
+// infixToRPN переводит выражение или сценарий в обратную польскую запись.
+// Сценарий — это привязки "let имя = выражение", разделённые ";", и итоговое
+// выражение: "let r = 5; let area = 3.14159 * r ^ 2; area * 2". Значение
+// каждой привязки попадает в RPN перед токеном tokenBind с её именем.
+func infixToRPN(expr string) ([]token, error) {
+	return infixToRPNWith(expr, nil)
+}
+
+// infixToRPNWith — infixToRPN, в котором доступны функции пользователя
+// из scope; их вызовы подставляются в RPN телами функций.
+func infixToRPNWith(expr string, scope *functionScope) ([]token, error) {
+	tokens, err := parseCalls(expr, scope)
+	if err != nil {
+		return nil, err
+	}
+	return inlineFunctions(tokens, scope)
+}
+
+// parseCalls переводит выражение в RPN, оставляя вызовы функций
+// пользователя токенами tokenFunction.
+func parseCalls(expr string, scope *functionScope) ([]token, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	end := len([]rune(expr))
+	if n := len(tokens); n > 0 && tokens[n-1].kind == tokenSemicolon {
+		// Завершающая ";" после итогового выражения допустима.
+		end = tokens[n-1].pos
+		tokens = tokens[:n-1]
+	}
+	output := []token{}
+	bound := make(map[string]bool)
+	start := 0
+	for i := 0; i <= len(tokens); i++ {
+		if i < len(tokens) && tokens[i].kind != tokenSemicolon {
+			continue
+		}
+		stmt := tokens[start:i]
+		last := i == len(tokens)
+		stmtEnd := end
+		if !last {
+			stmtEnd = tokens[i].pos
+		}
+		start = i + 1
+		if !isLetStatement(stmt) {
+			if !last {
+				if len(stmt) == 0 {
+					return nil, &SyntaxError{Pos: stmtEnd, Token: ";", Message: "empty statement"}
+				}
+				return nil, &SyntaxError{Pos: stmt[0].pos, Token: stmt[0].text, Message: "expected let binding"}
+			}
+			rpn, err := statementToRPN(stmt, stmtEnd, scope)
+			if err != nil {
+				return nil, err
+			}
+			output = append(output, rpn...)
+			continue
+		}
+		name := stmt[1]
+		if last {
+			return nil, &SyntaxError{Pos: stmt[0].pos, Token: stmt[0].text, Message: "script must end with an expression"}
+		}
+		if len(stmt) < 3 || stmt[2].kind != tokenAssign {
+			return nil, &SyntaxError{Pos: name.pos, Token: name.text, Message: "expected '=' after binding name"}
+		}
+		if bound[name.text] {
+			return nil, &SyntaxError{Pos: name.pos, Token: name.text, Message: "duplicate binding"}
+		}
+		bound[name.text] = true
+		rpn, err := statementToRPN(stmt[3:], stmtEnd, scope)
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, rpn...)
+		output = append(output, token{kind: tokenBind, text: name.text, pos: name.pos})
+	}
+	return output, nil
+}
+
+func isLetStatement(stmt []token) bool {
+	return len(stmt) >= 2 && stmt[0].kind == tokenIdent && stmt[0].text == "let" && stmt[1].kind == tokenIdent
+}
+
+// statementToRPN переводит одно выражение в обратную польскую запись алгоритмом
+// сортировочной станции. "+", "-" и "!" в позиции операнда считаются унарными,
+// вызов функции попадает в RPN после своих аргументов вместе с их числом.
+// end — позиция конца выражения для сообщения о неожиданном конце,
+// scope — функции пользователя, которые можно вызывать наравне со встроенными.
+func statementToRPN(tokens []token, end int, scope *functionScope) ([]token, error) {
+	output := []token{}
+	opStack := []token{}
+	// argCounts хранит по элементу на каждую открытую скобку: число запятых
+	// для скобок вызова функции и списка и -1 для обычных скобок.
+	argCounts := []int{}
+	// expectOperand истинно в начале выражения, после "(" и после оператора.
+	expectOperand := true
+	for i, tok := range tokens {
+		switch tok.kind {
+		case tokenNumber:
+			if !expectOperand {
+				return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "unexpected number"}
+			}
+			output = append(output, tok)
+			expectOperand = false
+		case tokenAssign:
+			// "=" допустим только в привязке let.
+			return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "unexpected character"}
+		case tokenIdent:
+			if !expectOperand && tokens[i-1].kind == tokenNumber {
+				// Идентификатор сразу после числа — единица измерения этого числа.
+				if _, ok := units[tok.text]; !ok {
+					return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "unknown unit"}
+				}
+				tok.kind = tokenUnit
+				output = append(output, tok)
+				continue
+			}
+			if !expectOperand {
+				return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "unexpected identifier"}
+			}
+			if i+1 >= len(tokens) || tokens[i+1].kind != tokenLParen {
+				// Идентификатор без скобок — переменная, её значение
+				// подставляется при построении задач.
+				output = append(output, tok)
+				expectOperand = false
+				continue
+			}
+			if _, ok := builtinFunctions[tok.text]; !ok && scope.lookup(tok.text) == nil {
+				return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "unknown function"}
+			}
+			tok.kind = tokenFunction
+			opStack = append(opStack, tok)
+		case tokenLParen:
+			if !expectOperand {
+				return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "unexpected parenthesis"}
+			}
+			if len(opStack) > 0 && opStack[len(opStack)-1].kind == tokenFunction {
+				argCounts = append(argCounts, 0)
+			} else {
+				argCounts = append(argCounts, -1)
+			}
+			opStack = append(opStack, tok)
+		case tokenComma:
+			if expectOperand || len(argCounts) == 0 || argCounts[len(argCounts)-1] < 0 {
+				return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "unexpected comma"}
+			}
+			for !isOpening(opStack[len(opStack)-1]) {
+				output = append(output, opStack[len(opStack)-1])
+				opStack = opStack[:len(opStack)-1]
+			}
+			argCounts[len(argCounts)-1]++
+			expectOperand = true
+		case tokenRParen:
+			// Пустой список аргументов "f()" — единственный случай, когда ")"
+			// допустима сразу после "(".
+			emptyCall := expectOperand && i > 0 && tokens[i-1].kind == tokenLParen &&
+				len(argCounts) > 0 && argCounts[len(argCounts)-1] == 0
+			if expectOperand && !emptyCall {
+				return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "unexpected parenthesis"}
+			}
+			for len(opStack) > 0 && !isOpening(opStack[len(opStack)-1]) {
+				output = append(output, opStack[len(opStack)-1])
+				opStack = opStack[:len(opStack)-1]
+			}
+			if len(opStack) == 0 || opStack[len(opStack)-1].kind != tokenLParen {
+				return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "unmatched closing parenthesis"}
+			}
+			opStack = opStack[:len(opStack)-1]
+			commas := argCounts[len(argCounts)-1]
+			argCounts = argCounts[:len(argCounts)-1]
+			if commas >= 0 {
+				fn := opStack[len(opStack)-1]
+				opStack = opStack[:len(opStack)-1]
+				fn.argc = commas + 1
+				if emptyCall {
+					fn.argc = 0
+				}
+				if !scope.acceptsArgs(fn) {
+					return nil, &SyntaxError{Pos: fn.pos, Token: fn.text, Message: fmt.Sprintf("wrong number of arguments (%d)", fn.argc)}
+				}
+				output = append(output, fn)
+			}
+			expectOperand = false
+		case tokenLBracket:
+			if !expectOperand {
+				return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "unexpected bracket"}
+			}
+			argCounts = append(argCounts, 0)
+			opStack = append(opStack, tok)
+		case tokenRBracket:
+			if expectOperand {
+				if i > 0 && tokens[i-1].kind == tokenLBracket {
+					return nil, &SyntaxError{Pos: tokens[i-1].pos, Message: "empty list"}
+				}
+				return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "unexpected bracket"}
+			}
+			for len(opStack) > 0 && !isOpening(opStack[len(opStack)-1]) {
+				output = append(output, opStack[len(opStack)-1])
+				opStack = opStack[:len(opStack)-1]
+			}
+			if len(opStack) == 0 || opStack[len(opStack)-1].kind != tokenLBracket {
+				return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "unmatched closing bracket"}
+			}
+			open := opStack[len(opStack)-1]
+			opStack = opStack[:len(opStack)-1]
+			output = append(output, token{kind: tokenList, text: "[", pos: open.pos, argc: argCounts[len(argCounts)-1] + 1})
+			argCounts = argCounts[:len(argCounts)-1]
+			expectOperand = false
+		case tokenOperator:
+			if expectOperand {
+				if tok.text != "+" && tok.text != "-" && tok.text != "!" {
+					return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "unexpected operator"}
+				}
+				// Префиксный оператор не выталкивает из стека ничего.
+				tok.kind = tokenUnary
+				opStack = append(opStack, tok)
+				continue
+			}
+			if _, ok := precedence[tok.text]; !ok {
+				return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "unexpected operator"}
+			}
+			for len(opStack) > 0 {
+				top := opStack[len(opStack)-1]
+				if isOpening(top) || tokenPrecedence(top) < tokenPrecedence(tok) {
+					break
+				}
+				if rightAssociative[tok.text] && tokenPrecedence(top) == tokenPrecedence(tok) {
+					break
+				}
+				output = append(output, top)
+				opStack = opStack[:len(opStack)-1]
+			}
+			opStack = append(opStack, tok)
+			expectOperand = true
+		}
+	}
+	if expectOperand {
+		return nil, &SyntaxError{Pos: end, Message: "unexpected end of expression"}
+	}
+	for len(opStack) > 0 {
+		top := opStack[len(opStack)-1]
+		if top.kind == tokenLParen {
+			return nil, &SyntaxError{Pos: top.pos, Token: top.text, Message: "unclosed parenthesis"}
+		}
+		if top.kind == tokenLBracket {
+			return nil, &SyntaxError{Pos: top.pos, Token: top.text, Message: "unclosed bracket"}
+		}
+		output = append(output, top)
+		opStack = opStack[:len(opStack)-1]
+	}
+	return output, nil
+}
+
+// parseNumberLiteral проверяет числовой литерал и возвращает его десятичную
+// запись без разделителей. Грамматика литерала:
+//
+//	number  = decimal [ "i" ] | "0x" digits16 | "0b" digits2 | "0o" digits8
+//	decimal = ( digits [ "." [ digits ] ] | "." digits ) [ ( "e" | "E" ) [ "+" | "-" ] digits ]
+//	digits  = digit { [ "_" ] digit }
+//
+// Литералы с префиксом — целые числа произвольной длины, "_" допускается
+// только между цифрами. Суффикс "i" обозначает мнимое число и сохраняется в записи.
+func parseNumberLiteral(literal string) (string, error) {
+	if len(literal) >= 2 && literal[0] == '0' && isBasePrefix(rune(literal[1])) {
+		base := numberBases[unicode.ToLower(rune(literal[1]))]
+		digits := literal[2:]
+		if digits == "" {
+			return "", fmt.Errorf("missing digits after base prefix")
+		}
+		if err := checkDigits(digits, base); err != nil {
+			return "", err
+		}
+		value, _ := new(big.Int).SetString(strings.ReplaceAll(digits, "_", ""), base)
+		return value.String(), nil
+	}
+
+	body, imaginary := strings.CutSuffix(literal, "i")
+	mantissa, exponent, hasExponent := strings.Cut(strings.ReplaceAll(body, "E", "e"), "e")
+	whole, fraction, hasPoint := strings.Cut(mantissa, ".")
+	if whole == "" && fraction == "" {
+		return "", fmt.Errorf("malformed number")
+	}
+	if whole != "" {
+		if err := checkDigits(whole, 10); err != nil {
+			return "", err
+		}
+	}
+	if hasPoint && fraction != "" {
+		if err := checkDigits(fraction, 10); err != nil {
+			return "", err
+		}
+	}
+	if hasExponent {
+		digits := strings.TrimLeft(exponent, "+-")
+		if digits == "" {
+			return "", fmt.Errorf("missing exponent digits")
+		}
+		if err := checkDigits(digits, 10); err != nil {
+			return "", err
+		}
+	}
+	text := strings.ReplaceAll(body, "_", "")
+	if imaginary {
+		text += "i"
+	}
+	return text, nil
+}
+
+// unitSuffix возвращает длину единицы измерения в конце литерала, если
+// литерал без неё — корректное число, и 0 в остальных случаях.
+func unitSuffix(literal string) int {
+	letters := len(literal) - len(strings.TrimRightFunc(literal, isLetter))
+	for n := letters; n > 0; n-- {
+		if _, ok := units[literal[len(literal)-n:]]; !ok {
+			continue
+		}
+		if _, err := parseNumberLiteral(literal[:len(literal)-n]); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+// numberBases сопоставляет буквы префиксов "0x", "0b" и "0o" с основаниями.
+var numberBases = map[rune]int{'x': 16, 'b': 2, 'o': 8}
+
+func isBasePrefix(c rune) bool {
+	_, ok := numberBases[unicode.ToLower(c)]
+	return ok
+}
+
+// checkDigits проверяет, что digits состоит из цифр основания base,
+// разделённых одиночными "_".
+func checkDigits(digits string, base int) error {
+	if strings.HasPrefix(digits, "_") || strings.HasSuffix(digits, "_") || strings.Contains(digits, "__") {
+		return fmt.Errorf("digit separator must be between digits")
+	}
+	for _, c := range digits {
+		if c == '_' {
+			continue
+		}
+		if d, err := strconv.ParseInt(string(c), 36, 64); err != nil || int(d) >= base {
+			if c == '.' {
+				return fmt.Errorf("unexpected '.' in number")
+			}
+			return fmt.Errorf("invalid digit %q in base %d literal", c, base)
+		}
+	}
+	return nil
+}
+
+func isValidExpression(expression string) bool {
+	_, err := infixToRPN(expression)
+	return err == nil
+}
+
+// withImaginaryUnit заменяет для режима complex имя i мнимой единицей 1i.
+// Привязать имя i через let в этом режиме нельзя.
+func withImaginaryUnit(tokens []token) ([]token, error) {
+	out := make([]token, len(tokens))
+	for j, t := range tokens {
+		switch {
+		case t.kind == tokenIdent && t.text == "i":
+			t = token{kind: tokenNumber, text: "1i", pos: t.pos}
+		case t.kind == tokenBind && t.text == "i":
+			return nil, &SyntaxError{Pos: t.pos, Token: t.text, Message: "name is reserved for the imaginary unit"}
+		}
+		out[j] = t
+	}
+	return out, nil
+}
+
+// isOpening сообщает, открывает ли токен скобку или список.
+func isOpening(t token) bool {
+	return t.kind == tokenLParen || t.kind == tokenLBracket
+}
+
+func isValidChar(char rune) bool {
+	return isDigit(char) ||
+		char == '+' || char == '-' ||
+		char == '*' || char == '/' ||
+		char == '^' || char == '%' ||
+		char == '<' || char == '>' ||
+		char == '=' || char == '!' ||
+		char == '&' || char == '|' ||
+		char == '(' || char == ')' ||
+		char == '[' || char == ']' ||
+		char == '.' || char == ' ' ||
+		char == ',' || char == ';' ||
+		isLetter(char)
+}
+
+func isLetter(char rune) bool {
+	return (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || char == '_'
+}
+
+func isDigit(char rune) bool {
+	return char >= '0' && char <= '9'
+}
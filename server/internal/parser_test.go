@@ -0,0 +1,222 @@
+package application
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens, err := tokenize("12.5*(3-  .5)")
+	if err != nil {
+		t.Fatalf("tokenize: %v", err)
+	}
+	expected := []token{
+		{tokenNumber, "12.5", 0, 0},
+		{tokenOperator, "*", 4, 0},
+		{tokenLParen, "(", 5, 0},
+		{tokenNumber, "3", 6, 0},
+		{tokenOperator, "-", 7, 0},
+		{tokenNumber, ".5", 10, 0},
+		{tokenRParen, ")", 12, 0},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %d: %v", len(expected), len(tokens), tokens)
+	}
+	for i := range expected {
+		if tokens[i] != expected[i] {
+			t.Errorf("Token %d: expected %+v, got %+v", i, expected[i], tokens[i])
+		}
+	}
+}
+
+func TestInfixToRPNUnary(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"- 5 + 3", "5 u- 3 +"},
+		{"2 * - 3", "2 3 u- *"},
+		{"- ( 1 + 2 )", "1 2 + u-"},
+		{"- 2 * 3", "2 u- 3 *"},
+		{"+ 4 - - 1", "4 u+ 1 u- -"},
+		{"-2^2", "2 2 ^ u-"},
+		{"2^-1", "2 1 u- ^"},
+	}
+	for _, tc := range tests {
+		rpn, err := infixToRPN(tc.expression)
+		if err != nil {
+			t.Errorf("For expression %q: unexpected error %v", tc.expression, err)
+			continue
+		}
+		if got := rpnString(rpn); got != tc.expected {
+			t.Errorf("For expression %q: expected %q, got %q", tc.expression, tc.expected, got)
+		}
+	}
+
+	for _, expression := range []string{"2 + * 3", "2 -", "( )", "2 ( 3 )"} {
+		if _, err := infixToRPN(expression); err == nil {
+			t.Errorf("Expected error for expression %q", expression)
+		}
+	}
+}
+
+func TestInfixToRPNPrecedence(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"2^3^2", "2 3 2 ^ ^"},
+		{"2*3^2", "2 3 2 ^ *"},
+		{"7 % 3 * 2", "7 3 % 2 *"},
+		{"7 // 2 + 1", "7 2 // 1 +"},
+		{"8 / 2 // 3", "8 2 / 3 //"},
+		{"sqrt(16) + max(3, 7, 2)", "16 sqrt/1 3 7 2 max/3 +"},
+		{"max(1 + 2, abs(-3)) * 2", "1 2 + 3 u- abs/1 max/2 2 *"},
+		{"-log(8, 2)^2", "8 2 log/2 2 ^ u-"},
+		{"price * (1 + tax)", "price 1 tax + *"},
+		{"x >= 10 && y < 5", "x 10 >= y 5 < &&"},
+		{"a || b && !c", "a b c u! && ||"},
+		{"1 + 2 == 3", "1 2 + 3 =="},
+		{"a != b == c", "a b != c =="},
+		{"if(a > b, a - b, 0)", "a b > a b - 0 if/3"},
+		{"let r = 5; let area = 3.14159 * r ^ 2; area * 2", "5 =r 3.14159 r 2 ^ * =area area 2 *"},
+		{"let x = 1; x;", "1 =x x"},
+		{"sum([1, 2, 3]) / len([1, 2, 3])", "1 2 3 [3] sum/1 1 2 3 [3] len/1 /"},
+		{"5 km / 2 h", "5 [km] 2 [h] /"},
+		{"5km + 300m", "5 [km] 300 [m] +"},
+		{"1.5e3ms * 2", "1.5e3 [ms] 2 *"},
+		{"dot([1, 2], [a + 1, 4])", "1 2 [2] a 1 + 4 [2] dot/2"},
+	}
+	for _, tc := range tests {
+		rpn, err := infixToRPN(tc.expression)
+		if err != nil {
+			t.Errorf("For expression %q: unexpected error %v", tc.expression, err)
+			continue
+		}
+		if got := rpnString(rpn); got != tc.expected {
+			t.Errorf("For expression %q: expected %q, got %q", tc.expression, tc.expected, got)
+		}
+	}
+}
+
+func TestInfixToRPNSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		pos        int
+		token      string
+	}{
+		{"2 + 2 = 4", 6, "="},
+		{"1.2.3 + 1", 0, "1.2.3"},
+		{"2 * * 3", 4, "*"},
+		{"(1 + 2", 0, "("},
+		{"1 + 2)", 5, ")"},
+		{"2 +", 3, ""},
+		{"2 (3)", 2, "("},
+		{"foo(1)", 0, "foo"},
+		{"1 + sqrt(1, 2)", 4, "sqrt"},
+		{"max()", 0, "max"},
+		{"2 hello", 2, "hello"},
+		{"(1, 2)", 2, ","},
+		{"max(1,)", 6, ")"},
+		{"a = b", 2, "="},
+		{"a & b", 2, "&"},
+		{"2 ! 3", 2, "!"},
+		{"if(1, 2)", 0, "if"},
+		{"let x = 1", 0, "let"},
+		{"1 + 2; 3", 0, "1"},
+		{"let x = 1;; x", 10, ";"},
+		{"let x 1; x", 4, "x"},
+		{"let x = 1; let x = 2; x", 15, "x"},
+		{"let x = ; x", 8, ""},
+		{"let x = 1;", 0, "let"},
+		{";", 0, ""},
+		{"sum([])", 4, ""},
+		{"[1, 2", 0, "["},
+		{"1 + 2]", 5, "]"},
+		{"max(1, 2]", 8, "]"},
+		{"[1, 2)", 5, ")"},
+		{"2 [1]", 2, "["},
+	}
+	for _, tc := range tests {
+		_, err := infixToRPN(tc.expression)
+		syntaxErr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("For expression %q: expected SyntaxError, got %v", tc.expression, err)
+			continue
+		}
+		if syntaxErr.Pos != tc.pos || syntaxErr.Token != tc.token {
+			t.Errorf("For expression %q: expected %q at %d, got %q at %d", tc.expression, tc.token, tc.pos, syntaxErr.Token, syntaxErr.Pos)
+		}
+	}
+}
+
+func TestNumberLiterals(t *testing.T) {
+	valid := []struct {
+		literal  string
+		expected string
+	}{
+		{"42", "42"},
+		{".5", ".5"},
+		{"5.", "5."},
+		{"6.02e23", "6.02e23"},
+		{"1E-3", "1E-3"},
+		{"2.5e+2", "2.5e+2"},
+		{"1_000_000", "1000000"},
+		{"3.141_592", "3.141592"},
+		{"0xFF", "255"},
+		{"0Xff_ff", "65535"},
+		{"0b1010", "10"},
+		{"0o17", "15"},
+		{"0x1_0000_0000_0000_0000", "18446744073709551616"},
+		{"2i", "2i"},
+		{"1.5e-3i", "1.5e-3i"},
+		{"1_0i", "10i"},
+	}
+	for _, tc := range valid {
+		tokens, err := tokenize(tc.literal)
+		if err != nil || len(tokens) != 1 || tokens[0].kind != tokenNumber || tokens[0].text != tc.expected {
+			t.Errorf("For literal %q: expected number %q, got %v %v", tc.literal, tc.expected, tokens, err)
+		}
+	}
+
+	invalid := []struct {
+		expression string
+		pos        int
+		token      string
+		message    string
+	}{
+		{"1__000", 0, "1__000", "digit separator must be between digits"},
+		{"1_ + 2", 0, "1_", "digit separator must be between digits"},
+		{"2 * 1_.5", 4, "1_.5", "digit separator must be between digits"},
+		{"1e", 0, "1e", "missing exponent digits"},
+		{"1e+ 2", 0, "1e+", "missing exponent digits"},
+		{"0x", 0, "0x", "missing digits after base prefix"},
+		{"0b102", 0, "0b102", "invalid digit '2' in base 2 literal"},
+		{"0xFG", 0, "0xFG", "invalid digit 'G' in base 16 literal"},
+		{"0x1.8", 0, "0x1.8", "unexpected '.' in number"},
+		{"12abc", 0, "12abc", "invalid digit 'a' in base 10 literal"},
+		{"1.2.3", 0, "1.2.3", "unexpected '.' in number"},
+		{"0x1i", 0, "0x1i", "invalid digit 'i' in base 16 literal"},
+		{"2ii", 0, "2ii", "invalid digit 'i' in base 10 literal"},
+		{"1ei", 0, "1ei", "missing exponent digits"},
+	}
+	for _, tc := range invalid {
+		_, err := tokenize(tc.expression)
+		syntaxErr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("For expression %q: expected SyntaxError, got %v", tc.expression, err)
+			continue
+		}
+		if syntaxErr.Pos != tc.pos || syntaxErr.Token != tc.token || syntaxErr.Message != tc.message {
+			t.Errorf("For expression %q: expected %q at %d (%s), got %q at %d (%s)", tc.expression, tc.token, tc.pos, tc.message, syntaxErr.Token, syntaxErr.Pos, syntaxErr.Message)
+		}
+	}
+}
+
+func rpnString(rpn []token) string {
+	parts := make([]string, len(rpn))
+	for i, t := range rpn {
+		parts[i] = t.String()
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,315 @@
+package application
+
+import (
+	"strings"
+)
+
+// expressionFormats — форматы записи выражения для GET /api/v1/expressions/{id}?format=.
+var expressionFormats = map[string]func([]*node) string{
+	"infix":  formatInfix,
+	"latex":  formatLatex,
+	"mathml": formatMathML,
+}
+
+// renderPrecedence — приоритет узла в LaTeX и MathML. Число с порядком,
+// мнимое число и число с единицей записываются произведением, поэтому
+// в основании степени и под унарным оператором берутся в скобки.
+func renderPrecedence(nd *node) int {
+	p := nodePrecedence(nd)
+	switch nd.tok.kind {
+	case tokenUnit:
+		p = min(p, precedence["*"])
+	case tokenNumber:
+		if n := splitNumber(nd.tok.text); n.exponent != "" || n.imaginary && n.mantissa != "1" {
+			p = min(p, precedence["*"])
+		}
+	}
+	return p
+}
+
+// numberParts — части числового литерала: знак, мантисса, десятичный
+// порядок и признак мнимого числа.
+type numberParts struct {
+	negative  bool
+	mantissa  string
+	exponent  string
+	imaginary bool
+}
+
+func splitNumber(text string) numberParts {
+	var n numberParts
+	text, n.negative = strings.CutPrefix(text, "-")
+	text, n.imaginary = strings.CutSuffix(text, "i")
+	n.mantissa, n.exponent, _ = strings.Cut(strings.ToLower(text), "e")
+	n.exponent = strings.TrimPrefix(n.exponent, "+")
+	return n
+}
+
+// latexOperators — записи операторов в LaTeX, которые отличаются от исходных.
+var latexOperators = map[string]string{
+	"*":  `\cdot`,
+	"%":  `\bmod`,
+	"//": `\mathbin{//}`,
+	"==": "=",
+	"!=": `\neq`,
+	"<=": `\leq`,
+	">=": `\geq`,
+	"&&": `\land`,
+	"||": `\lor`,
+	"!":  `\lnot `,
+}
+
+// latexFunctions — функции, для которых в LaTeX есть собственные команды.
+var latexFunctions = map[string]bool{"sin": true, "cos": true, "tan": true, "log": true, "exp": true}
+
+// formatLatex записывает деревья выражения в LaTeX; скобки расставляются
+// так же, как в formatInfix, а деление и степень записываются \frac и ^{}.
+func formatLatex(statements []*node) string {
+	parts := make([]string, len(statements))
+	for i, st := range statements {
+		parts[i] = st.latex()
+	}
+	return strings.Join(parts, `;\quad `)
+}
+
+func (nd *node) latex() string {
+	paren := func(i int) string {
+		if nd.parenthesized(i, renderPrecedence) {
+			return `\left(` + nd.args[i].latex() + `\right)`
+		}
+		return nd.args[i].latex()
+	}
+	switch nd.tok.kind {
+	case tokenNumber:
+		return latexNumber(nd.tok.text)
+	case tokenIdent:
+		return latexName(nd.tok.text)
+	case tokenBind:
+		return `\mathrm{let}\ ` + latexName(nd.tok.text) + " = " + nd.args[0].latex()
+	case tokenUnit:
+		return nd.args[0].latex() + `\,\mathrm{` + nd.tok.text + "}"
+	case tokenUnary:
+		return latexOperator(nd.tok.text) + paren(0)
+	case tokenOperator:
+		switch nd.tok.text {
+		case "/":
+			return `\frac{` + nd.args[0].latex() + "}{" + nd.args[1].latex() + "}"
+		case "^":
+			return "{" + paren(0) + "}^{" + nd.args[1].latex() + "}"
+		}
+		return paren(0) + " " + latexOperator(nd.tok.text) + " " + paren(1)
+	case tokenFunction:
+		switch name := nd.tok.text; {
+		case name == "sqrt":
+			return `\sqrt{` + nd.args[0].latex() + "}"
+		case name == "abs":
+			return `\left|` + nd.args[0].latex() + `\right|`
+		case name == "log" && len(nd.args) == 2:
+			return `\log_{` + nd.args[1].latex() + `}\left(` + nd.args[0].latex() + `\right)`
+		case latexFunctions[name]:
+			return `\` + name + `\left(` + joinLatex(nd.args) + `\right)`
+		default:
+			return `\operatorname{` + latexEscape(name) + `}\left(` + joinLatex(nd.args) + `\right)`
+		}
+	case tokenList:
+		if rows := matrixRows(nd); rows != nil {
+			lines := make([]string, len(rows))
+			for i, row := range rows {
+				cells := make([]string, len(row))
+				for j, cell := range row {
+					cells[j] = cell.latex()
+				}
+				lines[i] = strings.Join(cells, " & ")
+			}
+			return `\begin{bmatrix}` + strings.Join(lines, ` \\ `) + `\end{bmatrix}`
+		}
+		return `\left[` + joinLatex(nd.args) + `\right]`
+	}
+	return latexEscape(nd.tok.text)
+}
+
+func joinLatex(nodes []*node) string {
+	parts := make([]string, len(nodes))
+	for i, nd := range nodes {
+		parts[i] = nd.latex()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func latexOperator(op string) string {
+	if out, ok := latexOperators[op]; ok {
+		return out
+	}
+	return op
+}
+
+// latexNumber записывает число с порядком как m \cdot 10^{e}, мнимую единицу — \mathrm{i}.
+func latexNumber(text string) string {
+	n := splitNumber(text)
+	var factors []string
+	if !n.imaginary || n.mantissa != "1" || n.exponent != "" {
+		factors = append(factors, n.mantissa)
+	}
+	if n.exponent != "" {
+		factors = append(factors, "10^{"+n.exponent+"}")
+	}
+	out := strings.Join(factors, ` \cdot `)
+	if n.imaginary {
+		out += `\mathrm{i}`
+	}
+	if n.negative {
+		out = "-" + out
+	}
+	return out
+}
+
+// latexName записывает однобуквенное имя как есть, длинное — \mathit{}.
+func latexName(name string) string {
+	if len([]rune(name)) == 1 {
+		return name
+	}
+	return `\mathit{` + latexEscape(name) + "}"
+}
+
+func latexEscape(text string) string {
+	return strings.ReplaceAll(text, "_", `\_`)
+}
+
+// mathmlOperators — записи операторов в MathML, которые отличаются от исходных.
+var mathmlOperators = map[string]string{
+	"-":  "−",
+	"*":  "⋅",
+	"%":  "mod",
+	"==": "=",
+	"!=": "≠",
+	"<":  "&lt;",
+	"<=": "≤",
+	">":  "&gt;",
+	">=": "≥",
+	"&&": "∧",
+	"||": "∨",
+	"!":  "¬",
+}
+
+// formatMathML записывает деревья выражения элементом <math> презентационной
+// разметки MathML; скобки расставляются так же, как в formatLatex.
+func formatMathML(statements []*node) string {
+	parts := make([]string, len(statements))
+	for i, st := range statements {
+		parts[i] = st.mathml()
+	}
+	return `<math xmlns="http://www.w3.org/1998/Math/MathML"><mrow>` +
+		strings.Join(parts, `<mo separator="true">;</mo>`) + "</mrow></math>"
+}
+
+func (nd *node) mathml() string {
+	paren := func(i int) string {
+		if nd.parenthesized(i, renderPrecedence) {
+			return "<mrow><mo>(</mo>" + nd.args[i].mathml() + "<mo>)</mo></mrow>"
+		}
+		return nd.args[i].mathml()
+	}
+	switch nd.tok.kind {
+	case tokenNumber:
+		return mathmlNumber(nd.tok.text)
+	case tokenIdent:
+		return "<mi>" + nd.tok.text + "</mi>"
+	case tokenBind:
+		return `<mrow><mi mathvariant="normal">let</mi><mspace width="0.278em"/><mi>` + nd.tok.text +
+			"</mi><mo>=</mo>" + nd.args[0].mathml() + "</mrow>"
+	case tokenUnit:
+		return "<mrow>" + nd.args[0].mathml() + `<mspace width="0.167em"/><mi mathvariant="normal">` + nd.tok.text + "</mi></mrow>"
+	case tokenUnary:
+		return "<mrow><mo>" + mathmlOperator(nd.tok.text) + "</mo>" + paren(0) + "</mrow>"
+	case tokenOperator:
+		switch nd.tok.text {
+		case "/":
+			return "<mfrac>" + nd.args[0].mathml() + nd.args[1].mathml() + "</mfrac>"
+		case "^":
+			return "<msup>" + paren(0) + nd.args[1].mathml() + "</msup>"
+		}
+		return "<mrow>" + paren(0) + "<mo>" + mathmlOperator(nd.tok.text) + "</mo>" + paren(1) + "</mrow>"
+	case tokenFunction:
+		switch name := nd.tok.text; {
+		case name == "sqrt":
+			return "<msqrt>" + nd.args[0].mathml() + "</msqrt>"
+		case name == "abs":
+			return "<mrow><mo>|</mo>" + nd.args[0].mathml() + "<mo>|</mo></mrow>"
+		case name == "log" && len(nd.args) == 2:
+			return "<mrow><msub><mi>log</mi>" + nd.args[1].mathml() + "</msub><mo>&#x2061;</mo><mrow><mo>(</mo>" +
+				nd.args[0].mathml() + "<mo>)</mo></mrow></mrow>"
+		default:
+			return "<mrow><mi>" + name + "</mi><mo>&#x2061;</mo><mrow><mo>(</mo>" + joinMathML(nd.args) + "<mo>)</mo></mrow></mrow>"
+		}
+	case tokenList:
+		if rows := matrixRows(nd); rows != nil {
+			var b strings.Builder
+			b.WriteString("<mrow><mo>[</mo><mtable>")
+			for _, row := range rows {
+				b.WriteString("<mtr>")
+				for _, cell := range row {
+					b.WriteString("<mtd>" + cell.mathml() + "</mtd>")
+				}
+				b.WriteString("</mtr>")
+			}
+			b.WriteString("</mtable><mo>]</mo></mrow>")
+			return b.String()
+		}
+		return "<mrow><mo>[</mo>" + joinMathML(nd.args) + "<mo>]</mo></mrow>"
+	}
+	return "<mi>" + nd.tok.text + "</mi>"
+}
+
+func joinMathML(nodes []*node) string {
+	parts := make([]string, len(nodes))
+	for i, nd := range nodes {
+		parts[i] = nd.mathml()
+	}
+	return strings.Join(parts, `<mo separator="true">,</mo>`)
+}
+
+func mathmlOperator(op string) string {
+	if out, ok := mathmlOperators[op]; ok {
+		return out
+	}
+	return op
+}
+
+// mathmlNumber записывает число с порядком как m ⋅ 10^e, мнимую единицу — <mi>i</mi>.
+func mathmlNumber(text string) string {
+	n := splitNumber(text)
+	var parts []string
+	if !n.imaginary || n.mantissa != "1" || n.exponent != "" {
+		parts = append(parts, "<mn>"+n.mantissa+"</mn>")
+	}
+	if n.exponent != "" {
+		exponent := "<mn>" + strings.TrimPrefix(n.exponent, "-") + "</mn>"
+		if strings.HasPrefix(n.exponent, "-") {
+			exponent = "<mrow><mo>−</mo>" + exponent + "</mrow>"
+		}
+		parts = append(parts, "<mo>⋅</mo>", "<msup><mn>10</mn>"+exponent+"</msup>")
+	}
+	if n.imaginary {
+		parts = append(parts, `<mi mathvariant="normal">i</mi>`)
+	}
+	if n.negative {
+		parts = append([]string{"<mo>−</mo>"}, parts...)
+	}
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	return "<mrow>" + strings.Join(parts, "") + "</mrow>"
+}
+
+// matrixRows возвращает строки списка, если это матрица: список списков
+// одной и той же длины.
+func matrixRows(nd *node) [][]*node {
+	rows := make([][]*node, len(nd.args))
+	for i, row := range nd.args {
+		if row.tok.kind != tokenList || len(row.args) != len(nd.args[0].args) {
+			return nil
+		}
+		rows[i] = row.args
+	}
+	return rows
+}
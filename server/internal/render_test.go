@@ -0,0 +1,89 @@
+package application
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Tuma78/server/models"
+)
+
+func TestFormatLatex(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"(1 + 2) * 3", `\left(1 + 2\right) \cdot 3`},
+		{"(a + 1) / (b - 2)", `\frac{a + 1}{b - 2}`},
+		{"(x + 1) ^ (2 * y)", `{\left(x + 1\right)}^{2 \cdot y}`},
+		{"-2 ^ 2", `-{2}^{2}`},
+		{"sqrt(abs(x)) + log(8, 2)", `\sqrt{\left|x\right|} + \log_{2}\left(8\right)`},
+		{"max(1.5e-3, rate) <= 2", `\operatorname{max}\left(1.5 \cdot 10^{-3}, \mathit{rate}\right) \leq 2`},
+		{"2e3 ^ 2", `{\left(2 \cdot 10^{3}\right)}^{2}`},
+		{"det([[1, 2], [3, 4]])", `\operatorname{det}\left(\begin{bmatrix}1 & 2 \\ 3 & 4\end{bmatrix}\right)`},
+		{"let r = 5 km; r * 2", `\mathrm{let}\ r = 5\,\mathrm{km};\quad r \cdot 2`},
+	}
+	for _, tc := range tests {
+		statements, err := rpnToTree(mustInfixToRPN(t, tc.expression))
+		if err != nil {
+			t.Fatalf("rpnToTree(%q): %v", tc.expression, err)
+		}
+		if got := formatLatex(statements); got != tc.expected {
+			t.Errorf("For %q: expected %q, got %q", tc.expression, tc.expected, got)
+		}
+	}
+}
+
+func TestFormatMathML(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"1 / (x + 1)", `<mfrac><mn>1</mn><mrow><mi>x</mi><mo>+</mo><mn>1</mn></mrow></mfrac>`},
+		{"(a - b) ^ 2", `<msup><mrow><mo>(</mo><mrow><mi>a</mi><mo>−</mo><mi>b</mi></mrow><mo>)</mo></mrow><mn>2</mn></msup>`},
+		{"x < 2e-3", `<mrow><mi>x</mi><mo>&lt;</mo><mrow><mn>2</mn><mo>⋅</mo><msup><mn>10</mn><mrow><mo>−</mo><mn>3</mn></mrow></msup></mrow></mrow>`},
+		{"sin(x)", `<mrow><mi>sin</mi><mo>&#x2061;</mo><mrow><mo>(</mo><mi>x</mi><mo>)</mo></mrow></mrow>`},
+	}
+	for _, tc := range tests {
+		statements, err := rpnToTree(mustInfixToRPN(t, tc.expression))
+		if err != nil {
+			t.Fatalf("rpnToTree(%q): %v", tc.expression, err)
+		}
+		expected := `<math xmlns="http://www.w3.org/1998/Math/MathML"><mrow>` + tc.expected + "</mrow></math>"
+		if got := formatMathML(statements); got != expected {
+			t.Errorf("For %q: expected %q, got %q", tc.expression, expected, got)
+		}
+	}
+}
+
+func TestExpressionFormats(t *testing.T) {
+	app := New()
+	exprID, err := app.addExpression("((1 + 2)) * i", nil, models.NumberModeComplex)
+	if err != nil {
+		t.Fatalf("addExpression: %v", err)
+	}
+	get := func(query string) (int, map[string]string) {
+		w := httptest.NewRecorder()
+		app.ExpressionHandler(w, httptest.NewRequest(http.MethodGet, "/api/v1/expressions/"+exprID+query, nil))
+		var resp struct {
+			Expression map[string]string `json:"expression"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp.Expression
+	}
+
+	for query, expected := range map[string]string{
+		"":              "",
+		"?format=infix": "(1 + 2) * 1i",
+		"?format=latex": `\left(1 + 2\right) \cdot \mathrm{i}`,
+	} {
+		code, out := get(query)
+		if code != http.StatusOK || out["expression"] != "((1 + 2)) * i" || out["formatted"] != expected {
+			t.Errorf("For %q: expected %q, got %d %v", query, expected, code, out)
+		}
+	}
+	if code, _ := get("?format=svg"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unsupported format, got %d", code)
+	}
+}
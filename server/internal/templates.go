@@ -0,0 +1,237 @@
+package application
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Tuma78/server/models"
+	"github.com/google/uuid"
+)
+
+// Template — разобранное и проверенное выражение с объявленными параметрами.
+// Tasks хранит форму графа задач, в которой параметры остаются операндами
+// с Param; при вычислении форма копируется и параметры подставляются.
+type Template struct {
+	ID         string            `json:"id"`
+	Expression string            `json:"expression"`
+	Params     []string          `json:"params"`
+	Precision  models.NumberMode `json:"precision"`
+	Unit       string            `json:"unit,omitempty"`
+	// EliminatedTasks — число задач, устранённых упрощением выражения.
+	EliminatedTasks int            `json:"eliminated_tasks,omitempty"`
+	Dim             dimension      `json:"-"`
+	RPN             []token        `json:"-"`
+	Source          []token        `json:"-"`
+	Tasks           []*models.Task `json:"-"`
+	Root            models.Operand `json:"-"`
+	Bindings        []binding      `json:"-"`
+}
+
+// TemplatesHandler создаёт шаблон (POST) или возвращает список шаблонов (GET).
+func (a *Application) TemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req models.TemplateRequest
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := validateParams(req.Params); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(models.Response{Error: "Template is not valid", Details: err.Error()})
+			return
+		}
+		mode, err := requestMode(req.Precision, req.NumberMode)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(models.Response{Error: "Unsupported precision", Details: err.Error()})
+			return
+		}
+		tplID, err := a.addTemplate(req.Expression, a.requestScope(r), req.Params, mode)
+		writeExpressionCreated(w, tplID, err)
+	case http.MethodGet:
+		a.mutex.Lock()
+		out := make([]*Template, 0, len(a.templates))
+		for _, tpl := range a.templates {
+			out = append(out, tpl)
+		}
+		a.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"templates": out})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// TemplateHandler возвращает шаблон по ID или вычисляет его по пути /{id}/evaluate.
+func (a *Application) TemplateHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/templates/")
+	id, evaluate := strings.CutSuffix(path, "/evaluate")
+	if id == "" || strings.Contains(id, "/") {
+		http.Error(w, "ID not provided", http.StatusBadRequest)
+		return
+	}
+	a.mutex.Lock()
+	tpl, ok := a.templates[id]
+	a.mutex.Unlock()
+	if !ok {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if !evaluate {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"template": tpl})
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req models.EvaluateRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	exprID, err := a.instantiateTemplate(tpl, req.Variables)
+	writeExpressionCreated(w, exprID, err)
+}
+
+// addTemplate разбирает выражение, проверяет, что оно использует только
+// объявленные параметры, и строит форму графа задач. Функции пользователя
+// из scope подставляются в шаблон при его создании.
+func (a *Application) addTemplate(exprStr string, scope *functionScope, params []string, mode models.NumberMode) (string, error) {
+	source, tokens, err := parseSource(exprStr, scope, mode)
+	if err != nil {
+		return "", err
+	}
+	declared := make(map[string]float64, len(params))
+	for _, p := range params {
+		declared[p] = 0
+	}
+	if undeclared := unboundVariables(tokens, declared); len(undeclared) > 0 {
+		return "", &UnboundVariablesError{Names: undeclared}
+	}
+	graph, eliminated, err := buildGraph(tokens, a.config, "", nil, mode, true)
+	if err != nil {
+		return "", err
+	}
+	tpl := &Template{
+		ID:              uuid.New().String(),
+		Expression:      exprStr,
+		Params:          params,
+		Precision:       mode,
+		Unit:            graph.unit.String(),
+		Dim:             graph.unit,
+		EliminatedTasks: eliminated,
+		RPN:             tokens,
+		Source:          source,
+		Tasks:           graph.tasks,
+		Root:            graph.root,
+		Bindings:        graph.bindings,
+	}
+	a.mutex.Lock()
+	a.templates[tpl.ID] = tpl
+	a.mutex.Unlock()
+	return tpl.ID, nil
+}
+
+// instantiateTemplate создаёт выражение из формы задач шаблона: задачи
+// получают новые ID, а параметры заменяются переданными значениями.
+func (a *Application) instantiateTemplate(tpl *Template, vars map[string]float64) (string, error) {
+	var missing []string
+	for _, p := range tpl.Params {
+		if _, ok := vars[p]; !ok {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		return "", &UnboundVariablesError{Names: missing}
+	}
+	exprID := uuid.New().String()
+	ids := make(map[string]string, len(tpl.Tasks))
+	for _, t := range tpl.Tasks {
+		ids[t.ID] = uuid.New().String()
+	}
+	tasks := make([]*models.Task, len(tpl.Tasks))
+	for i, t := range tpl.Tasks {
+		task := *t
+		task.ID = ids[t.ID]
+		task.ExpressionID = exprID
+		task.Args = make([]models.Operand, len(t.Args))
+		for j, arg := range t.Args {
+			task.Args[j] = bindParam(arg, ids, vars, tpl.Precision)
+		}
+		task.DependsOn = make([]string, len(t.DependsOn))
+		for j, dep := range t.DependsOn {
+			task.DependsOn[j] = ids[dep]
+		}
+		task.Guards = make([]models.Guard, len(t.Guards))
+		for j, g := range t.Guards {
+			task.Guards[j] = models.Guard{Select: ids[g.Select], Branch: g.Branch}
+		}
+		tasks[i] = &task
+	}
+	bindings := make([]binding, len(tpl.Bindings))
+	for i, b := range tpl.Bindings {
+		bindings[i] = binding{Name: b.Name, Operand: bindParam(b.Operand, ids, vars, tpl.Precision)}
+	}
+	expr := &Expression{
+		ID:         exprID,
+		Expression: tpl.Expression,
+		RPN:        tpl.RPN,
+		Source:     tpl.Source,
+		Status:     StatusPending,
+		Mode:       tpl.Precision,
+		Tasks:      tasks,
+		Root:       bindParam(tpl.Root, ids, vars, tpl.Precision),
+		Bindings:   bindings,
+		Dim:        tpl.Dim,
+		Unit:       tpl.Unit,
+	}
+	a.registerExpression(expr)
+	return exprID, nil
+}
+
+// bindParam переносит операнд формы в новое выражение: ссылки получают
+// новые ID задач, параметры — переданные значения, списки копируются поэлементно.
+func bindParam(arg models.Operand, ids map[string]string, vars map[string]float64, mode models.NumberMode) models.Operand {
+	switch {
+	case arg.Ref != "":
+		return models.Operand{Ref: ids[arg.Ref], Index: arg.Index}
+	case arg.Param != "":
+		return variableOperand(mode, vars[arg.Param])
+	case arg.IsList():
+		items := make([]models.Operand, len(arg.List))
+		for i, item := range arg.List {
+			items[i] = bindParam(item, ids, vars, mode)
+		}
+		return models.Operand{List: items}
+	}
+	return arg
+}
+
+// validateParams проверяет, что параметры шаблона — уникальные идентификаторы.
+func validateParams(params []string) error {
+	seen := make(map[string]bool, len(params))
+	for _, p := range params {
+		tokens, err := tokenize(p)
+		if err != nil || len(tokens) != 1 || tokens[0].kind != tokenIdent {
+			return fmt.Errorf("invalid parameter name %q", p)
+		}
+		if seen[p] {
+			return fmt.Errorf("duplicate parameter %q", p)
+		}
+		seen[p] = true
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package application
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Tuma78/server/models"
+)
+
+func TestTemplates(t *testing.T) {
+	app := New()
+
+	w := postJSON(app.TemplatesHandler, "/api/v1/templates", models.TemplateRequest{Expression: "a * (b + c)", Params: []string{"a", "b", "c"}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected template to be created, got %d: %s", w.Code, w.Body.String())
+	}
+	var created models.Response
+	json.NewDecoder(w.Body).Decode(&created)
+	tpl := app.templates[created.ID]
+	if tpl == nil || len(tpl.Tasks) != 2 {
+		t.Fatalf("Expected template with a two-task shape")
+	}
+
+	evaluate := func(vars map[string]float64) *httptest.ResponseRecorder {
+		return postJSON(app.TemplateHandler, "/api/v1/templates/"+created.ID+"/evaluate", models.EvaluateRequest{Variables: vars})
+	}
+	var ids []string
+	for _, a := range []float64{2, 5} {
+		w = evaluate(map[string]float64{"a": a, "b": 3, "c": 4})
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected expression to be created, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp models.Response
+		json.NewDecoder(w.Body).Decode(&resp)
+		ids = append(ids, resp.ID)
+	}
+	first, second := app.expressions[ids[0]], app.expressions[ids[1]]
+	if first.Tasks[0].ID == second.Tasks[0].ID || first.Tasks[0].ID == tpl.Tasks[0].ID {
+		t.Errorf("Expected instantiated tasks to get fresh IDs")
+	}
+	if argText(first.Tasks[1].Args[0]) != "2" || argText(second.Tasks[1].Args[0]) != "5" || argText(first.Tasks[0].Args[1]) != "4" {
+		t.Errorf("Expected parameters to be bound, got %v %v", first.Tasks[1].Args, second.Tasks[1].Args)
+	}
+	if first.Tasks[1].DependsOn[0] != first.Tasks[0].ID {
+		t.Errorf("Expected dependencies to point at the instantiated tasks")
+	}
+	if argText(tpl.Tasks[1].Args[0]) != "a" {
+		t.Errorf("Template shape must not be modified by evaluation")
+	}
+
+	if w = evaluate(map[string]float64{"a": 1}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for missing parameters, got %d", w.Code)
+	}
+	w = postJSON(app.TemplatesHandler, "/api/v1/templates", models.TemplateRequest{Expression: "a * x", Params: []string{"a"}})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for undeclared parameters, got %d", w.Code)
+	}
+	w = postJSON(app.TemplatesHandler, "/api/v1/templates", models.TemplateRequest{Expression: "a", Params: []string{"a", "a"}})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for duplicate parameters, got %d", w.Code)
+	}
+}
+
+func postJSON(handler http.HandlerFunc, path string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, path, bytes.NewBuffer(data)))
+	return w
+}
@@ -0,0 +1,309 @@
+package application
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// dimension — показатели степеней базовых величин: длины (m), массы (kg)
+// и времени (s). Нулевая размерность у безразмерных чисел.
+type dimension [3]int
+
+// baseUnits — обозначения базовых величин в порядке dimension.
+var baseUnits = [3]string{"m", "kg", "s"}
+
+func (d dimension) add(o dimension) dimension {
+	for i := range d {
+		d[i] += o[i]
+	}
+	return d
+}
+
+func (d dimension) sub(o dimension) dimension {
+	for i := range d {
+		d[i] -= o[i]
+	}
+	return d
+}
+
+func (d dimension) mul(n int) dimension {
+	for i := range d {
+		d[i] *= n
+	}
+	return d
+}
+
+// String записывает размерность в единицах СИ, например "kg*m/s^2";
+// у безразмерной величины запись пустая. Запись разбирает parseUnit.
+func (d dimension) String() string {
+	var num, den []string
+	for i, exp := range d {
+		term := baseUnits[i]
+		if exp > 1 || exp < -1 {
+			term += "^" + strconv.Itoa(max(exp, -exp))
+		}
+		if exp > 0 {
+			num = append(num, term)
+		} else if exp < 0 {
+			den = append(den, term)
+		}
+	}
+	if len(num) == 0 && len(den) == 0 {
+		return ""
+	}
+	if len(num) == 0 {
+		num = []string{"1"}
+	}
+	return strings.Join(append([]string{strings.Join(num, "*")}, den...), "/")
+}
+
+// unitName — запись размерности для сообщений об ошибках.
+func unitName(d dimension) string {
+	if s := d.String(); s != "" {
+		return s
+	}
+	return "dimensionless"
+}
+
+// unit — единица измерения: размерность и множитель перевода в СИ.
+type unit struct {
+	dim   dimension
+	scale *big.Rat
+}
+
+// units — единицы, которые можно указать после числа, например "5 km".
+// Множители точные, поэтому перевод не теряет точности в режимах decimal и rational.
+var units = map[string]unit{
+	"m":  {dimension{1, 0, 0}, big.NewRat(1, 1)},
+	"km": {dimension{1, 0, 0}, big.NewRat(1000, 1)},
+	"cm": {dimension{1, 0, 0}, big.NewRat(1, 100)},
+	"mm": {dimension{1, 0, 0}, big.NewRat(1, 1000)},
+	"kg": {dimension{0, 1, 0}, big.NewRat(1, 1)},
+	"g":  {dimension{0, 1, 0}, big.NewRat(1, 1000)},
+	"s":  {dimension{0, 0, 1}, big.NewRat(1, 1)},
+	"ms": {dimension{0, 0, 1}, big.NewRat(1, 1000)},
+	// "min" — единица только после числа, вызов min(...) остаётся функцией.
+	"min": {dimension{0, 0, 1}, big.NewRat(60, 1)},
+	"h":   {dimension{0, 0, 1}, big.NewRat(3600, 1)},
+	"Hz":  {dimension{0, 0, -1}, big.NewRat(1, 1)},
+	"N":   {dimension{1, 1, -2}, big.NewRat(1, 1)},
+	"J":   {dimension{2, 1, -2}, big.NewRat(1, 1)},
+	"W":   {dimension{2, 1, -3}, big.NewRat(1, 1)},
+}
+
+// parseUnit разбирает запись единицы, например "m/s", "km/h" или "kg*m/s^2":
+// обозначения из units, соединённые "*" и "/", с необязательной целой
+// степенью "^n". "1/s" — обратная единица.
+func parseUnit(text string) (unit, error) {
+	result := unit{scale: big.NewRat(1, 1)}
+	runes := []rune(strings.ReplaceAll(text, " ", ""))
+	if len(runes) == 0 {
+		return unit{}, fmt.Errorf("empty unit")
+	}
+	divide := false
+	for i := 0; i < len(runes); {
+		start := i
+		for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+			i++
+		}
+		name := string(runes[start:i])
+		var term unit
+		switch u, ok := units[name]; {
+		case ok:
+			term = u
+		case name == "1" && start == 0:
+			term = unit{scale: big.NewRat(1, 1)}
+		default:
+			return unit{}, fmt.Errorf("unknown unit %q", name)
+		}
+		exp := 1
+		if i < len(runes) && runes[i] == '^' {
+			start = i + 1
+			for i = start; i < len(runes) && (unicode.IsDigit(runes[i]) || i == start && runes[i] == '-'); i++ {
+			}
+			n, err := strconv.Atoi(string(runes[start:i]))
+			if err != nil {
+				return unit{}, fmt.Errorf("invalid exponent in unit %q", text)
+			}
+			exp = n
+		}
+		if divide {
+			exp = -exp
+		}
+		result.dim = result.dim.add(term.dim.mul(exp))
+		result.scale.Mul(result.scale, ratPow(term.scale, exp))
+		if i == len(runes) {
+			break
+		}
+		if runes[i] != '*' && runes[i] != '/' || i+1 == len(runes) {
+			return unit{}, fmt.Errorf("invalid unit %q", text)
+		}
+		divide = runes[i] == '/'
+		i++
+	}
+	return result, nil
+}
+
+// ratPow возводит дробь в целую степень.
+func ratPow(x *big.Rat, n int) *big.Rat {
+	result := big.NewRat(1, 1)
+	for i := 0; i < max(n, -n); i++ {
+		result.Mul(result, x)
+	}
+	if n < 0 {
+		result.Inv(result)
+	}
+	return result
+}
+
+// unitEntry — операнд на стеке проверки единиц: размерность, форма списка
+// или матрицы (rows и cols, 0 у чисел) и значение числовой константы,
+// если оно известно при разборе.
+type unitEntry struct {
+	dim        dimension
+	rows, cols int
+	constant   *big.Rat
+}
+
+// checkUnits проверяет согласованность единиц в RPN до построения задач:
+// складывать, сравнивать и выбирать через if можно только величины одной
+// размерности, а аргументы log, exp и тригонометрических функций должны быть
+// безразмерными. Возвращает размерность результата каждого токена и всего выражения.
+func checkUnits(tokens []token) ([]dimension, dimension, error) {
+	dims := make([]dimension, len(tokens))
+	var stack []unitEntry
+	bindings := make(map[string]unitEntry)
+	pop := func(n int) []unitEntry {
+		entries := append([]unitEntry(nil), stack[len(stack)-n:]...)
+		stack = stack[:len(stack)-n]
+		return entries
+	}
+	for i, tok := range tokens {
+		n := tokenArity(tok)
+		if len(stack) < n {
+			return nil, dimension{}, fmt.Errorf("invalid expression")
+		}
+		args := pop(n)
+		var result unitEntry
+		incompatible := func(a, b unitEntry) error {
+			return &SyntaxError{Pos: tok.pos, Token: tok.text, Message: fmt.Sprintf("incompatible units %s and %s", unitName(a.dim), unitName(b.dim))}
+		}
+		// same проверяет, что у всех аргументов одна размерность, и возвращает её.
+		same := func() (unitEntry, error) {
+			for _, a := range args[1:] {
+				if a.dim != args[0].dim {
+					return unitEntry{}, incompatible(args[0], a)
+				}
+			}
+			return unitEntry{dim: args[0].dim}, nil
+		}
+		var err error
+		switch tok.kind {
+		case tokenNumber:
+			if value, ok := new(big.Rat).SetString(tok.text); ok {
+				result.constant = value
+			}
+		case tokenUnit:
+			result.dim = units[tok.text].dim
+		case tokenIdent:
+			result = bindings[tok.text]
+		case tokenBind:
+			bindings[tok.text] = args[0]
+			continue
+		case tokenUnary:
+			result = unitEntry{dim: args[0].dim}
+			if tok.text == "!" {
+				result.dim = dimension{}
+			} else if args[0].constant != nil {
+				result.constant = args[0].constant
+				if tok.text == "-" {
+					result.constant = new(big.Rat).Neg(args[0].constant)
+				}
+			}
+		case tokenList:
+			result, err = same()
+			result.rows, result.cols = len(args), args[0].rows
+		case tokenOperator:
+			a, b := args[0], args[1]
+			switch tok.text {
+			case "+", "-", "%":
+				result, err = same()
+			case "*":
+				result.dim = a.dim.add(b.dim)
+			case "/", "//":
+				result.dim = a.dim.sub(b.dim)
+			case "^":
+				result, err = unitPower(tok, a, b)
+			case "<", "<=", ">", ">=", "==", "!=":
+				_, err = same()
+			}
+		case tokenFunction:
+			result, err = functionUnits(tok, args, same)
+		}
+		if err != nil {
+			return nil, dimension{}, err
+		}
+		dims[i] = result.dim
+		stack = append(stack, result)
+	}
+	if len(stack) != 1 {
+		return nil, dimension{}, fmt.Errorf("invalid expression")
+	}
+	return dims, stack[0].dim, nil
+}
+
+// unitPower проверяет степень a ^ b: показатель безразмерный, а у величины
+// с единицами — целая константа, иначе размерность результата неизвестна.
+func unitPower(tok token, a, b unitEntry) (unitEntry, error) {
+	if b.dim != (dimension{}) {
+		return unitEntry{}, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "exponent must be dimensionless"}
+	}
+	if a.dim == (dimension{}) {
+		return unitEntry{}, nil
+	}
+	if b.constant == nil || !b.constant.IsInt() || !b.constant.Num().IsInt64() {
+		return unitEntry{}, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: "exponent of a quantity with units must be an integer constant"}
+	}
+	return unitEntry{dim: a.dim.mul(int(b.constant.Num().Int64()))}, nil
+}
+
+// functionUnits выводит размерность результата встроенной функции.
+func functionUnits(tok token, args []unitEntry, same func() (unitEntry, error)) (unitEntry, error) {
+	switch tok.text {
+	case "abs", "min", "max", "sum", "avg":
+		return same()
+	case "len":
+		return unitEntry{}, nil
+	case "sqrt":
+		d := args[0].dim
+		for _, exp := range d {
+			if exp%2 != 0 {
+				return unitEntry{}, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: fmt.Sprintf("square root of %s", unitName(d))}
+			}
+		}
+		return unitEntry{dim: dimension{d[0] / 2, d[1] / 2, d[2] / 2}}, nil
+	case "if":
+		if args[1].dim != args[2].dim {
+			return unitEntry{}, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: fmt.Sprintf("incompatible units %s and %s", unitName(args[1].dim), unitName(args[2].dim))}
+		}
+		return args[1], nil
+	case "dot":
+		return unitEntry{dim: args[0].dim.add(args[1].dim)}, nil
+	case "matmul":
+		return unitEntry{dim: args[0].dim.add(args[1].dim), rows: args[0].rows, cols: args[1].cols}, nil
+	case "transpose":
+		return unitEntry{dim: args[0].dim, rows: args[0].cols, cols: args[0].rows}, nil
+	case "det":
+		return unitEntry{dim: args[0].dim.mul(args[0].rows)}, nil
+	}
+	// log, exp, тригонометрия и прочие функции определены только для чисел без единиц.
+	for _, a := range args {
+		if a.dim != (dimension{}) {
+			return unitEntry{}, &SyntaxError{Pos: tok.pos, Token: tok.text, Message: fmt.Sprintf("function requires a dimensionless argument, got %s", unitName(a.dim))}
+		}
+	}
+	return unitEntry{}, nil
+}
@@ -0,0 +1,413 @@
+package application
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Tuma78/server/models"
+)
+
+// userFunction — функция, зарегистрированная через /api/v1/functions.
+// RPN хранит разобранное тело, в котором вызовы других функций пользователя
+// остаются вызовами: они подставляются при разборе каждого выражения, поэтому
+// новое определение функции действует во всех выражениях, созданных после него.
+type userFunction struct {
+	Name   string   `json:"name"`
+	Params []string `json:"params"`
+	Body   string   `json:"body"`
+	Global bool     `json:"global"`
+	RPN    []token  `json:"-"`
+}
+
+// functionScope — функции пользователя, видимые выражению: собственные own
+// и глобальные global. Собственная функция закрывает глобальную с тем же
+// именем. Тело глобальной функции видит только глобальные функции.
+type functionScope struct {
+	own, global map[string]*userFunction
+}
+
+func (s *functionScope) lookup(name string) *userFunction {
+	if s == nil {
+		return nil
+	}
+	if f, ok := s.own[name]; ok {
+		return f
+	}
+	return s.global[name]
+}
+
+// acceptsArgs проверяет число аргументов вызова встроенной или пользовательской функции.
+func (s *functionScope) acceptsArgs(call token) bool {
+	if fn, ok := builtinFunctions[call.text]; ok {
+		return fn.acceptsArgs(call.argc)
+	}
+	f := s.lookup(call.text)
+	return f != nil && len(f.Params) == call.argc
+}
+
+// bodyScope — функции, видимые телу f.
+func (s *functionScope) bodyScope(f *userFunction) *functionScope {
+	if f.Global {
+		return &functionScope{global: s.global}
+	}
+	return s
+}
+
+// FunctionError — определение функции пользователя некорректно.
+type FunctionError struct {
+	Message string
+}
+
+func (e *FunctionError) Error() string {
+	return e.Message
+}
+
+// maxInlinedNodes ограничивает размер выражения после подстановки функций:
+// вложенные вызовы растут экспоненциально, и без предела одно определение
+// могло бы остановить сервер.
+const maxInlinedNodes = 10000
+
+// inlineFunctions подставляет в RPN тела вызванных функций пользователя,
+// так что агенты получают задачи только встроенных операций. Аргументы,
+// вынесенные в привязки, идут перед инструкцией, в которой сделан вызов.
+func inlineFunctions(tokens []token, scope *functionScope) ([]token, error) {
+	if scope == nil || len(scope.own) == 0 && len(scope.global) == 0 {
+		return tokens, nil
+	}
+	statements, err := rpnToTree(tokens)
+	if err != nil {
+		return nil, err
+	}
+	in := &inliner{}
+	var out []*node
+	for _, st := range statements {
+		inlined, err := in.inline(scope, st, make(map[*userFunction]bool))
+		if err != nil {
+			return nil, err
+		}
+		out = append(append(out, in.bindings...), inlined)
+		in.bindings = nil
+	}
+	return treeToRPN(out), nil
+}
+
+// inliner подставляет тела функций в одно выражение. Аргумент, который тело
+// использует несколько раз, выносится в привязку из bindings и вычисляется
+// один раз; nodes — число узлов, созданных подстановкой, named — число
+// вынесенных аргументов.
+type inliner struct {
+	bindings []*node
+	nodes    int
+	named    int
+}
+
+// inline возвращает копию дерева, в которой вызовы функций пользователя
+// заменены их телами с подставленными аргументами. active — функции, тела
+// которых подставляются сейчас: повторный вызов одной из них — рекурсия.
+func (in *inliner) inline(s *functionScope, nd *node, active map[*userFunction]bool) (*node, error) {
+	if in.nodes++; in.nodes > maxInlinedNodes {
+		return nil, &SyntaxError{Pos: nd.tok.pos, Token: nd.tok.text, Message: "expression is too large after inlining functions"}
+	}
+	args := make([]*node, len(nd.args))
+	for i, arg := range nd.args {
+		var err error
+		if args[i], err = in.inline(s, arg, active); err != nil {
+			return nil, err
+		}
+	}
+	call := nd.tok
+	if _, ok := builtinFunctions[call.text]; call.kind != tokenFunction || ok {
+		return &node{tok: call, args: args}, nil
+	}
+	f := s.lookup(call.text)
+	switch {
+	case f == nil:
+		return nil, &SyntaxError{Pos: call.pos, Token: call.text, Message: "unknown function"}
+	case len(f.Params) != len(args):
+		return nil, &SyntaxError{Pos: call.pos, Token: call.text, Message: fmt.Sprintf("wrong number of arguments (%d)", len(args))}
+	case active[f]:
+		return nil, &SyntaxError{Pos: call.pos, Token: call.text, Message: "recursive function"}
+	}
+	statements, err := rpnToTree(f.RPN)
+	if err != nil {
+		return nil, err
+	}
+
+	// Тело подставляется до аргументов, поэтому аргументы не обходятся заново
+	// на каждом уровне вложенности. Привязки, вынесенные из тела, тоже
+	// ссылаются на параметры.
+	start := len(in.bindings)
+	active[f] = true
+	body, err := in.inline(s.bodyScope(f), statements[0], active)
+	delete(active, f)
+	if err != nil {
+		return nil, err
+	}
+	uses := make(map[string]int, len(f.Params))
+	countNames(body, uses)
+	for _, b := range in.bindings[start:] {
+		countNames(b, uses)
+	}
+	values := make(map[string]*node, len(f.Params))
+	var named []*node
+	for i, p := range f.Params {
+		values[p] = args[i]
+		if uses[p] > 1 && !isAtom(args[i]) {
+			in.named++
+			name := argumentName(f, p, in.named)
+			named = append(named, &node{tok: token{kind: tokenBind, text: name, pos: call.pos}, args: []*node{args[i]}})
+			values[p] = &node{tok: token{kind: tokenIdent, text: name, pos: call.pos}}
+		}
+	}
+	for i, b := range in.bindings[start:] {
+		in.bindings[start+i] = bindArguments(b, values, call.pos)
+	}
+	in.bindings = slices.Insert(in.bindings, start, named...)
+	return bindArguments(body, values, call.pos), nil
+}
+
+// bindArguments заменяет параметры в теле функции аргументами вызова. Токены
+// тела получают позицию вызова, чтобы ошибки указывали на место в выражении.
+func bindArguments(nd *node, values map[string]*node, pos int) *node {
+	if arg, ok := values[nd.tok.text]; ok && nd.tok.kind == tokenIdent {
+		return arg
+	}
+	tok := nd.tok
+	tok.pos = pos
+	args := make([]*node, len(nd.args))
+	for i, arg := range nd.args {
+		args[i] = bindArguments(arg, values, pos)
+	}
+	return &node{tok: tok, args: args}
+}
+
+// countNames считает, сколько раз каждое имя встречается в дереве.
+func countNames(nd *node, uses map[string]int) {
+	if nd.tok.kind == tokenIdent {
+		uses[nd.tok.text]++
+	}
+	for _, arg := range nd.args {
+		countNames(arg, uses)
+	}
+}
+
+// isAtom сообщает, что узел — число, имя или число с единицей: такой
+// аргумент дёшево повторить при каждом использовании.
+func isAtom(nd *node) bool {
+	switch nd.tok.kind {
+	case tokenNumber, tokenIdent:
+		return true
+	case tokenUnit:
+		return isAtom(nd.args[0])
+	}
+	return false
+}
+
+// argumentName — имя привязки, в которую вынесен аргумент param n-го вызова
+// с вынесенными аргументами. Точки в имени нет в именах из выражения, поэтому
+// привязка не совпадает с переменными и не попадает в ответ.
+func argumentName(f *userFunction, param string, n int) string {
+	return fmt.Sprintf("%s.%s.%d", f.Name, param, n)
+}
+
+func isArgumentName(name string) bool {
+	return strings.Contains(name, ".")
+}
+
+// functionScope возвращает снимок функций, видимых пользователю user.
+func (a *Application) functionScope(user string) *functionScope {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	scope := &functionScope{
+		own:    make(map[string]*userFunction, len(a.userFunctions[user])),
+		global: make(map[string]*userFunction, len(a.globalFunctions)),
+	}
+	for name, f := range a.userFunctions[user] {
+		scope.own[name] = f
+	}
+	for name, f := range a.globalFunctions {
+		scope.global[name] = f
+	}
+	return scope
+}
+
+// requestScope — функции, видимые автору запроса из заголовка X-User-ID.
+// Заголовок не проверяется: его должен выставлять прокси, который проверил
+// пользователя (см. README).
+func (a *Application) requestScope(r *http.Request) *functionScope {
+	return a.functionScope(r.Header.Get("X-User-ID"))
+}
+
+// isAdmin сообщает, передан ли в запросе токен администратора.
+func (a *Application) isAdmin(r *http.Request) bool {
+	token := r.Header.Get("X-Admin-Token")
+	return a.config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.config.AdminToken)) == 1
+}
+
+// FunctionsHandler регистрирует функцию пользователя (POST) или возвращает
+// функции, доступные пользователю из заголовка X-User-ID (GET). Глобальную
+// функцию может зарегистрировать только администратор.
+func (a *Application) FunctionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("X-User-ID")
+	switch r.Method {
+	case http.MethodPost:
+		var req models.FunctionRequest
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Global && !a.isAdmin(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !req.Global && user == "" {
+			http.Error(w, "User not specified", http.StatusUnauthorized)
+			return
+		}
+		f, err := a.addFunction(user, req)
+		if err != nil {
+			writeExpressionCreated(w, "", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"function": f})
+	case http.MethodGet:
+		scope := a.functionScope(user)
+		out := make([]*userFunction, 0, len(scope.own)+len(scope.global))
+		for _, f := range scope.own {
+			out = append(out, f)
+		}
+		for name, f := range scope.global {
+			if _, ok := scope.own[name]; !ok {
+				out = append(out, f)
+			}
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"functions": out})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// addFunction проверяет определение и сохраняет функцию пользователя user
+// или глобальную функцию, заменяя прежнее определение с тем же именем.
+// Тело — одно выражение над параметрами; оно может вызывать встроенные
+// и другие функции пользователя, но не может приводить к рекурсии.
+func (a *Application) addFunction(user string, req models.FunctionRequest) (*userFunction, error) {
+	if tokens, err := tokenize(req.Name); err != nil || len(tokens) != 1 || tokens[0].kind != tokenIdent {
+		return nil, &FunctionError{Message: fmt.Sprintf("invalid function name %q", req.Name)}
+	}
+	if _, ok := builtinFunctions[req.Name]; ok || req.Name == "let" {
+		return nil, &FunctionError{Message: fmt.Sprintf("name %q is reserved", req.Name)}
+	}
+	if err := validateParams(req.Params); err != nil {
+		return nil, &FunctionError{Message: err.Error()}
+	}
+
+	// Тело разбирается вместе с новым определением: так вызов самой функции
+	// в теле находится как рекурсия, а не как неизвестная функция.
+	f := &userFunction{Name: req.Name, Params: req.Params, Body: req.Body, Global: req.Global}
+	scope := a.functionScope(user)
+	if req.Global {
+		scope.own = nil
+		scope.global[f.Name] = f
+	} else {
+		scope.own[f.Name] = f
+	}
+	tokens, err := parseCalls(req.Body, scope)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		if t.kind == tokenBind {
+			return nil, &FunctionError{Message: "function body must be a single expression"}
+		}
+	}
+	declared := make(map[string]float64, len(req.Params))
+	for _, p := range req.Params {
+		declared[p] = 0
+	}
+	if undeclared := unboundVariables(tokens, declared); len(undeclared) > 0 {
+		return nil, &UnboundVariablesError{Names: undeclared}
+	}
+	f.RPN = tokens
+
+	// Пробная подстановка тела находит рекурсию, в том числе через другие
+	// функции, и тела, которые после подстановки больше maxInlinedNodes.
+	statements, err := rpnToTree(tokens)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := new(inliner).inline(scope, statements[0], map[*userFunction]bool{f: true}); err != nil {
+		return nil, err
+	}
+	if err := a.checkCallers(f, scope); err != nil {
+		return nil, err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if req.Global {
+		a.globalFunctions[f.Name] = f
+	} else {
+		if a.userFunctions[user] == nil {
+			a.userFunctions[user] = make(map[string]*userFunction)
+		}
+		a.userFunctions[user][f.Name] = f
+	}
+	return f, nil
+}
+
+// checkCallers проверяет, что функции, которые могут вызывать f, по-прежнему
+// подставляются с новым определением f: например, что число аргументов
+// вызова совпадает. scope — функции автора определения вместе с f. Новое
+// глобальное определение проверяется в функциях всех пользователей, кроме
+// тех, у кого есть собственная функция с тем же именем.
+func (a *Application) checkCallers(f *userFunction, scope *functionScope) error {
+	check := func(s *functionScope, callers map[string]*userFunction) error {
+		for _, g := range callers {
+			if g == f {
+				continue
+			}
+			statements, err := rpnToTree(g.RPN)
+			if err == nil {
+				_, err = new(inliner).inline(s.bodyScope(g), statements[0], map[*userFunction]bool{g: true})
+			}
+			if err != nil {
+				return &FunctionError{Message: fmt.Sprintf("function %s would no longer be valid: %v", g.Name, err)}
+			}
+		}
+		return nil
+	}
+	if !f.Global {
+		return check(scope, scope.own)
+	}
+	if err := check(scope, scope.global); err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	users := make([]string, 0, len(a.userFunctions))
+	for u := range a.userFunctions {
+		users = append(users, u)
+	}
+	a.mutex.Unlock()
+	for _, u := range users {
+		s := a.functionScope(u)
+		if _, ok := s.own[f.Name]; ok {
+			continue
+		}
+		s.global[f.Name] = f
+		if err := check(s, s.own); err != nil {
+			return err
+		}
+	}
+	return nil
+}
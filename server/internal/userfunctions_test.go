@@ -0,0 +1,298 @@
+package application
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Tuma78/server/models"
+)
+
+// postAs отправляет запрос от имени пользователя user; admin — токен администратора.
+func postAs(handler http.HandlerFunc, path, user, admin string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewBuffer(data))
+	if user != "" {
+		r.Header.Set("X-User-ID", user)
+	}
+	if admin != "" {
+		r.Header.Set("X-Admin-Token", admin)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestInlineFunctions(t *testing.T) {
+	app := New()
+	for _, req := range []models.FunctionRequest{
+		{Name: "hyp", Params: []string{"a", "b"}, Body: "sqrt(a^2 + b^2)"},
+		{Name: "sq", Params: []string{"x"}, Body: "x * x"},
+		{Name: "twice_sq", Params: []string{"x"}, Body: "2 * sq(x)"},
+	} {
+		if _, err := app.addFunction("alice", req); err != nil {
+			t.Fatalf("addFunction(%s): %v", req.Name, err)
+		}
+	}
+	scope := app.functionScope("alice")
+
+	tokens, err := infixToRPNWith("let r = hyp(3, 4); twice_sq(r + 1)", scope)
+	if err != nil {
+		t.Fatalf("infixToRPNWith: %v", err)
+	}
+	// Аргумент, который тело использует дважды, вычисляется один раз в привязке.
+	if got, expected := rpnString(tokens), "3 2 ^ 4 2 ^ + sqrt/1 =r r 1 + =twice_sq.x.1 2 twice_sq.x.1 twice_sq.x.1 * *"; got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	tokens, _ = infixToRPNWith("sq(r) + twice_sq(hyp(r, 1))", scope)
+	if got, expected := rpnString(tokens), "r 2 ^ 1 2 ^ + sqrt/1 =twice_sq.x.1 r r * 2 twice_sq.x.1 twice_sq.x.1 * * +"; got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	for _, tc := range []struct {
+		expression string
+		message    string
+	}{
+		{"hyp(1)", "wrong number of arguments (1)"},
+		{"nope(1)", "unknown function"},
+	} {
+		_, err := infixToRPNWith(tc.expression, scope)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) || syntaxErr.Message != tc.message {
+			t.Errorf("For %q: expected %q, got %v", tc.expression, tc.message, err)
+		}
+	}
+	if _, err := infixToRPNWith("hyp(3, 4)", app.functionScope("bob")); err == nil {
+		t.Errorf("Expected functions of alice to be hidden from bob")
+	}
+}
+
+// TestNestedFunctionsStayLinear проверяет, что вложенные определения не
+// раздувают выражение: каждое тело вызывает предыдущее дважды, а аргумент
+// используется трижды.
+func TestNestedFunctionsStayLinear(t *testing.T) {
+	app := New()
+	if _, err := app.addFunction("alice", models.FunctionRequest{Name: "f0", Params: []string{"a"}, Body: "a * a + a"}); err != nil {
+		t.Fatalf("addFunction(f0): %v", err)
+	}
+	var rejected int
+	for i := 1; i <= 30 && rejected == 0; i++ {
+		req := models.FunctionRequest{Name: fmt.Sprintf("f%d", i), Params: []string{"a"}, Body: fmt.Sprintf("f%d(f%d(a))", i-1, i-1)}
+		_, err := app.addFunction("alice", req)
+		var syntaxErr *SyntaxError
+		switch {
+		case err == nil:
+		case errors.As(err, &syntaxErr) && strings.Contains(syntaxErr.Message, "too large"):
+			rejected = i
+		default:
+			t.Fatalf("addFunction(%s): %v", req.Name, err)
+		}
+	}
+	if rejected == 0 {
+		t.Fatalf("Expected a definition to exceed %d nodes", maxInlinedNodes)
+	}
+
+	// Вложенные вызовы f0 не копируют аргумент: f3(x) — 8 вызовов по 5 узлов.
+	tokens, err := infixToRPNWith("f3(x + 1)", app.functionScope("alice"))
+	if err != nil {
+		t.Fatalf("infixToRPNWith: %v", err)
+	}
+	if len(tokens) > 8*7 {
+		t.Errorf("Expected a linear expansion, got %d tokens: %s", len(tokens), rpnString(tokens))
+	}
+	if _, err := infixToRPNWith(fmt.Sprintf("f%d(x)", rejected-1), app.functionScope("alice")); err != nil {
+		t.Errorf("Expected the largest accepted function to be usable, got %v", err)
+	}
+}
+
+// TestInlinedArgumentIsLazy проверяет, что аргумент, вынесенный в привязку
+// из ветви if, вычисляется только в выбранной ветви и не попадает в ответ.
+func TestInlinedArgumentIsLazy(t *testing.T) {
+	app := New()
+	if _, err := app.addFunction("alice", models.FunctionRequest{Name: "sq", Params: []string{"x"}, Body: "x * x"}); err != nil {
+		t.Fatalf("addFunction: %v", err)
+	}
+	for _, tc := range []struct {
+		condition float64
+		expected  string
+	}{
+		{0, "0"},
+		{1, "4"},
+	} {
+		w := postAs(app.CalcHandler, "/api/v1/calculate", "alice", "", models.Request{Expression: "if(y > 0, sq(sqrt(y)), 0)", Variables: map[string]float64{"y": 4}})
+		var created models.Response
+		json.NewDecoder(w.Body).Decode(&created)
+		greater := fetchTask(t, app)
+		if greater.Operation != models.OperationGreater {
+			t.Fatalf("Expected only the condition to be dispatched, got %s", greater.Operation)
+		}
+		postResult(t, app, greater, tc.condition, http.StatusOK)
+		if tc.condition != 0 {
+			sqrt := fetchTask(t, app)
+			if sqrt.Operation != models.OperationSqrt {
+				t.Fatalf("Expected sqrt once the branch is chosen, got %s", sqrt.Operation)
+			}
+			postResult(t, app, sqrt, 2, http.StatusOK)
+			multiplication := fetchTask(t, app)
+			if argText(multiplication.Args[0]) != "2" || argText(multiplication.Args[1]) != "2" {
+				t.Fatalf("Expected 2 * 2, got %v", multiplication.Args)
+			}
+			postResult(t, app, multiplication, 4, http.StatusOK)
+		}
+		expr := app.expressions[created.ID]
+		if expr.Status != StatusCompleted || string(expr.Result) != tc.expected || len(expr.Bindings) != 0 {
+			t.Errorf("For condition %v: expected %s without bindings, got %s %s %v", tc.condition, tc.expected, expr.Status, expr.Result, expr.Bindings)
+		}
+	}
+	if len(app.taskQueue) != 0 {
+		t.Errorf("Expected the unchosen argument never to be queued, got %d tasks", len(app.taskQueue))
+	}
+}
+
+func TestFunctionsHandler(t *testing.T) {
+	app := New()
+	app.config.AdminToken = "secret"
+	hyp := models.FunctionRequest{Name: "hyp", Params: []string{"a", "b"}, Body: "sqrt(a^2 + b^2)"}
+
+	if w := postAs(app.FunctionsHandler, "/api/v1/functions", "", "", hyp); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without user, got %d", w.Code)
+	}
+	if w := postAs(app.FunctionsHandler, "/api/v1/functions", "alice", "", hyp); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Тело подставляется в граф задач и упрощается: агент получает только sqrt(25).
+	w := postAs(app.CalcHandler, "/api/v1/calculate", "alice", "", models.Request{Expression: "hyp(3, 4)"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created models.Response
+	json.NewDecoder(w.Body).Decode(&created)
+	task := fetchTask(t, app)
+	if task.Operation != models.OperationSqrt || argText(task.Args[0]) != "25" {
+		t.Fatalf("Expected sqrt(25), got %s %v", task.Operation, task.Args)
+	}
+	postResult(t, app, task, 5, http.StatusOK)
+	if expr := app.expressions[created.ID]; string(expr.Result) != "5" {
+		t.Errorf("Expected 5, got %s", expr.Result)
+	}
+	if w := postAs(app.CalcHandler, "/api/v1/calculate", "bob", "", models.Request{Expression: "hyp(3, 4)"}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a function of another user, got %d", w.Code)
+	}
+
+	cube := models.FunctionRequest{Name: "cube", Params: []string{"x"}, Body: "x ^ 3", Global: true}
+	if w := postAs(app.FunctionsHandler, "/api/v1/functions", "bob", "", cube); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for global function without admin token, got %d", w.Code)
+	}
+	if w := postAs(app.FunctionsHandler, "/api/v1/functions", "", "wrong", cube); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for wrong admin token, got %d", w.Code)
+	}
+	if w := postAs(app.FunctionsHandler, "/api/v1/functions", "", "secret", cube); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 for global function, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := postAs(app.CalcHandler, "/api/v1/calculate", "bob", "", models.Request{Expression: "cube(2)"}); w.Code != http.StatusCreated {
+		t.Errorf("Expected global function to be available, got %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, req := range []models.FunctionRequest{
+		{Name: "g", Params: []string{"x"}, Body: "x"},
+		{Name: "f", Params: []string{"x"}, Body: "g(x) + cube(x)"},
+	} {
+		if w := postAs(app.FunctionsHandler, "/api/v1/functions", "alice", "", req); w.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 for %s, got %d: %s", req.Name, w.Code, w.Body.String())
+		}
+	}
+	for _, tc := range []struct {
+		req     models.FunctionRequest
+		details string
+	}{
+		{models.FunctionRequest{Name: "g", Params: []string{"x"}, Body: "f(x) * 2"}, "recursive function"},
+		{models.FunctionRequest{Name: "h", Params: []string{"x"}, Body: "h(x - 1)"}, "recursive function"},
+		{models.FunctionRequest{Name: "k", Params: []string{"x"}, Body: "x + y"}, "unbound variables: y"},
+		{models.FunctionRequest{Name: "m", Params: []string{"x"}, Body: "hyp(x)"}, "wrong number of arguments (1)"},
+		{models.FunctionRequest{Name: "sqrt", Params: []string{"x"}, Body: "x"}, "reserved"},
+		{models.FunctionRequest{Name: "2n", Params: []string{"x"}, Body: "x"}, "invalid function name"},
+		{models.FunctionRequest{Name: "n", Params: []string{"x", "x"}, Body: "x"}, "duplicate parameter"},
+		{models.FunctionRequest{Name: "n", Params: []string{"x"}, Body: "let y = x; y"}, "single expression"},
+		// f вызывает g с одним аргументом.
+		{models.FunctionRequest{Name: "g", Params: []string{"x", "y"}, Body: "x + y"}, "function f would no longer be valid"},
+		{models.FunctionRequest{Name: "cube", Params: []string{"x", "y"}, Body: "x ^ 3 + y", Global: true}, "function f would no longer be valid"},
+	} {
+		w := postAs(app.FunctionsHandler, "/api/v1/functions", "alice", "secret", tc.req)
+		var resp models.Response
+		json.NewDecoder(w.Body).Decode(&resp)
+		if w.Code != http.StatusUnprocessableEntity || !strings.Contains(resp.Details, tc.details) {
+			t.Errorf("For %s = %q: expected 422 with %q, got %d %+v", tc.req.Name, tc.req.Body, tc.details, w.Code, resp)
+		}
+	}
+	// Новое определение с тем же числом параметров не ломает вызовы.
+	for _, req := range []models.FunctionRequest{
+		{Name: "g", Params: []string{"y"}, Body: "y * 2"},
+		{Name: "cube", Params: []string{"x"}, Body: "x * x * x", Global: true},
+	} {
+		if w := postAs(app.FunctionsHandler, "/api/v1/functions", "alice", "secret", req); w.Code != http.StatusCreated {
+			t.Errorf("Expected 201 for %s, got %d: %s", req.Name, w.Code, w.Body.String())
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/functions", nil)
+	r.Header.Set("X-User-ID", "alice")
+	w = httptest.NewRecorder()
+	app.FunctionsHandler(w, r)
+	var list struct {
+		Functions []userFunction `json:"functions"`
+	}
+	json.NewDecoder(w.Body).Decode(&list)
+	var names []string
+	for _, f := range list.Functions {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "cube,f,g,hyp" {
+		t.Errorf("Expected cube,f,g,hyp, got %v", names)
+	}
+}
+
+// TestFunctionCallRendering проверяет, что запись выражения сохраняет вызовы
+// функций пользователя: привязки, в которые вынесены аргументы, в неё не
+// попадают, и запись снова разбирается в то же выражение.
+func TestFunctionCallRendering(t *testing.T) {
+	app := New()
+	sq := models.FunctionRequest{Name: "sq", Params: []string{"x"}, Body: "x * x"}
+	if _, err := app.addFunction("alice", sq); err != nil {
+		t.Fatalf("addFunction: %v", err)
+	}
+	formatted := func(expression, format string) string {
+		t.Helper()
+		w := postAs(app.CalcHandler, "/api/v1/calculate", "alice", "", models.Request{Expression: expression, Variables: map[string]float64{"a": 2}})
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 for %q, got %d: %s", expression, w.Code, w.Body.String())
+		}
+		var created models.Response
+		json.NewDecoder(w.Body).Decode(&created)
+		w = httptest.NewRecorder()
+		app.ExpressionHandler(w, httptest.NewRequest(http.MethodGet, "/api/v1/expressions/"+created.ID+"?format="+format, nil))
+		var resp struct {
+			Expression struct {
+				Formatted string `json:"formatted"`
+			} `json:"expression"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Expression.Formatted
+	}
+
+	infix := formatted("sq((a + 1)) * 2", "infix")
+	if infix != "sq(a + 1) * 2" {
+		t.Fatalf("Expected sq(a + 1) * 2, got %q", infix)
+	}
+	if again := formatted(infix, "infix"); again != infix {
+		t.Errorf("Expected %q to render to itself, got %q", infix, again)
+	}
+	if latex := formatted(infix, "latex"); latex != `\operatorname{sq}\left(a + 1\right) \cdot 2` {
+		t.Errorf("Unexpected LaTeX %q", latex)
+	}
+}
@@ -0,0 +1,61 @@
+package models
+
+import "encoding/json"
+
+// Operand — аргумент задачи: значение Value, ссылка Ref на задачу, результат
+// которой ещё не получен, или список List. Значение кодируется так же, как
+// результат задачи: числом JSON в режиме float, строкой в режимах decimal и rational
+// и объектом Complex в режиме complex.
+type Operand struct {
+	Value json.RawMessage `json:"value,omitempty"`
+	Ref   string          `json:"ref,omitempty"`
+	// Index — позиция [строка, столбец] в матрице-результате задачи Ref,
+	// например в блоке произведения матриц.
+	Index []int `json:"index,omitempty"`
+	// List — элементы списка: значения и ссылки. Матрица — список строк,
+	// каждая строка — список одной и той же длины.
+	List []Operand `json:"list,omitempty"`
+	// Param — имя параметра шаблона; значение подставляется при вычислении шаблона.
+	Param string `json:"param,omitempty"`
+}
+
+// IsValue сообщает, известно ли значение операнда. Список значением не считается.
+func (o Operand) IsValue() bool {
+	return o.Ref == "" && o.Param == "" && o.List == nil
+}
+
+// IsList сообщает, является ли операнд списком.
+func (o Operand) IsList() bool {
+	return o.List != nil
+}
+
+// Resolved сообщает, известно ли значение операнда или всех элементов списка.
+func (o Operand) Resolved() bool {
+	if !o.IsList() {
+		return o.IsValue()
+	}
+	for _, item := range o.List {
+		if !item.Resolved() {
+			return false
+		}
+	}
+	return true
+}
+
+// Refs возвращает ID задач, на которые ссылается операнд или элементы списка.
+// ID может повторяться, если на задачу ссылаются несколько элементов.
+func (o Operand) Refs() []string {
+	if o.Ref != "" {
+		return []string{o.Ref}
+	}
+	var refs []string
+	for _, item := range o.List {
+		refs = append(refs, item.Refs()...)
+	}
+	return refs
+}
+
+// IsMatrix сообщает, является ли операнд матрицей — списком строк-списков.
+func (o Operand) IsMatrix() bool {
+	return o.IsList() && o.List[0].IsList()
+}
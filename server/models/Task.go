@@ -1,17 +1,112 @@
 package models
+
+import "time"
+
+// Task — одна операция выражения над аргументами Args. DependsOn содержит ID задач, на которые
+// ссылаются аргументы; задача попадает в очередь, когда все они выполнены.
 type Task struct {
 	ID            string    `json:"id"`
-	Arg1          string    `json:"arg1"`          
-	Arg2          string    `json:"arg2"`          
-	Operation     Operation `json:"operation"`     
+	ExpressionID  string    `json:"-"`
+	Args          []Operand `json:"args"`
+	Operation     Operation `json:"operation"`
 	OperationTime int       `json:"operation_time"`
+	DependsOn     []string  `json:"depends_on,omitempty"`
+	// Mode — режим вычислений; в режиме decimal аргументы и результат
+	// передаются десятичными строками произвольной точности, в режиме
+	// complex — объектами {"re": .., "im": ..}, в режиме interval — {"lo": .., "hi": ..}.
+	Mode NumberMode `json:"mode,omitempty"`
+	// Unit — единица результата задачи в СИ, например "m/s"; пусто у безразмерных.
+	Unit string `json:"unit,omitempty"`
+	Done bool   `json:"-"`
+	// LeaseID и LeaseDeadline заполняются, когда задача выдана агенту.
+	LeaseID       string    `json:"-"`
+	LeaseDeadline time.Time `json:"-"`
+	// Guards — условия, при которых задача вообще нужна: задача из ветви if
+	// выдаётся агенту, только когда задача select выбрала эту ветвь.
+	Guards []Guard `json:"-"`
+	// Chosen — ветвь, выбранная задачей select: 0, пока условие не вычислено, затем 1 или 2.
+	Chosen int `json:"-"`
+}
+
+// Guard связывает задачу с ветвью Branch (1 или 2) задачи select с ID Select.
+type Guard struct {
+	Select string
+	Branch int
+}
+
+type NumberMode string
+
+const (
+	NumberModeFloat   NumberMode = "float"
+	NumberModeDecimal NumberMode = "decimal"
+	// NumberModeRational — точные дроби: аргументы и результат передаются
+	// строками вида "1/3".
+	NumberModeRational NumberMode = "rational"
+	// NumberModeComplex — комплексные числа: аргументы и результат
+	// передаются объектами Complex.
+	NumberModeComplex NumberMode = "complex"
+	// NumberModeInterval — интервальная арифметика: значения передаются
+	// объектами Interval, а агент округляет границы наружу.
+	NumberModeInterval NumberMode = "interval"
+)
+
+// Complex — значение в режиме complex.
+type Complex struct {
+	Re float64 `json:"re"`
+	Im float64 `json:"im"`
+}
+
+// Interval — значение в режиме interval: отрезок, содержащий точный результат.
+type Interval struct {
+	Lo float64 `json:"lo"`
+	Hi float64 `json:"hi"`
 }
 
 type Operation string
 
 const (
-	OperationAddition       Operation = "addition"
-	OperationSubtraction    Operation = "subtraction"
-	OperationMultiplication Operation = "multiplication"
-	OperationDivision       Operation = "division"
+	OperationAddition        Operation = "addition"
+	OperationSubtraction     Operation = "subtraction"
+	OperationMultiplication  Operation = "multiplication"
+	OperationDivision        Operation = "division"
+	OperationExponentiation  Operation = "exponentiation"
+	OperationModulo          Operation = "modulo"
+	OperationIntegerDivision Operation = "integer_division"
+	// OperationNegation — унарный минус, использует только первый аргумент.
+	OperationNegation Operation = "negation"
+
+	// Сравнения и логические операции возвращают 1 (истина) или 0 (ложь);
+	// любое ненулевое значение считается истинным.
+	OperationLess         Operation = "less"
+	OperationLessEqual    Operation = "less_equal"
+	OperationGreater      Operation = "greater"
+	OperationGreaterEqual Operation = "greater_equal"
+	OperationEqual        Operation = "equal"
+	OperationNotEqual     Operation = "not_equal"
+	OperationAnd          Operation = "and"
+	OperationOr           Operation = "or"
+	OperationNot          Operation = "not"
+	// OperationSelect — if(условие, a, b). Выполняется оркестратором и агентам не выдаётся.
+	OperationSelect Operation = "select"
+
+	// Встроенные функции, см. builtinFunctions в оркестраторе.
+	OperationSqrt Operation = "sqrt"
+	OperationAbs  Operation = "abs"
+	OperationMin  Operation = "min"
+	OperationMax  Operation = "max"
+	OperationLog  Operation = "log"
+	OperationExp  Operation = "exp"
+	OperationSin  Operation = "sin"
+	OperationCos  Operation = "cos"
+	OperationTan  Operation = "tan"
+
+	// Агрегаты над списками: sum и min/max принимают списки и числа вперемешку,
+	// dot — два списка одной длины.
+	OperationSum Operation = "sum"
+	OperationDot Operation = "dot"
+
+	// Матричные операции. matmul умножает блок строк первой матрицы на блок
+	// столбцов второй и возвращает матрицу: массив строк JSON.
+	OperationMatmul      Operation = "matmul"
+	OperationDeterminant Operation = "determinant"
 )
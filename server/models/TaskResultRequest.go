@@ -1,6 +1,21 @@
 package models
 
+import "encoding/json"
+
+// TaskResultRequest — результат задачи от агента: число в режиме float и
+// десятичная строка в режиме decimal. Если вычисление не удалось, агент
+// заполняет Error вместо Result. Unit, если указан, должен совпадать с
+// единицей задачи.
 type TaskResultRequest struct {
-	ID     string  `json:"id"`
-	Result float64 `json:"result"`
-}
\ No newline at end of file
+	ID      string          `json:"id"`
+	LeaseID string          `json:"lease_id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Unit    string          `json:"unit,omitempty"`
+	Error   *TaskError      `json:"error,omitempty"`
+}
+
+// TaskError описывает причину, по которой агент не смог выполнить задачу.
+type TaskError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
@@ -1,5 +1,52 @@
 package models
 
+// Request — запрос на вычисление выражения. Variables задаёт значения
+// переменных, встречающихся в выражении. Режим вычислений задаётся полем
+// NumberMode ("float" по умолчанию, "decimal", "rational", "complex" или "interval"); Precision —
+// прежнее название того же поля. Expression может быть сценарием с привязками
+// let; IncludeBindings добавляет значения привязок в ответ. To — единица,
+// в которую переводится результат, например "km/h". NoOptimize отключает
+// упрощение выражения: каждая операция выполняется агентом.
 type Request struct {
-	Expression string `json:"expression"`
-}
\ No newline at end of file
+	Expression      string             `json:"expression"`
+	Variables       map[string]float64 `json:"variables,omitempty"`
+	Precision       NumberMode         `json:"precision,omitempty"`
+	NumberMode      NumberMode         `json:"number_mode,omitempty"`
+	IncludeBindings bool               `json:"include_bindings,omitempty"`
+	To              string             `json:"to,omitempty"`
+	NoOptimize      bool               `json:"no_optimize,omitempty"`
+}
+
+// EvaluateRequest — запрос на пересчёт сохранённого выражения с другими
+// значениями переменных.
+type EvaluateRequest struct {
+	Variables map[string]float64 `json:"variables"`
+}
+
+// TemplateRequest — запрос на создание шаблона выражения с объявленными параметрами.
+type TemplateRequest struct {
+	Expression string     `json:"expression"`
+	Params     []string   `json:"params"`
+	Precision  NumberMode `json:"precision,omitempty"`
+	NumberMode NumberMode `json:"number_mode,omitempty"`
+}
+
+// DeriveRequest — запрос производной выражения по переменной Variable.
+// Если задана точка Point, производная вычисляется в ней; Variables —
+// значения остальных переменных.
+type DeriveRequest struct {
+	Expression string             `json:"expression"`
+	Variable   string             `json:"variable"`
+	Point      *float64           `json:"point,omitempty"`
+	Variables  map[string]float64 `json:"variables,omitempty"`
+	NumberMode NumberMode         `json:"number_mode,omitempty"`
+}
+
+// FunctionRequest — запрос на регистрацию функции пользователя с параметрами
+// Params и телом Body. Global делает функцию доступной всем пользователям.
+type FunctionRequest struct {
+	Name   string   `json:"name"`
+	Params []string `json:"params"`
+	Body   string   `json:"body"`
+	Global bool     `json:"global,omitempty"`
+}
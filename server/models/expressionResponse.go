@@ -1,6 +1,15 @@
 package models
 
+// Response — ответ на запрос вычисления. Для синтаксических ошибок
+// Position и Token указывают, где выражение не удалось разобрать.
 type Response struct {
-	ID    string `json:"id,omitempty"`
-	Error string `json:"error,omitempty"`
-}
\ No newline at end of file
+	ID       string `json:"id,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Details  string `json:"details,omitempty"`
+	Position *int   `json:"position,omitempty"`
+	Token    string `json:"token,omitempty"`
+	// Unbound — переменные выражения, для которых не передано значение.
+	Unbound []string `json:"unbound,omitempty"`
+	// EliminatedTasks — число задач, устранённых упрощением выражения.
+	EliminatedTasks int `json:"eliminated_tasks,omitempty"`
+}